@@ -309,6 +309,15 @@ type CreateRequest struct {
 	Parameters map[string]any    `json:"parameters,omitempty"`
 	Messages   []Message         `json:"messages,omitempty"`
 
+	// NoTemplate skips detecting a chat template from the model files so
+	// none is attached unless Template is set.
+	NoTemplate bool `json:"no_template,omitempty"`
+
+	// SplitSize splits a model converted from safetensors into model layers
+	// of at most this many bytes of tensor data each. Zero converts it to a
+	// single layer.
+	SplitSize uint64 `json:"split_size,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 	// Deprecated: use Quantize instead
@@ -351,6 +360,10 @@ type ShowResponse struct {
 	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
 	Tensors       []Tensor       `json:"tensors,omitempty"`
 	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+
+	// LayerErrors are the errors of layers that couldn't be read or don't
+	// match their model, keyed by digest. It's only set for verbose requests.
+	LayerErrors map[string]string `json:"layer_errors,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -359,6 +372,39 @@ type CopyRequest struct {
 	Destination string `json:"destination"`
 }
 
+// DiffRequest is the request passed to [Client.Diff].
+type DiffRequest struct {
+	A string `json:"a"`
+	B string `json:"b"`
+
+	// Pull pulls models that aren't available locally instead of failing
+	Pull bool `json:"pull,omitempty"`
+}
+
+// DiffResponse is the response returned from [Client.Diff]. It lists only
+// the layers and metadata that differ between the models.
+type DiffResponse struct {
+	Layers []LayerDiff `json:"layers,omitempty"`
+	KV     []KVDiff    `json:"kv,omitempty"`
+}
+
+// LayerDiff is a layer whose digest differs between two models. An empty
+// digest means the model has no layer at that position.
+type LayerDiff struct {
+	MediaType string `json:"media_type"`
+	A         string `json:"a,omitempty"`
+	B         string `json:"b,omitempty"`
+}
+
+// KVDiff is a metadata key whose value differs between the model layers of
+// two models. A nil value means the key is not set.
+type KVDiff struct {
+	MediaType string `json:"media_type"`
+	Key       string `json:"key"`
+	A         any    `json:"a"`
+	B         any    `json:"b"`
+}
+
 // PullRequest is the request passed to [Client.Pull].
 type PullRequest struct {
 	Model    string `json:"model"`
@@ -33,12 +33,15 @@ import (
 	"golang.org/x/term"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/convert"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/progress"
 	"github.com/ollama/ollama/runner"
 	"github.com/ollama/ollama/server"
+	"github.com/ollama/ollama/types/errtypes"
 	"github.com/ollama/ollama/types/model"
 	"github.com/ollama/ollama/version"
 )
@@ -111,18 +114,22 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 		req.Quantize = quantize
 	}
 
+	req.NoTemplate, _ = cmd.Flags().GetBool("no-template")
+	req.SplitSize, _ = cmd.Flags().GetUint64("split-size")
+
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
 	}
 
 	if len(req.Files) > 0 {
+		names := fileNames(req.Files)
 		fileMap := map[string]string{}
 		for f, digest := range req.Files {
 			if _, err := createBlob(cmd, client, f, digest, p); err != nil {
 				return err
 			}
-			fileMap[filepath.Base(f)] = digest
+			fileMap[names[f]] = digest
 		}
 		req.Files = fileMap
 	}
@@ -148,6 +155,18 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 				p.Add(resp.Digest, bar)
 			}
 
+			bar.Set(resp.Completed)
+		} else if resp.Total > 0 {
+			// conversion phases have no digest so their bars are keyed by status
+			bar, ok := bars[resp.Status]
+			if !ok {
+				spinner.Stop()
+
+				bar = progress.NewBar(resp.Status, resp.Total, resp.Completed)
+				bars[resp.Status] = bar
+				p.Add(resp.Status, bar)
+			}
+
 			bar.Set(resp.Completed)
 		} else if status != resp.Status {
 			spinner.Stop()
@@ -170,6 +189,42 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// fileNames returns the name each file is sent to the server as. Names are
+// relative to the deepest directory containing every file so files nested in
+// a model directory, e.g. 1_Pooling/config.json, keep their layout.
+func fileNames(files map[string]string) map[string]string {
+	var dir string
+	for f := range files {
+		if dir == "" {
+			dir = filepath.Dir(f)
+		}
+
+		for {
+			if rel, err := filepath.Rel(dir, f); err == nil && filepath.IsLocal(rel) {
+				break
+			}
+
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+
+	names := make(map[string]string, len(files))
+	for f := range files {
+		rel, err := filepath.Rel(dir, f)
+		if err != nil || !filepath.IsLocal(rel) {
+			rel = filepath.Base(f)
+		}
+
+		names[f] = filepath.ToSlash(rel)
+	}
+
+	return names
+}
+
 func createBlob(cmd *cobra.Command, client *api.Client, path string, digest string, p *progress.Progress) (string, error) {
 	realPath, err := filepath.EvalSymlinks(path)
 	if err != nil {
@@ -661,6 +716,9 @@ func showInfo(resp *api.ShowResponse, verbose bool, w io.Writer) error {
 			rows = append(rows, []string{"", "parameters", format.HumanNumber(uint64(resp.ModelInfo["general.parameter_count"].(float64)))})
 			rows = append(rows, []string{"", "context length", strconv.FormatFloat(resp.ModelInfo[fmt.Sprintf("%s.context_length", arch)].(float64), 'f', -1, 64)})
 			rows = append(rows, []string{"", "embedding length", strconv.FormatFloat(resp.ModelInfo[fmt.Sprintf("%s.embedding_length", arch)].(float64), 'f', -1, 64)})
+			if tokenizer, ok := resp.ModelInfo["tokenizer.ggml.model"].(string); ok {
+				rows = append(rows, []string{"", "tokenizer", tokenizer})
+			}
 		} else {
 			rows = append(rows, []string{"", "architecture", resp.Details.Family})
 			rows = append(rows, []string{"", "parameters", resp.Details.ParameterSize})
@@ -680,6 +738,21 @@ func showInfo(resp *api.ShowResponse, verbose bool, w io.Writer) error {
 		})
 	}
 
+	if len(resp.LayerErrors) > 0 {
+		tableRender("Layer errors", func() (rows [][]string) {
+			digests := make([]string, 0, len(resp.LayerErrors))
+			for digest := range resp.LayerErrors {
+				digests = append(digests, digest)
+			}
+			sort.Strings(digests)
+
+			for _, digest := range digests {
+				rows = append(rows, []string{"", digest, resp.LayerErrors[digest]})
+			}
+			return
+		})
+	}
+
 	if resp.Parameters != "" {
 		tableRender("Parameters", func() (rows [][]string) {
 			scanner := bufio.NewScanner(strings.NewReader(resp.Parameters))
@@ -772,6 +845,136 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func DiffHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	pull, err := cmd.Flags().GetBool("pull")
+	if err != nil {
+		return err
+	}
+
+	diff, err := client.Diff(cmd.Context(), &api.DiffRequest{A: args[0], B: args[1], Pull: pull})
+	if err != nil {
+		return err
+	}
+
+	if len(diff.Layers) == 0 && len(diff.KV) == 0 {
+		fmt.Printf("'%s' and '%s' are the same\n", args[0], args[1])
+		return nil
+	}
+
+	value := func(v any) string {
+		if v == nil {
+			return "-"
+		}
+
+		return fmt.Sprint(v)
+	}
+
+	digest := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+
+		return strings.TrimPrefix(s, "sha256:")[:12]
+	}
+
+	var data [][]string
+	for _, l := range diff.Layers {
+		data = append(data, []string{strings.TrimPrefix(l.MediaType, "application/vnd.ollama.image."), digest(l.A), digest(l.B)})
+	}
+
+	for _, kv := range diff.KV {
+		data = append(data, []string{kv.Key, value(kv.A), value(kv.B)})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"", args[0], args[1]})
+	table.SetAutoFormatHeaders(false)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func ExportHandler(cmd *cobra.Command, args []string) error {
+	shardSize, err := cmd.Flags().GetUint64("shard-size")
+	if err != nil {
+		return err
+	}
+
+	name := model.ParseName(args[0])
+	if !name.IsValid() {
+		return errors.New(errtypes.InvalidModelNameErrMsg)
+	}
+
+	// export only reads the local models directory, so the manifest is read
+	// directly rather than with server.GetModel, which links the splits of
+	// split models into it
+	m, err := server.ParseNamedManifest(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("model %s not found", args[0])
+	} else if err != nil {
+		return err
+	}
+
+	var models []server.Layer
+	for _, layer := range m.Layers {
+		switch layer.MediaType {
+		case "application/vnd.ollama.image.model":
+			models = append(models, layer)
+		case "application/vnd.ollama.image.adapter":
+			return fmt.Errorf("exporting %s is not supported: models with adapters can't be exported", args[0])
+		}
+	}
+
+	switch {
+	case len(models) == 0:
+		return fmt.Errorf("%s has no model to export", args[0])
+	case len(models) > 1:
+		return fmt.Errorf("exporting %s is not supported: split models can't be exported", args[0])
+	}
+
+	blob, err := server.GetBlobsPath(models[0].Digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(args[1], 0o755); err != nil {
+		return err
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	status := "exporting model"
+	spinner := progress.NewSpinner(status)
+	p.Add(status, spinner)
+
+	if err := convert.ExportModel(f, args[1], convert.ExportOptions{ShardSize: shardSize, Dequantize: llama.Dequantize}); err != nil {
+		return err
+	}
+	spinner.Stop()
+
+	fmt.Printf("exported '%s' to '%s'\n", args[0], args[1])
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
@@ -1225,6 +1428,8 @@ func NewCLI() *cobra.Command {
 
 	createCmd.Flags().StringP("file", "f", "", "Name of the Modelfile (default \"Modelfile\"")
 	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_0)")
+	createCmd.Flags().Bool("no-template", false, "Don't attach a chat template detected from the model files")
+	createCmd.Flags().Uint64("split-size", 0, "Split a model converted from safetensors into layers of at most this many bytes")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -1314,6 +1519,25 @@ func NewCLI() *cobra.Command {
 		RunE:    CopyHandler,
 	}
 
+	diffCmd := &cobra.Command{
+		Use:     "diff MODEL MODEL",
+		Short:   "Compare the layers and metadata of two models",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    DiffHandler,
+	}
+
+	diffCmd.Flags().Bool("pull", false, "Pull models that aren't available locally")
+
+	exportCmd := &cobra.Command{
+		Use:   "export MODEL DIRECTORY",
+		Short: "Export a model to safetensors",
+		Args:  cobra.ExactArgs(2),
+		RunE:  ExportHandler,
+	}
+
+	exportCmd.Flags().Uint64("shard-size", 5*format.GigaByte, "Largest size in bytes of each safetensors file")
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
 		Short:   "Remove a model",
@@ -1348,6 +1572,7 @@ func NewCLI() *cobra.Command {
 		listCmd,
 		psCmd,
 		copyCmd,
+		diffCmd,
 		deleteCmd,
 		serveCmd,
 	} {
@@ -1367,6 +1592,7 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_ORIGINS"],
 				envVars["OLLAMA_SCHED_SPREAD"],
 				envVars["OLLAMA_TMPDIR"],
+				envVars["OLLAMA_TEMPLATES"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
 				envVars["OLLAMA_KV_CACHE_TYPE"],
 				envVars["OLLAMA_LLM_LIBRARY"],
@@ -1389,6 +1615,8 @@ func NewCLI() *cobra.Command {
 		listCmd,
 		psCmd,
 		copyCmd,
+		diffCmd,
+		exportCmd,
 		deleteCmd,
 		runnerCmd,
 	)
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +17,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/server"
+	"github.com/ollama/ollama/types/model"
 )
 
 func TestShowInfo(t *testing.T) {
@@ -36,6 +40,34 @@ func TestShowInfo(t *testing.T) {
     parameters      7B      
     quantization    FP16    
 
+`
+
+		if diff := cmp.Diff(expect, b.String()); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("layer errors", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := showInfo(&api.ShowResponse{
+			Details: api.ModelDetails{
+				Family:            "test",
+				ParameterSize:     "7B",
+				QuantizationLevel: "FP16",
+			},
+			LayerErrors: map[string]string{"sha256:abc123": "invalid file magic"},
+		}, true, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := `  Model
+    architecture    test    
+    parameters      7B      
+    quantization    FP16    
+
+  Layer errors
+    sha256:abc123    invalid file magic    
+
 `
 
 		if diff := cmp.Diff(expect, b.String()); diff != "" {
@@ -51,6 +83,7 @@ func TestShowInfo(t *testing.T) {
 				"general.parameter_count": float64(7_000_000_000),
 				"test.context_length":     float64(0),
 				"test.embedding_length":   float64(0),
+				"tokenizer.ggml.model":    "gpt2",
 			},
 			Details: api.ModelDetails{
 				Family:            "test",
@@ -66,6 +99,7 @@ func TestShowInfo(t *testing.T) {
     parameters          7B      
     context length      0       
     embedding length    0       
+    tokenizer           gpt2    
     quantization        FP16    
 
 `
@@ -890,3 +924,176 @@ func TestNewCreateRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestFileNames(t *testing.T) {
+	root := t.TempDir()
+
+	cases := []struct {
+		name     string
+		files    []string
+		expected map[string]string
+	}{
+		{
+			"single file",
+			[]string{filepath.Join(root, "model.gguf")},
+			map[string]string{filepath.Join(root, "model.gguf"): "model.gguf"},
+		},
+		{
+			"nested directory",
+			[]string{
+				filepath.Join(root, "model.safetensors"),
+				filepath.Join(root, "config.json"),
+				filepath.Join(root, "1_Pooling", "config.json"),
+			},
+			map[string]string{
+				filepath.Join(root, "model.safetensors"):        "model.safetensors",
+				filepath.Join(root, "config.json"):              "config.json",
+				filepath.Join(root, "1_Pooling", "config.json"): "1_Pooling/config.json",
+			},
+		},
+		{
+			"sibling directories",
+			[]string{
+				filepath.Join(root, "a", "model.gguf"),
+				filepath.Join(root, "b", "projector.gguf"),
+			},
+			map[string]string{
+				filepath.Join(root, "a", "model.gguf"):     "a/model.gguf",
+				filepath.Join(root, "b", "projector.gguf"): "b/projector.gguf",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(map[string]string)
+			for _, f := range tt.files {
+				files[f] = "sha256:" + f
+			}
+
+			if diff := cmp.Diff(tt.expected, fileNames(files)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.attention.head_count":    uint32(1),
+		"llama.attention.head_count_kv": uint32(1),
+	}, []ggml.Tensor{
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{4}, WriterTo: bytes.NewReader(make([]byte, 16))},
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{4, 2}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := server.NewLayer(&b, "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := server.NewLayer(strings.NewReader(`{}`), "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.WriteManifest(model.ParseName("test"), config, []server.Layer{layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.Flags().Uint64("shard-size", 0, "")
+	cmd.SetContext(t.Context())
+
+	dir := filepath.Join(t.TempDir(), "export")
+	if err := ExportHandler(cmd, []string{"test", dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"model.safetensors", "config.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := ExportHandler(cmd, []string{"missing", dir}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error exporting a missing model, got %v", err)
+	}
+
+	// the splits of a split model aren't joined
+	if err := server.WriteManifest(model.ParseName("split"), config, []server.Layer{layer, layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExportHandler(cmd, []string{"split", dir}); err == nil || !strings.Contains(err.Error(), "split models can't be exported") {
+		t.Errorf("expected split model error, got %v", err)
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/diff" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		var req api.DiffRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !req.Pull {
+			t.Error("expected pull to be set")
+		}
+
+		resp := api.DiffResponse{
+			Layers: []api.LayerDiff{
+				{MediaType: "application/vnd.ollama.image.model", A: "sha256:abc123def4567890", B: "sha256:0987654fed321cba"},
+				{MediaType: "application/vnd.ollama.image.system", B: "sha256:123456789abcdef0"},
+			},
+			KV: []api.KVDiff{
+				{MediaType: "application/vnd.ollama.image.model", Key: "general.file_type", A: "F16", B: "Q4_0"},
+			},
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("OLLAMA_HOST", mockServer.URL)
+
+	cmd := &cobra.Command{}
+	cmd.Flags().Bool("pull", true, "")
+	cmd.SetContext(t.Context())
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	err := DiffHandler(cmd, []string{"base", "tuned"})
+
+	w.Close()
+	os.Stdout = oldStdout
+	output, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "                     base            tuned        \n" +
+		"model                abc123def456    0987654fed32    \n" +
+		"system               -               123456789abc    \n" +
+		"general.file_type    F16             Q4_0            \n"
+	if got := string(output); got != expected {
+		t.Errorf("expected output:\n%q\ngot:\n%q", expected, got)
+	}
+}
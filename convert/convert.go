@@ -1,21 +1,37 @@
 package convert
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/version"
 )
 
+// ErrUnsupportedArchitecture is returned when there is no converter for a
+// model's architecture.
+var ErrUnsupportedArchitecture = errors.New("unsupported architecture")
+
 type ModelParameters struct {
-	Architectures []string       `json:"architectures"`
-	VocabSize     uint32         `json:"vocab_size"`
-	TextModel     TextParameters `json:"text_config"`
+	Architectures     []string       `json:"architectures"`
+	IsEncoderDecoder  bool           `json:"is_encoder_decoder"`
+	VocabSize         uint32         `json:"vocab_size"`
+	TieWordEmbeddings bool           `json:"tie_word_embeddings"`
+	TextModel         TextParameters `json:"text_config"`
+
+	QuantizationConfig struct {
+		QuantMethod string `json:"quant_method"`
+	} `json:"quantization_config"`
 }
 
 type TextParameters struct {
@@ -23,6 +39,8 @@ type TextParameters struct {
 }
 
 type AdapterParameters struct {
+	// Rank and Alpha are set by PEFT adapters, LoraParameters by MLX adapters
+	Rank           uint32 `json:"r"`
 	Alpha          uint32 `json:"lora_alpha"`
 	LoraLayers     uint32 `json:"lora_layers"`
 	LoraParameters struct {
@@ -75,6 +93,36 @@ func (p AdapterParameters) KV() ggml.KV {
 		"general.version":    "v0.2",
 	}
 
+	if rank := cmp.Or(p.Rank, p.LoraParameters.Rank); rank > 0 {
+		kv["adapter.lora.rank"] = rank
+	}
+
+	return kv
+}
+
+// sourceFS is a model's files along with a digest identifying them
+type sourceFS struct {
+	fs.FS
+	digest string
+}
+
+// WithSourceDigest returns fsys with digest, which identifies the files in it,
+// recorded as general.source_digest in models converted from it.
+func WithSourceDigest(fsys fs.FS, digest string) fs.FS {
+	return sourceFS{fsys, digest}
+}
+
+// provenanceKV returns key-values recording how a model in fsys was converted
+func provenanceKV(fsys fs.FS) ggml.KV {
+	kv := ggml.KV{
+		"general.source_format":      tensorFormat(fsys),
+		"general.conversion_version": version.Version,
+	}
+
+	if s, ok := fsys.(sourceFS); ok && s.digest != "" {
+		kv["general.source_digest"] = s.digest
+	}
+
 	return kv
 }
 
@@ -84,12 +132,12 @@ func (ModelParameters) specialTokenTypes() []string {
 	}
 }
 
-func (ModelParameters) writeFile(ws io.WriteSeeker, kv ggml.KV, ts []ggml.Tensor) error {
-	return ggml.WriteGGUF(ws, kv, ts)
+func (ModelParameters) writeFile(w io.Writer, kv ggml.KV, ts []ggml.Tensor) error {
+	return ggml.WriteGGUF(w, kv, ts)
 }
 
-func (AdapterParameters) writeFile(ws io.WriteSeeker, kv ggml.KV, ts []ggml.Tensor) error {
-	return ggml.WriteGGUF(ws, kv, ts)
+func (AdapterParameters) writeFile(w io.Writer, kv ggml.KV, ts []ggml.Tensor) error {
+	return ggml.WriteGGUF(w, kv, ts)
 }
 
 type ModelConverter interface {
@@ -103,14 +151,27 @@ type ModelConverter interface {
 
 	// specialTokenTypes returns any special token types the model uses
 	specialTokenTypes() []string
-	// writeFile writes the model to the provided io.WriteSeeker
-	writeFile(io.WriteSeeker, ggml.KV, []ggml.Tensor) error
+	// writeFile writes the model to the provided io.Writer
+	writeFile(io.Writer, ggml.KV, []ggml.Tensor) error
+}
+
+// tokenizerKVer is implemented by models that write tokenizer key-values of
+// their own over those from the tokenizer files.
+type tokenizerKVer interface {
+	tokenizerKV(ggml.KV, *Tokenizer)
 }
 
 type moreParser interface {
 	parseMore(fs.FS) error
 }
 
+// ropeScaler is implemented by models that read rope_scaling from config.json
+// so scaling types they can't convert are rejected instead of being ignored.
+type ropeScaler interface {
+	ropeScalingType() string
+	ropeScalingTypes() []string
+}
+
 type AdapterConverter interface {
 	// KV maps parameters to LLM key-values
 	KV(ggml.KV) ggml.KV
@@ -120,10 +181,10 @@ type AdapterConverter interface {
 	// See [strings.Replacer](https://pkg.go.dev/strings#Replacer) for details
 	Replacements() []string
 
-	writeFile(io.WriteSeeker, ggml.KV, []ggml.Tensor) error
+	writeFile(io.Writer, ggml.KV, []ggml.Tensor) error
 }
 
-func ConvertAdapter(fsys fs.FS, ws io.WriteSeeker, baseKV ggml.KV) error {
+func ConvertAdapter(fsys fs.FS, w io.Writer, baseKV ggml.KV) error {
 	bts, err := fs.ReadFile(fsys, "adapter_config.json")
 	if err != nil {
 		return err
@@ -146,7 +207,7 @@ func ConvertAdapter(fsys fs.FS, ws io.WriteSeeker, baseKV ggml.KV) error {
 	case "gemma2":
 		conv = &gemma2Adapter{}
 	default:
-		return errors.New("unsupported architecture")
+		return fmt.Errorf("%w %q", ErrUnsupportedArchitecture, arch)
 	}
 
 	ts, err := parseTensors(fsys, strings.NewReplacer(conv.Replacements()...))
@@ -158,14 +219,56 @@ func ConvertAdapter(fsys fs.FS, ws io.WriteSeeker, baseKV ggml.KV) error {
 		return err
 	}
 
-	return conv.writeFile(ws, conv.KV(baseKV), conv.Tensors(ts))
+	kv := conv.KV(baseKV)
+	maps.Copy(kv, provenanceKV(fsys))
+	return conv.writeFile(w, kv, conv.Tensors(ts))
 }
 
-// Convert writes an Ollama compatible model to the provided io.WriteSeeker based on configurations
+// Convert writes an Ollama compatible model to the provided io.Writer based on configurations
 // and files it finds in the input path.
 // Supported input model formats include safetensors.
 // Supported input tokenizers files include tokenizer.json (preferred) and tokenizer.model.
-func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
+func ConvertModel(fsys fs.FS, w io.Writer) error {
+	return convertModel(fsys, func(conv ModelConverter, kv ggml.KV, ts []ggml.Tensor) error {
+		return conv.writeFile(w, kv, ts)
+	})
+}
+
+// ConvertModelSplit is like [ConvertModel] but writes the model as multiple
+// GGUF splits holding at most maxSize bytes of tensor data each. See
+// [ggml.WriteGGUFSplit].
+func ConvertModelSplit(fsys fs.FS, maxSize uint64, create func(i, n int) (io.Writer, error)) error {
+	return convertModel(fsys, func(_ ModelConverter, kv ggml.KV, ts []ggml.Tensor) error {
+		return ggml.WriteGGUFSplit(kv, ts, maxSize, create)
+	})
+}
+
+// modelConverters returns a converter for each architecture named in
+// config.json that can be converted
+var modelConverters = map[string]func(arch string) ModelConverter{
+	"LlamaForCausalLM":               func(string) ModelConverter { return &llamaModel{} },
+	"MistralForCausalLM":             func(string) ModelConverter { return &llamaModel{} },
+	"MixtralForCausalLM":             func(string) ModelConverter { return &mixtralModel{} },
+	"GemmaForCausalLM":               func(string) ModelConverter { return &gemmaModel{} },
+	"Gemma2ForCausalLM":              func(string) ModelConverter { return &gemma2Model{} },
+	"Gemma3ForCausalLM":              func(arch string) ModelConverter { return &gemma3Model{Architecture: arch} },
+	"Gemma3ForConditionalGeneration": func(arch string) ModelConverter { return &gemma3Model{Architecture: arch} },
+	"Phi3ForCausalLM":                func(string) ModelConverter { return &phi3Model{} },
+	"Qwen2ForCausalLM":               func(string) ModelConverter { return &qwen2Model{} },
+	"BertModel":                      func(string) ModelConverter { return &bertModel{} },
+	"CohereForCausalLM":              func(string) ModelConverter { return &commandrModel{} },
+}
+
+func supportedArchitectures() string {
+	return strings.Join(slices.Sorted(maps.Keys(modelConverters)), ", ")
+}
+
+// packedQuantMethods are the quantization_config methods of models whose
+// tensors are packed in a layout that can't be converted. Dequantizing them
+// isn't implemented.
+var packedQuantMethods = []string{"exl2", "gptq", "awq"}
+
+func convertModel(fsys fs.FS, write func(ModelConverter, ggml.KV, []ggml.Tensor) error) error {
 	bts, err := fs.ReadFile(fsys, "config.json")
 	if err != nil {
 		return err
@@ -180,30 +283,25 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		return errors.New("unknown architecture")
 	}
 
-	var conv ModelConverter
-	switch p.Architectures[0] {
-	case "LlamaForCausalLM", "MistralForCausalLM":
-		conv = &llamaModel{}
-	case "MixtralForCausalLM":
-		conv = &mixtralModel{}
-	case "GemmaForCausalLM":
-		conv = &gemmaModel{}
-	case "Gemma2ForCausalLM":
-		conv = &gemma2Model{}
-	case "Gemma3ForCausalLM", "Gemma3ForConditionalGeneration":
-		conv = &gemma3Model{Architecture: p.Architectures[0]}
-	case "Phi3ForCausalLM":
-		conv = &phi3Model{}
-	case "Qwen2ForCausalLM":
-		conv = &qwen2Model{}
-	case "BertModel":
-		conv = &bertModel{}
-	case "CohereForCausalLM":
-		conv = &commandrModel{}
-	default:
-		return fmt.Errorf("unsupported architecture %q", p.Architectures[0])
+	// packed tensors such as EXL2, GPTQ and AWQ aren't decoded so fail before
+	// doing any work. Other methods, such as fp8 or compressed-tensors, may
+	// leave tensors in a format that can be read.
+	if method := p.QuantizationConfig.QuantMethod; slices.Contains(packedQuantMethods, method) {
+		return fmt.Errorf("%s quantized models are not supported, import the unquantized model and quantize it with --quantize instead", method)
+	}
+
+	// there's no converter for encoder-decoder models such as T5 and BART,
+	// and none of their architectures would otherwise fail with a clear error
+	if p.IsEncoderDecoder {
+		return fmt.Errorf("%w: encoder-decoder architecture %q is not supported, only decoder-only and encoder-only models can be imported; supported architectures are %s", ErrUnsupportedArchitecture, p.Architectures[0], supportedArchitectures())
+	}
+
+	newConverter, ok := modelConverters[p.Architectures[0]]
+	if !ok {
+		return fmt.Errorf("%w %q, supported architectures are %s", ErrUnsupportedArchitecture, p.Architectures[0], supportedArchitectures())
 	}
 
+	conv := newConverter(p.Architectures[0])
 	if err := json.Unmarshal(bts, conv); err != nil {
 		return err
 	}
@@ -214,6 +312,12 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		}
 	}
 
+	if r, ok := conv.(ropeScaler); ok {
+		if typ := r.ropeScalingType(); typ != "" && !slices.Contains(r.ropeScalingTypes(), typ) {
+			return fmt.Errorf("unsupported rope scaling type %q, expected one of %s", typ, strings.Join(r.ropeScalingTypes(), ", "))
+		}
+	}
+
 	t, err := parseTokenizer(fsys, conv.specialTokenTypes())
 	if err != nil {
 		return err
@@ -225,9 +329,267 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		vocabSize = tVocabSize
 	}
 
+	// the embedding is checked against the tokenizer's own vocabulary since
+	// padding it would hide a mismatch
+	tokens := len(t.Vocabulary.Tokens)
+	if err := padVocabulary(t, vocabSize); err != nil {
+		return err
+	}
+
+	ts, err := parseTensors(fsys, strings.NewReplacer(conv.Replacements()...))
+	if err != nil {
+		return err
+	}
+
+	if err := validateVocabSize(ts, tokens); err != nil {
+		return err
+	}
+
+	kv := conv.KV(t)
+	maps.Copy(kv, provenanceKV(fsys))
+
+	out := conv.Tensors(ts)
+	if p.TieWordEmbeddings {
+		out = tieEmbeddings(kv.Architecture(), out)
+	}
+
+	if missing := missingTensors(kv, out); len(missing) > 0 {
+		return fmt.Errorf("missing tensors %s; add rules to tensor_map.json to rename source tensors", strings.Join(missing, ", "))
+	}
+
+	if c, ok := conv.(shapeChecker); ok {
+		if err := checkShapes(c, kv, out); err != nil {
+			return err
+		}
+	}
+
+	return write(conv, kv, out)
+}
+
+// tiedOutput reports, for each architecture, whether output.weight must be
+// present in models with tied embeddings. Architectures where it is false fall
+// back to token_embd.weight when output.weight is missing.
+var tiedOutput = map[string]bool{
+	"command-r": false,
+	"gemma":     false,
+	"gemma2":    false,
+	"gemma3":    false,
+	"llama":     false,
+	"phi3":      true,
+	"qwen2":     false,
+}
+
+// tieEmbeddings returns ts with output.weight dropped or added from
+// token_embd.weight as architecture arch expects for tied embeddings.
+func tieEmbeddings(arch string, ts []ggml.Tensor) []ggml.Tensor {
+	required, ok := tiedOutput[arch]
+	if !ok {
+		return ts
+	}
+
+	embd := slices.IndexFunc(ts, func(t ggml.Tensor) bool { return t.Name == "token_embd.weight" })
+	output := slices.IndexFunc(ts, func(t ggml.Tensor) bool { return t.Name == "output.weight" })
+	switch {
+	case embd < 0:
+		return ts
+	case !required && output >= 0:
+		slog.Debug("dropping output tensor tied to token embedding", "arch", arch)
+		return slices.Delete(ts, output, output+1)
+	case required && output < 0:
+		t := ts[embd]
+		t.Name = "output.weight"
+		return append(ts, t)
+	}
+
+	return ts
+}
+
+// requiredTensors are, for each architecture, the converted tensors that
+// models can't be loaded without. Names with a %d are required in each block.
+var requiredTensors = map[string][]string{
+	"bert": {
+		"token_embd.weight", "token_embd_norm.weight",
+		"blk.%d.attn_q.weight", "blk.%d.attn_k.weight", "blk.%d.attn_v.weight", "blk.%d.attn_output.weight", "blk.%d.attn_output_norm.weight",
+		"blk.%d.ffn_up.weight", "blk.%d.ffn_down.weight", "blk.%d.layer_output_norm.weight",
+	},
+	"command-r": {
+		"token_embd.weight", "output_norm.weight",
+		"blk.%d.attn_norm.weight", "blk.%d.attn_q.weight", "blk.%d.attn_k.weight", "blk.%d.attn_v.weight", "blk.%d.attn_output.weight",
+		"blk.%d.ffn_gate.weight", "blk.%d.ffn_up.weight", "blk.%d.ffn_down.weight",
+	},
+	"gemma":  gemmaRequiredTensors,
+	"gemma2": gemmaRequiredTensors,
+	"gemma3": gemmaRequiredTensors,
+	// mixtral's experts replace the feed forward tensors of llama blocks
+	"llama": {
+		"token_embd.weight", "output_norm.weight",
+		"blk.%d.attn_norm.weight", "blk.%d.attn_q.weight", "blk.%d.attn_k.weight", "blk.%d.attn_v.weight", "blk.%d.attn_output.weight",
+		"blk.%d.ffn_norm.weight",
+	},
+	"phi3": {
+		"token_embd.weight", "output_norm.weight",
+		"blk.%d.attn_norm.weight", "blk.%d.attn_qkv.weight", "blk.%d.attn_output.weight",
+		"blk.%d.ffn_norm.weight", "blk.%d.ffn_up.weight", "blk.%d.ffn_down.weight",
+	},
+	"qwen2": {
+		"token_embd.weight", "output_norm.weight",
+		"blk.%d.attn_norm.weight", "blk.%d.attn_q.weight", "blk.%d.attn_k.weight", "blk.%d.attn_v.weight", "blk.%d.attn_output.weight",
+		"blk.%d.ffn_norm.weight", "blk.%d.ffn_gate.weight", "blk.%d.ffn_up.weight", "blk.%d.ffn_down.weight",
+	},
+}
+
+var gemmaRequiredTensors = []string{
+	"token_embd.weight", "output_norm.weight",
+	"blk.%d.attn_norm.weight", "blk.%d.attn_q.weight", "blk.%d.attn_k.weight", "blk.%d.attn_v.weight", "blk.%d.attn_output.weight",
+	"blk.%d.ffn_norm.weight", "blk.%d.ffn_gate.weight", "blk.%d.ffn_up.weight", "blk.%d.ffn_down.weight",
+}
+
+// missingTensors returns the names of expected tensors not found in ts. The
+// tensors required by the architecture are expected, as well as each block
+// having the same tensors as every other block.
+func missingTensors(kv ggml.KV, ts []ggml.Tensor) (missing []string) {
+	names := make(map[string]struct{}, len(ts))
+	suffixes := make(map[string]struct{})
+	for _, t := range ts {
+		names[t.Name] = struct{}{}
+		if rest, ok := strings.CutPrefix(t.Name, "blk."); ok {
+			if _, suffix, ok := strings.Cut(rest, "."); ok {
+				suffixes[suffix] = struct{}{}
+			}
+		}
+	}
+
+	var expected []string
+	blocks, _ := kv[kv.Architecture()+".block_count"].(uint32)
+	for _, name := range requiredTensors[kv.Architecture()] {
+		if !strings.Contains(name, "%d") {
+			expected = append(expected, name)
+			continue
+		}
+
+		for i := range blocks {
+			expected = append(expected, fmt.Sprintf(name, i))
+		}
+	}
+
+	for i := range blocks {
+		for _, suffix := range slices.Sorted(maps.Keys(suffixes)) {
+			expected = append(expected, fmt.Sprintf("blk.%d.%s", i, suffix))
+		}
+	}
+
+	for _, name := range expected {
+		if _, ok := names[name]; !ok && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// shapeChecker is implemented by models that know the shapes their tensors
+// should have from their parameters.
+type shapeChecker interface {
+	// tensorShape returns the expected shape of the converted tensor name or
+	// nil if it isn't known. Dimensions of 0 aren't checked.
+	tensorShape(name string) []uint64
+}
+
+// checkShapes returns an error for the first tensor in ts with a shape other
+// than the one expected by c, or in a block beyond the model's block count,
+// as happens when a checkpoint doesn't match its config.json.
+func checkShapes(c shapeChecker, kv ggml.KV, ts []ggml.Tensor) error {
+	blocks, hasBlocks := kv[kv.Architecture()+".block_count"].(uint32)
+	for _, t := range ts {
+		if rest, ok := strings.CutPrefix(t.Name, "blk."); ok && hasBlocks {
+			n, _, _ := strings.Cut(rest, ".")
+			if i, err := strconv.ParseUint(n, 10, 32); err == nil && uint32(i) >= blocks {
+				return fmt.Errorf("tensor %s is in block %d but the model has %d blocks", t.Name, i, blocks)
+			}
+		}
+
+		want := c.tensorShape(t.Name)
+		if want == nil {
+			continue
+		}
+
+		mismatch := len(want) != len(t.Shape)
+		for i := 0; !mismatch && i < len(want); i++ {
+			mismatch = want[i] != 0 && want[i] != t.Shape[i]
+		}
+
+		if mismatch {
+			return fmt.Errorf("tensor %s has shape %v, expected %v", t.Name, t.Shape, want)
+		}
+	}
+
+	return nil
+}
+
+// transformerShape returns the expected shape of tensor name in a llama style
+// transformer or nil if it isn't one of its tensors. Tensors are indexed by
+// token, so embeddings have a row for each token.
+func transformerShape(name string, hidden, heads, kvHeads, headDim, ffn uint64) []uint64 {
+	if rest, ok := strings.CutPrefix(name, "blk."); ok {
+		_, name, _ = strings.Cut(rest, ".")
+	}
+
+	switch name {
+	case "token_embd.weight", "output.weight":
+		return []uint64{0, hidden}
+	case "attn_norm.weight", "ffn_norm.weight", "output_norm.weight":
+		return []uint64{hidden}
+	case "attn_q.weight":
+		return []uint64{heads * headDim, hidden}
+	case "attn_k.weight", "attn_v.weight":
+		return []uint64{kvHeads * headDim, hidden}
+	case "attn_q.bias":
+		return []uint64{heads * headDim}
+	case "attn_k.bias", "attn_v.bias":
+		return []uint64{kvHeads * headDim}
+	case "attn_output.weight":
+		return []uint64{hidden, heads * headDim}
+	case "ffn_gate.weight", "ffn_up.weight":
+		return []uint64{ffn, hidden}
+	case "ffn_down.weight":
+		return []uint64{hidden, ffn}
+	}
+
+	return nil
+}
+
+// validateVocabSize checks the token embedding has a row for each of the
+// vocabSize tokens. Embeddings padded beyond the vocabulary are allowed up to
+// envconfig.VocabPadding rows.
+func validateVocabSize(ts []Tensor, vocabSize int) error {
+	i := slices.IndexFunc(ts, func(t Tensor) bool {
+		return t.Name() == "token_embd.weight"
+	})
+	if i < 0 || len(ts[i].Shape()) == 0 {
+		return nil
+	}
+
+	rows := int(ts[i].Shape()[0])
+	switch {
+	case rows < vocabSize:
+		return fmt.Errorf("token embedding has %d rows but the vocabulary has %d tokens", rows, vocabSize)
+	case rows-vocabSize > int(envconfig.VocabPadding()):
+		return fmt.Errorf("token embedding has %d rows but the vocabulary has %d tokens, more than %d rows of padding", rows, vocabSize, envconfig.VocabPadding())
+	}
+
+	return nil
+}
+
+// padVocabulary pads the vocabulary of t with dummy tokens up to vocabSize
+// tokens. It's an error for the vocabulary to be larger, or smaller by more
+// than envconfig.VocabPadding tokens. A vocabSize of 0 leaves the vocabulary
+// as it is.
+func padVocabulary(t *Tokenizer, vocabSize int) error {
 	switch {
 	case vocabSize == 0:
 		slog.Warn("vocabulary size was not explicitly set by the model", "default size", len(t.Vocabulary.Tokens))
+	case vocabSize-len(t.Vocabulary.Tokens) > int(envconfig.VocabPadding()):
+		return fmt.Errorf("vocabulary has %d tokens but %d are expected, more than %d tokens of padding", len(t.Vocabulary.Tokens), vocabSize, envconfig.VocabPadding())
 	case vocabSize > len(t.Vocabulary.Tokens):
 		slog.Warn("vocabulary is smaller than expected, padding with dummy tokens", "expect", vocabSize, "actual", len(t.Vocabulary.Tokens))
 		for i := range vocabSize - len(t.Vocabulary.Tokens) {
@@ -241,10 +603,64 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		slog.Debug("vocabulary", "size", len(t.Vocabulary.Tokens))
 	}
 
-	ts, err := parseTensors(fsys, strings.NewReplacer(conv.Replacements()...))
+	return nil
+}
+
+// tokenizerConverter returns the converter of models converted to the GGUF
+// architecture arch. Only its tokenizer methods can be used since none of its
+// parameters are set.
+func tokenizerConverter(arch string) (ModelConverter, error) {
+	switch arch {
+	case "llama":
+		return &llamaModel{}, nil
+	case "gemma":
+		return &gemmaModel{}, nil
+	case "gemma2":
+		return &gemma2Model{}, nil
+	case "gemma3":
+		return &gemma3Model{}, nil
+	case "phi3":
+		return &phi3Model{}, nil
+	case "qwen2":
+		return &qwen2Model{}, nil
+	case "bert":
+		return &bertModel{}, nil
+	case "command-r":
+		return &commandrModel{}, nil
+	default:
+		return nil, fmt.Errorf("%w %q for updating the tokenizer", ErrUnsupportedArchitecture, arch)
+	}
+}
+
+// ConvertTokenizer returns the tokenizer key-values, as written by
+// [ConvertModel] for the GGUF architecture arch, for the tokenizer files in
+// fsys without reading any tensors, so that the tokenizer of an already
+// converted model can be replaced. The vocabulary is padded to vocabSize
+// tokens to match the model's embeddings.
+func ConvertTokenizer(fsys fs.FS, arch string, vocabSize int) (ggml.KV, error) {
+	conv, err := tokenizerConverter(arch)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return conv.writeFile(ws, conv.KV(t), conv.Tensors(ts))
+	t, err := parseTokenizer(fsys, conv.specialTokenTypes())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := padVocabulary(t, vocabSize); err != nil {
+		return nil, err
+	}
+
+	var p ModelParameters
+	kv := p.KV(t)
+	if c, ok := conv.(tokenizerKVer); ok {
+		c.tokenizerKV(kv, t)
+	}
+
+	maps.DeleteFunc(kv, func(k string, _ any) bool {
+		return !strings.HasPrefix(k, "tokenizer.")
+	})
+
+	return kv, nil
 }
@@ -113,6 +113,11 @@ func (p *bertModel) KV(t *Tokenizer) ggml.KV {
 		kv["bert.attention.layer_norm_epsilon"] = layerNormEpsilon
 	}
 
+	p.tokenizerKV(kv, t)
+	return kv
+}
+
+func (p *bertModel) tokenizerKV(kv ggml.KV, t *Tokenizer) {
 	kv["tokenizer.ggml.model"] = "bert"
 	kv["tokenizer.ggml.token_type_count"] = uint32(2)
 
@@ -128,8 +133,6 @@ func (p *bertModel) KV(t *Tokenizer) ggml.KV {
 	}
 
 	kv["tokenizer.ggml.tokens"] = t.Tokens
-
-	return kv
 }
 
 func (p *bertModel) Tensors(ts []Tensor) []ggml.Tensor {
@@ -35,11 +35,15 @@ func (p *gemmaModel) KV(t *Tokenizer) ggml.KV {
 	kv["gemma.attention.layer_norm_rms_epsilon"] = p.RMSNormEPS
 	kv["gemma.attention.key_length"] = p.HeadDim
 	kv["gemma.attention.value_length"] = p.HeadDim
+	p.tokenizerKV(kv, t)
+	return kv
+}
+
+func (p *gemmaModel) tokenizerKV(kv ggml.KV, _ *Tokenizer) {
 	kv["tokenizer.ggml.eot_token_id"] = uint32(107)
 	kv["tokenizer.ggml.middle_token_id"] = uint32(68)
 	kv["tokenizer.ggml.prefix_token_id"] = uint32(67)
 	kv["tokenizer.ggml.suffix_token_id"] = uint32(69)
-	return kv
 }
 
 func (p *gemmaModel) Tensors(ts []Tensor) []ggml.Tensor {
@@ -24,10 +24,7 @@ func (p *gemma2Model) KV(t *Tokenizer) ggml.KV {
 	kv["gemma2.attention.sliding_window"] = p.SlidingWindow
 	kv["gemma2.attn_logit_softcapping"] = p.AttentionLogitSoftcap
 	kv["gemma2.final_logit_softcapping"] = p.FinalLogitSoftcap
-	kv["tokenizer.ggml.eot_token_id"] = uint32(107)
-	kv["tokenizer.ggml.middle_token_id"] = uint32(68)
-	kv["tokenizer.ggml.prefix_token_id"] = uint32(67)
-	kv["tokenizer.ggml.suffix_token_id"] = uint32(69)
+	p.tokenizerKV(kv, t)
 	return kv
 }
 
@@ -34,6 +34,7 @@ type llamaModel struct {
 		LowFrequencyFactor              float32 `json:"low_freq_factor"`
 		HighFrequencyFactor             float32 `json:"high_freq_factor"`
 		OriginalMaxPositionalEmbeddings uint32  `json:"original_max_positional_embeddings"`
+		OriginalMaxPositionEmbeddings   uint32  `json:"original_max_position_embeddings"`
 
 		factors ropeFactor
 	} `json:"rope_scaling"`
@@ -46,6 +47,17 @@ type llamaModel struct {
 
 var _ ModelConverter = (*llamaModel)(nil)
 
+func (p *llamaModel) tensorShape(name string) []uint64 {
+	hidden := cmp.Or(p.HiddenSize, p.NEmbd)
+	heads := cmp.Or(p.NumAttentionHeads, p.NHead)
+	if hidden == 0 || heads == 0 {
+		return nil
+	}
+
+	headDim := cmp.Or(p.HeadDim, hidden/heads)
+	return transformerShape(name, uint64(hidden), uint64(heads), uint64(cmp.Or(p.NumKeyValueHeads, heads)), uint64(headDim), uint64(cmp.Or(p.IntermediateSize, p.NInner)))
+}
+
 func (p *llamaModel) KV(t *Tokenizer) ggml.KV {
 	kv := p.ModelParameters.KV(t)
 	kv["general.architecture"] = "llama"
@@ -74,17 +86,25 @@ func (p *llamaModel) KV(t *Tokenizer) ggml.KV {
 		kv["llama.rope.freq_base"] = p.RopeTheta
 	}
 
-	if p.RopeScaling.Type == "linear" {
-		kv["llama.rope.scaling.type"] = p.RopeScaling.Type
+	originalContextLength := cmp.Or(p.RopeScaling.OriginalMaxPositionEmbeddings, p.RopeScaling.OriginalMaxPositionalEmbeddings)
+	switch p.ropeScalingType() {
+	case "linear":
+		kv["llama.rope.scaling.type"] = "linear"
+		kv["llama.rope.scaling.factor"] = p.RopeScaling.Factor
+	case "yarn":
+		kv["llama.rope.scaling.type"] = "yarn"
 		kv["llama.rope.scaling.factor"] = p.RopeScaling.Factor
-	} else if p.RopeScaling.RopeType == "llama3" {
+		if originalContextLength > 0 {
+			kv["llama.rope.scaling.original_context_length"] = originalContextLength
+		}
+	case "llama3":
 		dim := p.HiddenSize / p.NumAttentionHeads
 		for i := uint32(0); i < dim; i += 2 {
 			factor := cmp.Or(p.RopeScaling.Factor, 8.0)
 			factorLow := cmp.Or(p.RopeScaling.LowFrequencyFactor, 1.0)
 			factorHigh := cmp.Or(p.RopeScaling.HighFrequencyFactor, 4.0)
 
-			original := cmp.Or(p.RopeScaling.OriginalMaxPositionalEmbeddings, 8192)
+			original := cmp.Or(originalContextLength, 8192)
 			lambdaLow := float32(original) / factorLow
 			lambdaHigh := float32(original) / factorHigh
 
@@ -120,6 +140,14 @@ func (p *llamaModel) KV(t *Tokenizer) ggml.KV {
 	return kv
 }
 
+func (p *llamaModel) ropeScalingType() string {
+	return cmp.Or(p.RopeScaling.RopeType, p.RopeScaling.Type)
+}
+
+func (p *llamaModel) ropeScalingTypes() []string {
+	return []string{"default", "linear", "llama3", "yarn"}
+}
+
 func (p *llamaModel) Tensors(ts []Tensor) []ggml.Tensor {
 	var out []ggml.Tensor
 
@@ -68,6 +68,14 @@ func (p *phi3Model) KV(t *Tokenizer) ggml.KV {
 	return kv
 }
 
+func (p *phi3Model) ropeScalingType() string {
+	return p.RopeScaling.Type
+}
+
+func (p *phi3Model) ropeScalingTypes() []string {
+	return []string{"su", "longrope", "yarn"}
+}
+
 func (p *phi3Model) Tensors(ts []Tensor) []ggml.Tensor {
 	var addRopeFactors sync.Once
 
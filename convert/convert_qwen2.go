@@ -1,6 +1,10 @@
 package convert
 
-import "github.com/ollama/ollama/fs/ggml"
+import (
+	"cmp"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
 
 type qwen2Model struct {
 	ModelParameters
@@ -12,15 +16,24 @@ type qwen2Model struct {
 	NumKeyValueHeads      uint32  `json:"num_key_value_heads"`
 	RopeTheta             float32 `json:"rope_theta"`
 	RopeScaling           struct {
-		Type                          string     `json:"type"`
-		Factor                        ropeFactor `json:"factor"`
-		OriginalMaxPositionEmbeddings uint32     `json:"original_max_position_embeddings"`
+		Type                          string  `json:"type"`
+		RopeType                      string  `json:"rope_type"`
+		Factor                        float32 `json:"factor"`
+		OriginalMaxPositionEmbeddings uint32  `json:"original_max_position_embeddings"`
 	} `json:"rope_scaling"`
 	RMSNormEPS float32 `json:"rms_norm_eps"`
 }
 
 var _ ModelConverter = (*qwen2Model)(nil)
 
+func (q *qwen2Model) tensorShape(name string) []uint64 {
+	if q.HiddenSize == 0 || q.NumAttentionHeads == 0 {
+		return nil
+	}
+
+	return transformerShape(name, uint64(q.HiddenSize), uint64(q.NumAttentionHeads), uint64(cmp.Or(q.NumKeyValueHeads, q.NumAttentionHeads)), uint64(q.HiddenSize/q.NumAttentionHeads), uint64(q.IntermediateSize))
+}
+
 func (q *qwen2Model) KV(t *Tokenizer) ggml.KV {
 	kv := q.ModelParameters.KV(t)
 	kv["general.architecture"] = "qwen2"
@@ -33,18 +46,29 @@ func (q *qwen2Model) KV(t *Tokenizer) ggml.KV {
 	kv["qwen2.rope.freq_base"] = q.RopeTheta
 	kv["qwen2.attention.layer_norm_rms_epsilon"] = q.RMSNormEPS
 
-	switch q.RopeScaling.Type {
-	case "":
+	switch q.ropeScalingType() {
+	case "", "default":
 		// no scaling
 	case "yarn":
-		kv["qwen2.rope.scaling.type"] = q.RopeScaling.Type
+		kv["qwen2.rope.scaling.type"] = "yarn"
 		kv["qwen2.rope.scaling.factor"] = q.RopeScaling.Factor
+		if q.RopeScaling.OriginalMaxPositionEmbeddings > 0 {
+			kv["qwen2.rope.scaling.original_context_length"] = q.RopeScaling.OriginalMaxPositionEmbeddings
+		}
 	default:
 		panic("unknown rope scaling type")
 	}
 	return kv
 }
 
+func (q *qwen2Model) ropeScalingType() string {
+	return cmp.Or(q.RopeScaling.RopeType, q.RopeScaling.Type)
+}
+
+func (q *qwen2Model) ropeScalingTypes() []string {
+	return []string{"default", "yarn"}
+}
+
 func (q *qwen2Model) Tensors(ts []Tensor) []ggml.Tensor {
 	var out []ggml.Tensor
 	for _, t := range ts {
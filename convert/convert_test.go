@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -17,10 +18,13 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 
+	"github.com/google/go-cmp/cmp"
 	"golang.org/x/exp/maps"
 
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/version"
 )
 
 type tensorData struct {
@@ -88,6 +92,10 @@ func generateResultsJSON(t *testing.T, f *os.File, kv ggml.KV, tensors ggml.Tens
 	return actual
 }
 
+// update regenerates the expected results of TestConvertModel from the
+// current converter: go test ./convert -run TestConvertModel -update
+var update = flag.Bool("update", false, "update expected conversion results in testdata")
+
 func TestMain(m *testing.M) {
 	var level slog.Level
 	flag.TextVar(&level, "level", slog.LevelInfo, "log level")
@@ -110,6 +118,9 @@ func TestConvertModel(t *testing.T) {
 		"gemma-2-9b-it",
 		"Qwen2.5-0.5B-Instruct",
 		"c4ai-command-r-v01",
+		// a tiny sharded llama with F32, F16 and BF16 tensors which is
+		// committed so that conversion is always tested
+		"tiny-llama",
 	}
 
 	for i := range cases {
@@ -127,6 +138,21 @@ func TestConvertModel(t *testing.T) {
 			f, kv, tensors := convertFull(t, os.DirFS(p))
 			actual := generateResultsJSON(t, f, kv, tensors)
 
+			if *update {
+				// the version depends on how the test is built
+				delete(actual, "general.conversion_version")
+
+				bts, err := json.MarshalIndent(actual, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(filepath.Join("testdata", fmt.Sprintf("%s.json", tt)), append(bts, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
 			expectFile, err := os.Open(filepath.Join("testdata", fmt.Sprintf("%s.json", tt)))
 			if err != nil {
 				t.Fatal(err)
@@ -297,7 +323,10 @@ func TestConvertAdapter(t *testing.T) {
 				"general.parameter_count":       "106496",
 				"general.type":                  "adapter",
 				"general.version":               "v0.2",
+				"general.source_format":         "safetensors",
+				"general.conversion_version":    version.Version,
 				"adapter.lora.alpha":            "16",
+				"adapter.lora.rank":             "8",
 				"adapter.type":                  "lora",
 				"llama.attention.head_count":    "32",
 				"llama.attention.head_count_kv": "8",
@@ -476,3 +505,584 @@ func generateLoraTestData(t *testing.T, tempDir string) {
 		t.Fatal(err)
 	}
 }
+
+func TestValidateVocabSize(t *testing.T) {
+	t.Setenv("OLLAMA_VOCAB_PADDING", "64")
+
+	embedding := func(rows uint64) []Tensor {
+		return []Tensor{
+			safetensor{tensorBase: &tensorBase{name: "blk.0.attn_q.weight", shape: []uint64{8, 8}}},
+			safetensor{tensorBase: &tensorBase{name: "token_embd.weight", shape: []uint64{rows, 8}}},
+		}
+	}
+
+	cases := []struct {
+		name    string
+		tensors []Tensor
+		wantErr string
+	}{
+		{"equal", embedding(100), ""},
+		{"padded", embedding(164), ""},
+		{"padded too much", embedding(165), "token embedding has 165 rows but the vocabulary has 100 tokens, more than 64 rows of padding"},
+		{"too small", embedding(99), "token embedding has 99 rows but the vocabulary has 100 tokens"},
+		{"no embedding", embedding(100)[:1], ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVocabSize(tt.tensors, 100)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPadVocabulary(t *testing.T) {
+	t.Setenv("OLLAMA_VOCAB_PADDING", "2")
+
+	cases := []struct {
+		name      string
+		vocabSize int
+		want      int
+		wantErr   string
+	}{
+		{"unset", 0, 3, ""},
+		{"equal", 3, 3, ""},
+		{"padded", 5, 5, ""},
+		{"padded too much", 6, 0, "vocabulary has 3 tokens but 6 are expected, more than 2 tokens of padding"},
+		{"too large", 2, 0, "vocabulary is larger than expected '3' instead of '2'"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenizer := &Tokenizer{Vocabulary: &Vocabulary{
+				Tokens: []string{"a", "b", "c"},
+				Scores: []float32{0, 0, 0},
+				Types:  []int32{tokenTypeNormal, tokenTypeNormal, tokenTypeNormal},
+			}}
+
+			err := padVocabulary(tokenizer, tt.vocabSize)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tokenizer.Tokens) != tt.want {
+				t.Errorf("expected %d tokens, got %v", tt.want, tokenizer.Tokens)
+			}
+		})
+	}
+}
+
+// llamaTensors returns shapes with the source tensors a llama model of blocks
+// blocks, a hidden size of 4 and a single attention head requires added
+// unless shapes already has them.
+func llamaTensors(blocks int, shapes map[string][]int) map[string][]int {
+	s := map[string][]int{
+		"model.embed_tokens.weight": {2, 4},
+		"model.norm.weight":         {4},
+	}
+
+	for i := range blocks {
+		for _, name := range []string{"input_layernorm", "post_attention_layernorm"} {
+			s[fmt.Sprintf("model.layers.%d.%s.weight", i, name)] = []int{4}
+		}
+
+		for _, name := range []string{"q_proj", "k_proj", "v_proj", "o_proj"} {
+			s[fmt.Sprintf("model.layers.%d.self_attn.%s.weight", i, name)] = []int{4, 4}
+		}
+	}
+
+	maps.Copy(s, shapes)
+	return s
+}
+
+func TestMissingTensors(t *testing.T) {
+	tensors := func(names ...string) (ts []ggml.Tensor) {
+		for _, name := range names {
+			ts = append(ts, ggml.Tensor{Name: name})
+		}
+		return ts
+	}
+
+	required := func(blocks int, extra ...string) []string {
+		names := []string{"token_embd.weight", "output_norm.weight"}
+		for i := range blocks {
+			for _, suffix := range []string{"attn_norm", "attn_q", "attn_k", "attn_v", "attn_output", "ffn_norm"} {
+				names = append(names, fmt.Sprintf("blk.%d.%s.weight", i, suffix))
+			}
+		}
+		return append(names, extra...)
+	}
+
+	kv := ggml.KV{"general.architecture": "llama", "llama.block_count": uint32(2)}
+
+	if missing := missingTensors(kv, tensors(required(2)...)); len(missing) > 0 {
+		t.Errorf("expected no missing tensors, got %v", missing)
+	}
+
+	// blocks are expected to have the same tensors as each other
+	if missing := missingTensors(kv, tensors(required(2, "blk.0.ffn_up.weight")...)); !slices.Equal(missing, []string{"blk.1.ffn_up.weight"}) {
+		t.Errorf("expected blk.1.ffn_up.weight to be missing, got %v", missing)
+	}
+
+	// as well as having the tensors the architecture requires
+	names := slices.DeleteFunc(required(2), func(name string) bool {
+		return name == "output_norm.weight" || name == "blk.1.attn_v.weight"
+	})
+	if missing := missingTensors(kv, tensors(names...)); !slices.Equal(missing, []string{"output_norm.weight", "blk.1.attn_v.weight"}) {
+		t.Errorf("expected output_norm.weight and blk.1.attn_v.weight to be missing, got %v", missing)
+	}
+
+	// architectures without required tensors are only checked for consistency
+	kv = ggml.KV{"general.architecture": "mamba", "mamba.block_count": uint32(2)}
+	if missing := missingTensors(kv, tensors("token_embd.weight", "blk.0.ssm_a", "blk.1.ssm_a")); len(missing) > 0 {
+		t.Errorf("expected no missing tensors, got %v", missing)
+	}
+}
+
+func TestConvertTiedEmbeddings(t *testing.T) {
+	cases := []struct {
+		name    string
+		arch    string
+		tensors map[string][]int
+		want    []string
+	}{
+		{
+			name:    "duplicate output dropped",
+			arch:    "LlamaForCausalLM",
+			tensors: map[string][]int{"model.embed_tokens.weight": {2, 4}, "model.norm.weight": {4}, "lm_head.weight": {2, 4}},
+			want:    []string{"output_norm.weight", "token_embd.weight"},
+		},
+		{
+			name:    "output added",
+			arch:    "Phi3ForCausalLM",
+			tensors: map[string][]int{"model.embed_tokens.weight": {2, 4}, "model.norm.weight": {4}},
+			want:    []string{"output.weight", "output_norm.weight", "token_embd.weight"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"architectures": [%q], "tie_word_embeddings": true, "hidden_size": 4, "num_attention_heads": 1, "max_position_embeddings": 8, "original_max_position_embeddings": 8}`, tt.arch))},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, tt.tensors),
+			}
+
+			_, _, tensors := convertFull(t, fsys)
+
+			var names []string
+			for _, tensor := range tensors.Items() {
+				names = append(names, tensor.Name)
+			}
+
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("expected tensors %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
+
+func TestConvertQuantized(t *testing.T) {
+	for _, method := range packedQuantMethods {
+		t.Run(method, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"architectures": ["LlamaForCausalLM"], "quantization_config": {"quant_method": %q, "bits": 4.0}}`, method))},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, map[string][]int{"model.layers.0.self_attn.q_proj.q_weight": {2, 4}}),
+			}
+
+			if err := ConvertModel(fsys, io.Discard); err == nil || !strings.Contains(err.Error(), method+" quantized models are not supported") {
+				t.Errorf("expected unsupported quantization error, got %v", err)
+			}
+		})
+	}
+
+	// tensors that aren't packed are converted as usual
+	for _, method := range []string{"fp8", "compressed-tensors"} {
+		t.Run(method, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "num_hidden_layers": 1, "quantization_config": {"quant_method": %q}}`, method))},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, llamaTensors(1, nil)),
+			}
+
+			if err := ConvertModel(fsys, io.Discard); err != nil {
+				t.Errorf("expected %s model to convert, got %v", method, err)
+			}
+		})
+	}
+}
+
+func TestConvertSourceDigest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config.json":       &fstest.MapFile{Data: []byte(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "num_hidden_layers": 1}`)},
+		"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+		"model.safetensors": safetensorsFile(t, llamaTensors(1, nil)),
+	}
+
+	for _, tt := range []struct {
+		name string
+		fsys fs.FS
+		want any
+	}{
+		{"without digest", fsys, nil},
+		{"with digest", WithSourceDigest(fsys, "sha256:abc123"), "sha256:abc123"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := ConvertModel(tt.fsys, &b); err != nil {
+				t.Fatal(err)
+			}
+
+			f, _, err := ggml.Decode(bytes.NewReader(b.Bytes()), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.KV()["general.source_digest"]; got != tt.want {
+				t.Errorf("expected source digest %v, got %v", tt.want, got)
+			}
+
+			if got := f.KV()["general.source_format"]; got != "safetensors" {
+				t.Errorf("expected safetensors source format, got %v", got)
+			}
+		})
+	}
+}
+
+func TestConvertUnsupportedArchitecture(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config.json":       &fstest.MapFile{Data: []byte(`{"architectures": ["MambaForCausalLM"]}`)},
+		"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+		"model.safetensors": safetensorsFile(t, map[string][]int{"backbone.embeddings.weight": {2, 4}}),
+	}
+
+	err := ConvertModel(fsys, io.Discard)
+	if !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Fatalf("expected unsupported architecture error, got %v", err)
+	}
+
+	for arch := range modelConverters {
+		if !strings.Contains(err.Error(), arch) {
+			t.Errorf("expected %s in %q", arch, err)
+		}
+	}
+}
+
+func TestConvertEncoderDecoder(t *testing.T) {
+	for _, arch := range []string{"T5ForConditionalGeneration", "BartForConditionalGeneration"} {
+		t.Run(arch, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"architectures": [%q], "is_encoder_decoder": true}`, arch))},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, map[string][]int{"shared.weight": {2, 4}}),
+			}
+
+			err := ConvertModel(fsys, io.Discard)
+			if !errors.Is(err, ErrUnsupportedArchitecture) || !strings.Contains(err.Error(), fmt.Sprintf("encoder-decoder architecture %q", arch)) {
+				t.Errorf("expected encoder-decoder error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConvertModelSplit(t *testing.T) {
+	fsys := fstest.MapFS{
+		"config.json":       &fstest.MapFile{Data: []byte(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "num_hidden_layers": 2}`)},
+		"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+		"model.safetensors": safetensorsFile(t, llamaTensors(2, nil)),
+	}
+
+	// each tensor is at least 16 bytes so no two share a split
+	var bs []*bytes.Buffer
+	if err := ConvertModelSplit(fsys, 16, func(i, n int) (io.Writer, error) {
+		bs = append(bs, &bytes.Buffer{})
+		return bs[i], nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bs) != 14 {
+		t.Fatalf("expected 14 splits, got %d", len(bs))
+	}
+
+	var names []string
+	for i, b := range bs {
+		f, _, err := ggml.Decode(bytes.NewReader(b.Bytes()), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := f.KV()["split.no"]; got != uint16(i) {
+			t.Errorf("expected split.no %d, got %v", i, got)
+		}
+
+		for _, tensor := range f.Tensors().Items() {
+			names = append(names, tensor.Name)
+		}
+	}
+
+	want := []string{"output_norm.weight", "token_embd.weight"}
+	for i := range 2 {
+		for _, suffix := range []string{"attn_k", "attn_norm", "attn_output", "attn_q", "attn_v", "ffn_norm"} {
+			want = append(want, fmt.Sprintf("blk.%d.%s.weight", i, suffix))
+		}
+	}
+
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("expected tensors %v, got %v", want, names)
+	}
+}
+
+func TestConvertRopeScaling(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		want   ggml.KV
+		err    string
+	}{
+		{
+			name:   "llama yarn",
+			config: `{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "rope_scaling": {"rope_type": "yarn", "factor": 4.0, "original_max_position_embeddings": 8192}}`,
+			want: ggml.KV{
+				"llama.rope.scaling.type":                    "yarn",
+				"llama.rope.scaling.factor":                  float32(4),
+				"llama.rope.scaling.original_context_length": uint32(8192),
+			},
+		},
+		{
+			name:   "qwen2 yarn",
+			config: `{"architectures": ["Qwen2ForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "rope_scaling": {"type": "yarn", "factor": 4.0, "original_max_position_embeddings": 32768}}`,
+			want: ggml.KV{
+				"qwen2.rope.scaling.type":                    "yarn",
+				"qwen2.rope.scaling.factor":                  float32(4),
+				"qwen2.rope.scaling.original_context_length": uint32(32768),
+			},
+		},
+		{
+			name:   "unsupported",
+			config: `{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "rope_scaling": {"type": "dynamic", "factor": 2.0}}`,
+			err:    `unsupported rope scaling type "dynamic"`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(tt.config)},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, map[string][]int{"model.embed_tokens.weight": {2, 4}, "model.norm.weight": {4}}),
+			}
+
+			if tt.err != "" {
+				if err := ConvertModel(fsys, io.Discard); err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+
+			_, kv, _ := convertFull(t, fsys)
+			for k, v := range tt.want {
+				if kv[k] != v {
+					t.Errorf("expected %s %v, got %v", k, v, kv[k])
+				}
+			}
+		})
+	}
+}
+
+func TestConvertModelShardOrder(t *testing.T) {
+	config := &fstest.MapFile{Data: []byte(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 1, "num_hidden_layers": 1}`)}
+	tokenizer := &fstest.MapFile{Data: []byte(`{}`)}
+
+	write := func(t *testing.T, fsys fs.FS) []byte {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := ConvertModel(fsys, &b); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes()
+	}
+
+	// the same tensors in one file or sharded differently convert to the
+	// same model
+	want := write(t, fstest.MapFS{
+		"config.json":       config,
+		"tokenizer.json":    tokenizer,
+		"model.safetensors": safetensorsFile(t, llamaTensors(1, nil)),
+	})
+
+	shard := llamaTensors(1, nil)
+	delete(shard, "model.layers.0.post_attention_layernorm.weight")
+	got := write(t, fstest.MapFS{
+		"config.json":    config,
+		"tokenizer.json": tokenizer,
+		"model-00001-of-00002.safetensors": safetensorsFile(t, map[string][]int{
+			"model.layers.0.post_attention_layernorm.weight": {4},
+		}),
+		"model-00002-of-00002.safetensors": safetensorsFile(t, shard),
+	})
+
+	if !bytes.Equal(want, got) {
+		t.Error("expected the same model regardless of how tensors are sharded")
+	}
+}
+
+func TestConvertTokenizer(t *testing.T) {
+	fsys := os.DirFS(filepath.Join("testdata", "tiny-llama"))
+
+	_, want, _ := convertFull(t, fsys)
+	maps.DeleteFunc(want, func(k string, _ any) bool {
+		return !strings.HasPrefix(k, "tokenizer.")
+	})
+
+	kv, err := ConvertTokenizer(fsys, "llama", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip through GGUF so values are decoded the same way
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, kv, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := ggml.Decode(bytes.NewReader(b.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := f.KV()
+	maps.DeleteFunc(got, func(k string, _ any) bool {
+		return !strings.HasPrefix(k, "tokenizer.")
+	})
+
+	if diff := cmp.Diff(generateResultsJSON(t, nil, want, ggml.Tensors{}), generateResultsJSON(t, nil, got, ggml.Tensors{})); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := ConvertTokenizer(fsys, "llama", 4); err == nil || !strings.Contains(err.Error(), "vocabulary is larger than expected") {
+		t.Errorf("expected vocabulary size error, got %v", err)
+	}
+
+	if _, err := ConvertTokenizer(fsys, "mamba", 6); !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Errorf("expected unsupported architecture error, got %v", err)
+	}
+}
+
+func TestConvertTokenizerArchitecture(t *testing.T) {
+	fsys := os.DirFS(filepath.Join("testdata", "tiny-llama"))
+
+	llama, err := ConvertTokenizer(fsys, "llama", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("gemma", func(t *testing.T) {
+		kv, err := ConvertTokenizer(fsys, "gemma2", 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range map[string]uint32{
+			"tokenizer.ggml.eot_token_id":    107,
+			"tokenizer.ggml.middle_token_id": 68,
+			"tokenizer.ggml.prefix_token_id": 67,
+			"tokenizer.ggml.suffix_token_id": 69,
+		} {
+			if kv[k] != v {
+				t.Errorf("expected %s to be %d, got %v", k, v, kv[k])
+			}
+		}
+	})
+
+	t.Run("bert", func(t *testing.T) {
+		kv, err := ConvertTokenizer(fsys, "bert", 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if kv["tokenizer.ggml.model"] != "bert" || kv["tokenizer.ggml.token_type_count"] != uint32(2) {
+			t.Errorf("expected bert tokenizer, got model %v and token type count %v", kv["tokenizer.ggml.model"], kv["tokenizer.ggml.token_type_count"])
+		}
+
+		// tokens are rewritten as phantom space tokens
+		tokens, want := kv["tokenizer.ggml.tokens"].([]string), llama["tokenizer.ggml.tokens"].([]string)
+		if len(tokens) != len(want) {
+			t.Fatalf("expected %d tokens, got %d", len(want), len(tokens))
+		}
+
+		for i := range tokens {
+			if w := want[i]; !strings.HasPrefix(w, "[") && tokens[i] != "\u2581"+w && tokens[i] != strings.TrimPrefix(w, "##") {
+				t.Errorf("expected token %d %q to be rewritten, got %q", i, w, tokens[i])
+			}
+		}
+	})
+}
+
+func TestConvertShapes(t *testing.T) {
+	config := `{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "intermediate_size": 8, "num_attention_heads": 2, "num_key_value_heads": 1, "num_hidden_layers": 1}`
+	shapes := func(changes map[string][]int) map[string][]int {
+		s := llamaTensors(1, map[string][]int{
+			"model.layers.0.self_attn.k_proj.weight": {2, 4},
+			"model.layers.0.self_attn.v_proj.weight": {2, 4},
+			"model.layers.0.mlp.down_proj.weight":    {4, 8},
+		})
+		maps.Copy(s, changes)
+		return s
+	}
+
+	cases := []struct {
+		name   string
+		shapes map[string][]int
+		err    string
+	}{
+		{"valid", shapes(nil), ""},
+		{
+			"wrong dimension",
+			shapes(map[string][]int{"model.layers.0.self_attn.k_proj.weight": {4, 4}}),
+			"tensor blk.0.attn_k.weight has shape [4 4], expected [2 4]",
+		},
+		{
+			"wrong rank",
+			shapes(map[string][]int{"model.layers.0.input_layernorm.weight": {4, 1}}),
+			"tensor blk.0.attn_norm.weight has shape [4 1], expected [4]",
+		},
+		{
+			"extra block",
+			shapes(map[string][]int{"model.layers.1.input_layernorm.weight": {4}}),
+			"tensor blk.1.attn_norm.weight is in block 1 but the model has 1 blocks",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"config.json":       &fstest.MapFile{Data: []byte(config)},
+				"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+				"model.safetensors": safetensorsFile(t, tt.shapes),
+			}
+
+			err := ConvertModel(fsys, io.Discard)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatal(err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package convert
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+// exportKinds maps GGUF tensor kinds to safetensors dtypes. Other tensors are
+// dequantized to F16.
+var exportKinds = map[uint32]string{
+	0:  "F32",
+	1:  "F16",
+	30: "BF16",
+}
+
+// ExportOptions configure [ExportModel].
+type ExportOptions struct {
+	// ShardSize is the largest size in bytes of each safetensors file. Zero
+	// writes a single model.safetensors.
+	ShardSize uint64
+
+	// Dequantize converts n values of a quantized tensor kind to float32 so it
+	// can be exported as F16. Quantized tensors can't be exported without it.
+	Dequantize func(kind uint32, data []byte, n uint64) ([]float32, error)
+}
+
+type exportTensor struct {
+	*ggml.Tensor
+
+	name  string
+	dtype string
+	size  uint64
+}
+
+func (t exportTensor) elements() uint64 {
+	n := uint64(1)
+	for _, dim := range t.Shape {
+		n *= dim
+	}
+
+	return n
+}
+
+// ExportModel reads a GGUF model from r and writes it to dir as safetensors
+// with a config.json and tokenizer files reconstructed from its metadata. It
+// is the inverse of [ConvertModel] and only supports llama models. Models
+// larger than opts.ShardSize are split into model-00001-of-0000N.safetensors
+// files listed in model.safetensors.index.json.
+func ExportModel(r io.ReadSeeker, dir string, opts ExportOptions) error {
+	f, _, err := ggml.Decode(r, -1)
+	if err != nil {
+		return err
+	}
+
+	kv := f.KV()
+	if arch := kv.Architecture(); arch != "llama" {
+		return fmt.Errorf("%w %q for export", ErrUnsupportedArchitecture, arch)
+	}
+
+	// undo the tensor renames done when converting
+	var p llamaModel
+	replacements := p.Replacements()
+	pairs := make([][2]string, 0, len(replacements)/2)
+	for i := 0; i+1 < len(replacements); i += 2 {
+		pairs = append(pairs, [2]string{replacements[i+1], replacements[i]})
+	}
+
+	// longer names first so that, for example, output_norm isn't renamed as
+	// output
+	slices.SortStableFunc(pairs, func(a, b [2]string) int {
+		return cmp.Compare(len(b[0]), len(a[0]))
+	})
+
+	var oldnew []string
+	for _, pair := range pairs {
+		oldnew = append(oldnew, pair[0], pair[1])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+
+	ts := f.Tensors()
+	var tensors []exportTensor
+	var factors []float32
+	var total uint64
+	for _, t := range ts.Items() {
+		// rope_freqs is generated from rope_scaling in config.json
+		if t.Name == "rope_freqs.weight" {
+			if t.Kind != 0 {
+				return fmt.Errorf("exporting %s tensor %s is not supported", t.Type(), t.Name)
+			}
+
+			if _, err := r.Seek(int64(ts.Offset+t.Offset), io.SeekStart); err != nil {
+				return err
+			}
+
+			factors = make([]float32, t.Size()/4)
+			if err := binary.Read(r, binary.LittleEndian, factors); err != nil {
+				return err
+			}
+			continue
+		}
+
+		et := exportTensor{Tensor: t, name: replacer.Replace(t.Name), size: t.Size()}
+		if dtype, ok := exportKinds[t.Kind]; ok {
+			et.dtype = dtype
+		} else if opts.Dequantize != nil {
+			et.dtype, et.size = "F16", 2*et.elements()
+		} else {
+			return fmt.Errorf("exporting %s tensor %s is not supported", t.Type(), t.Name)
+		}
+
+		tensors = append(tensors, et)
+		total += et.size
+	}
+
+	var shards [][]exportTensor
+	var size uint64
+	for _, t := range tensors {
+		if len(shards) == 0 || (opts.ShardSize > 0 && size > 0 && size+t.size > opts.ShardSize) {
+			shards = append(shards, nil)
+			size = 0
+		}
+
+		shards[len(shards)-1] = append(shards[len(shards)-1], t)
+		size += t.size
+	}
+
+	weights := make(map[string]string)
+	for i, shard := range shards {
+		name := "model.safetensors"
+		if len(shards) > 1 {
+			name = fmt.Sprintf("model-%05d-of-%05d.safetensors", i+1, len(shards))
+		}
+
+		if err := exportShard(r, ts.Offset, kv, shard, filepath.Join(dir, name), opts); err != nil {
+			return err
+		}
+
+		for _, t := range shard {
+			weights[t.name] = name
+		}
+	}
+
+	if len(shards) > 1 {
+		if err := writeJSON(filepath.Join(dir, "model.safetensors.index.json"), map[string]any{
+			"metadata":   map[string]uint64{"total_size": total},
+			"weight_map": weights,
+		}); err != nil {
+			return err
+		}
+	}
+
+	config := map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"model_type":              "llama",
+		"vocab_size":              len(kv.Strings("tokenizer.ggml.tokens")),
+		"hidden_size":             kv.EmbeddingLength(),
+		"intermediate_size":       kv.Uint("feed_forward_length"),
+		"num_hidden_layers":       kv.BlockCount(),
+		"num_attention_heads":     kv.HeadCount(),
+		"num_key_value_heads":     kv.HeadCountKV(),
+		"head_dim":                kv.EmbeddingHeadCountK(),
+		"max_position_embeddings": kv.ContextLength(),
+		"rms_norm_eps":            kv.Float("attention.layer_norm_rms_epsilon"),
+		"rope_theta":              kv.Float("rope.freq_base", 10000),
+		"tie_word_embeddings": !slices.ContainsFunc(tensors, func(t exportTensor) bool {
+			return t.Name == "output.weight"
+		}),
+	}
+
+	if scaling := exportRopeScaling(kv, factors); scaling != nil {
+		config["rope_scaling"] = scaling
+	}
+
+	if err := writeJSON(filepath.Join(dir, "config.json"), config); err != nil {
+		return err
+	}
+
+	return exportTokenizer(kv, dir)
+}
+
+// exportRopeScaling returns the rope_scaling of config.json for kv, or nil if
+// it has none. factors are the frequency factors of the rope_freqs tensor
+// that conversion computes for llama3 rope scaling.
+func exportRopeScaling(kv ggml.KV, factors []float32) map[string]any {
+	if _, ok := kv[kv.Architecture()+".rope.scaling.type"]; ok {
+		scaling := map[string]any{
+			"rope_type": kv.String("rope.scaling.type"),
+			"factor":    kv.Float("rope.scaling.factor"),
+		}
+
+		if _, ok := kv[kv.Architecture()+".rope.scaling.original_context_length"]; ok {
+			scaling["original_max_position_embeddings"] = kv.Uint("rope.scaling.original_context_length")
+		}
+
+		return scaling
+	} else if len(factors) == 0 {
+		return nil
+	}
+
+	// the factors are 1 for high frequencies, factor for low frequencies and
+	// smoothed between the two. Only the ratios of the original context
+	// length to low_freq_factor and high_freq_factor determine them, so the
+	// default original context length of conversion is assumed.
+	factor := slices.Max(factors)
+	original := 8192.0
+	dim := float64(kv.Uint("rope.dimension_count", uint32(kv.EmbeddingHeadCount())))
+	theta := float64(kv.Float("rope.freq_base", 10000))
+
+	// smooth is linear in original/wavelength, so two smoothed factors
+	// give the low and high frequency factors
+	var xs, smooths []float64
+	for i, f := range factors {
+		if f <= 1 || f >= factor {
+			continue
+		}
+
+		wavelength := 2 * math.Pi * math.Pow(theta, float64(2*i)/dim)
+		xs = append(xs, original/wavelength)
+		smooths = append(smooths, (1/float64(f)-1/float64(factor))/(1-1/float64(factor)))
+	}
+
+	low, high := 1.0, 4.0
+	if n := len(xs); n > 1 && xs[0] != xs[n-1] {
+		slope := (smooths[n-1] - smooths[0]) / (xs[n-1] - xs[0])
+		low = xs[0] - smooths[0]/slope
+		high = low + 1/slope
+	}
+
+	round := func(f float64) float64 {
+		return math.Round(f*1e4) / 1e4
+	}
+
+	return map[string]any{
+		"rope_type":                        "llama3",
+		"factor":                           factor,
+		"low_freq_factor":                  round(low),
+		"high_freq_factor":                 round(high),
+		"original_max_position_embeddings": uint32(original),
+	}
+}
+
+// exportShard writes tensors read from r, whose tensor data starts at offset,
+// to the safetensors file p.
+func exportShard(r io.ReadSeeker, offset uint64, kv ggml.KV, tensors []exportTensor, p string, opts ExportOptions) error {
+	header := map[string]any{"__metadata__": map[string]string{"format": "pt"}}
+	var o uint64
+	for _, t := range tensors {
+		shape := slices.Clone(t.Shape)
+		slices.Reverse(shape)
+		header[t.name] = safetensorMetadata{
+			Type:    t.dtype,
+			Shape:   shape,
+			Offsets: []int64{int64(o), int64(o + t.size)},
+		}
+		o += t.size
+	}
+
+	bts, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	// pad the header so tensor data is aligned
+	bts = append(bts, bytes.Repeat([]byte{' '}, (8-len(bts)%8)%8)...)
+
+	w, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(bts))); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(bts); err != nil {
+		return err
+	}
+
+	for _, t := range tensors {
+		if _, err := r.Seek(int64(offset+t.Offset), io.SeekStart); err != nil {
+			return err
+		}
+
+		var heads uint64
+		switch {
+		case strings.HasSuffix(t.Name, "attn_q.weight"):
+			heads = kv.HeadCount()
+		case strings.HasSuffix(t.Name, "attn_k.weight"):
+			heads = kv.HeadCountKV()
+		}
+
+		_, ok := exportKinds[t.Kind]
+		if ok && heads == 0 {
+			if _, err := io.CopyN(w, r, int64(t.Size())); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := make([]byte, t.Size())
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		if !ok {
+			f32s, err := opts.Dequantize(t.Kind, data, t.elements())
+			if err != nil {
+				return fmt.Errorf("%s: %w", t.Name, err)
+			}
+
+			data = make([]byte, 2*len(f32s))
+			for i, v := range f32s {
+				binary.LittleEndian.PutUint16(data[2*i:], float16.Fromfloat32(v).Bits())
+			}
+		}
+
+		if heads > 0 {
+			data, err = unpermuteRows(data, t.Shape[len(t.Shape)-1], heads)
+			if err != nil {
+				return fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// unpermuteRows reverses the attention head permutation applied to query and
+// key weights in [llamaModel.repack]. data holds rows rows of equal size.
+func unpermuteRows(data []byte, rows, heads uint64) ([]byte, error) {
+	if rows == 0 || heads == 0 || rows%(heads*2) != 0 || uint64(len(data))%rows != 0 {
+		return nil, fmt.Errorf("can't split %d rows into %d heads", rows, heads)
+	}
+
+	size := uint64(len(data)) / rows
+	dim := rows / heads
+	out := make([]byte, len(data))
+	for h := range heads {
+		for i := range dim / 2 {
+			for j := range uint64(2) {
+				src := h*dim + 2*i + j
+				dst := h*dim + j*dim/2 + i
+				copy(out[dst*size:(dst+1)*size], data[src*size:(src+1)*size])
+			}
+		}
+	}
+
+	return out, nil
+}
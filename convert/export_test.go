@@ -0,0 +1,327 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+func TestExportModel(t *testing.T) {
+	src := t.TempDir()
+
+	// tensors with distinct values so any misplaced rows are caught
+	shapes := map[string][]int{
+		"model.embed_tokens.weight":                      {4, 4},
+		"model.layers.0.input_layernorm.weight":          {4},
+		"model.layers.0.self_attn.q_proj.weight":         {4, 4},
+		"model.layers.0.self_attn.k_proj.weight":         {2, 4},
+		"model.layers.0.self_attn.v_proj.weight":         {2, 4},
+		"model.layers.0.self_attn.o_proj.weight":         {4, 4},
+		"model.layers.0.post_attention_layernorm.weight": {4},
+		"model.norm.weight":                              {4},
+		"lm_head.weight":                                 {4, 4},
+	}
+
+	var data bytes.Buffer
+	td := make(map[string]*tensorData)
+	var value float32
+	for name, shape := range shapes {
+		n := 1
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		td[name] = &tensorData{Offsets: []int{data.Len(), data.Len() + 4*n}, Type: "F32", Shape: shape}
+		for range n {
+			value++
+			if err := binary.Write(&data, binary.LittleEndian, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	bts, err := json.Marshal(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st bytes.Buffer
+	if err := binary.Write(&st, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+	st.Write(bts)
+	st.Write(data.Bytes())
+
+	for name, content := range map[string][]byte{
+		"model.safetensors":     st.Bytes(),
+		"config.json":           []byte(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 2, "num_key_value_heads": 1, "num_hidden_layers": 1, "rope_scaling": {"type": "linear", "factor": 2}}`),
+		"tokenizer.json":        []byte(`{"added_tokens": [{"id": 3, "content": "<s>", "special": true}], "model": {"type": "BPE", "vocab": {"a": 0, "b": 1, "ab": 2}, "merges": ["a b"]}, "pre_tokenizer": {"type": "Sequence", "pretokenizers": [{"type": "Split", "pattern": {"Regex": "` + strings.ReplaceAll(exportPretokenizers["llama-bpe"], `\`, `\\`) + `"}}]}}`),
+		"tokenizer_config.json": []byte(`{"bos_token": "<s>", "add_bos_token": true, "chat_template": "{{ messages }}"}`),
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, kv, tensors := convertFull(t, os.DirFS(src))
+	if pre := kv["tokenizer.ggml.pre"]; pre != "llama-bpe" {
+		t.Fatalf("expected the llama-bpe pretokenizer, got %v", pre)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		opts   ExportOptions
+		shards int
+	}{
+		{"single", ExportOptions{}, 1},
+		// small enough to split the model into several shards
+		{"sharded", ExportOptions{ShardSize: 64}, 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := t.TempDir()
+			if err := ExportModel(f, dst, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			if matches, _ := filepath.Glob(filepath.Join(dst, "*.safetensors")); len(matches) != tt.shards {
+				t.Fatalf("expected %d safetensors files, got %v", tt.shards, matches)
+			}
+
+			// converting the exported model again gives the same model
+			g, exportedKV, exportedTensors := convertFull(t, os.DirFS(dst))
+
+			for _, k := range []string{
+				"llama.block_count", "llama.embedding_length", "llama.attention.head_count", "llama.attention.head_count_kv",
+				"llama.rope.scaling.type", "llama.rope.scaling.factor",
+				"tokenizer.ggml.model", "tokenizer.ggml.pre", "tokenizer.ggml.tokens", "tokenizer.ggml.token_type", "tokenizer.ggml.merges",
+				"tokenizer.ggml.bos_token_id", "tokenizer.ggml.add_bos_token", "tokenizer.chat_template",
+			} {
+				// arrays are compared as JSON
+				want, err := json.Marshal(kv[k])
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := json.Marshal(exportedKV[k])
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, ok := kv[k]; !ok {
+					t.Errorf("%s is missing from the converted model", k)
+				} else if diff := cmp.Diff(string(want), string(got)); diff != "" {
+					t.Errorf("%s mismatch (-want +got):\n%s", k, diff)
+				}
+			}
+
+			read := func(t *testing.T, f *os.File, offset, size uint64) []byte {
+				t.Helper()
+
+				b := make([]byte, size)
+				if _, err := f.ReadAt(b, int64(offset)); err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+
+				return b
+			}
+
+			want := make(map[string][]byte)
+			for _, tensor := range tensors.Items() {
+				want[tensor.Name] = read(t, f, tensors.Offset+tensor.Offset, tensor.Size())
+			}
+
+			got := make(map[string][]byte)
+			for _, tensor := range exportedTensors.Items() {
+				got[tensor.Name] = read(t, g, exportedTensors.Offset+tensor.Offset, tensor.Size())
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("tensor mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExportRopeScaling(t *testing.T) {
+	want := map[string]any{
+		"rope_type":                        "llama3",
+		"factor":                           float32(8),
+		"low_freq_factor":                  1.0,
+		"high_freq_factor":                 4.0,
+		"original_max_position_embeddings": uint32(8192),
+	}
+
+	p := llamaModel{HiddenSize: 4096, NumAttentionHeads: 32, RopeTheta: 500000}
+	p.RopeScaling.RopeType = "llama3"
+	p.RopeScaling.Factor = 8
+	p.RopeScaling.LowFrequencyFactor = 1
+	p.RopeScaling.HighFrequencyFactor = 4
+	p.RopeScaling.OriginalMaxPositionEmbeddings = 8192
+
+	kv := p.KV(&Tokenizer{Vocabulary: &Vocabulary{}})
+	if diff := cmp.Diff(want, exportRopeScaling(kv, p.RopeScaling.factors)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	p.RopeScaling.RopeType = "yarn"
+	p.RopeScaling.factors = nil
+	kv = p.KV(&Tokenizer{Vocabulary: &Vocabulary{}})
+	if diff := cmp.Diff(map[string]any{
+		"rope_type":                        "yarn",
+		"factor":                           float32(8),
+		"original_max_position_embeddings": uint32(8192),
+	}, exportRopeScaling(kv, nil)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExportTokenizerSentencePiece(t *testing.T) {
+	want := &Vocabulary{
+		Model:  "llama",
+		Tokens: []string{"<unk>", "<s>", "<0x00>", "▁a"},
+		Scores: []float32{0, 0, 0, -1},
+		Types:  []int32{tokenTypeUnknown, tokenTypeControl, tokenTypeByte, tokenTypeNormal},
+	}
+
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, ggml.KV{
+		"general.architecture":        "llama",
+		"tokenizer.ggml.model":        "llama",
+		"tokenizer.ggml.tokens":       want.Tokens,
+		"tokenizer.ggml.scores":       want.Scores,
+		"tokenizer.ggml.token_type":   want.Types,
+		"tokenizer.ggml.bos_token_id": uint32(1),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := ggml.Decode(bytes.NewReader(b.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := exportTokenizer(f.KV(), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseSentencePiece(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	bts, err := os.ReadFile(filepath.Join(dir, "tokenizer_config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config struct {
+		BOSToken string `json:"bos_token"`
+	}
+	if err := json.Unmarshal(bts, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.BOSToken != "<s>" {
+		t.Errorf("expected bos token <s>, got %q", config.BOSToken)
+	}
+}
+
+func TestExportModelUnsupported(t *testing.T) {
+	f, _, _ := convertFull(t, fstest.MapFS{
+		"config.json":       &fstest.MapFile{Data: []byte(`{"architectures": ["Qwen2ForCausalLM"], "hidden_size": 4, "num_attention_heads": 1}`)},
+		"tokenizer.json":    &fstest.MapFile{Data: []byte(`{}`)},
+		"model.safetensors": safetensorsFile(t, map[string][]int{"model.embed_tokens.weight": {2, 4}, "model.norm.weight": {4}}),
+	})
+
+	if err := ExportModel(f, t.TempDir(), ExportOptions{}); err == nil || !strings.Contains(err.Error(), "unsupported architecture") {
+		t.Errorf("expected unsupported architecture error, got %v", err)
+	}
+}
+
+func TestExportModelQuantized(t *testing.T) {
+	var b bytes.Buffer
+	// Q8_0 blocks of 32 values are 34 bytes
+	if err := ggml.WriteGGUF(&b, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.attention.head_count":    uint32(1),
+		"llama.attention.head_count_kv": uint32(1),
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Kind: 8, Shape: []uint64{32, 2}, WriterTo: bytes.NewReader(make([]byte, 68))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(b.Bytes())
+	if err := ExportModel(r, t.TempDir(), ExportOptions{}); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected not supported error, got %v", err)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := ExportModel(r, dst, ExportOptions{
+		Dequantize: func(kind uint32, data []byte, n uint64) ([]float32, error) {
+			if kind != 8 || len(data) != 68 || n != 64 {
+				t.Errorf("unexpected dequantize of %d bytes of kind %d into %d values", len(data), kind, n)
+			}
+
+			f32s := make([]float32, n)
+			for i := range f32s {
+				f32s[i] = float32(i)
+			}
+			return f32s, nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := parseSafetensors(os.DirFS(dst), strings.NewReplacer(), "model.safetensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 1 || ts[0].Name() != "model.embed_tokens.weight" {
+		t.Fatalf("unexpected tensors %v", ts)
+	}
+
+	var got bytes.Buffer
+	if _, err := ts[0].WriteTo(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]uint16, 64)
+	for i := range want {
+		want[i] = float16.Fromfloat32(float32(i)).Bits()
+	}
+
+	u16s := make([]uint16, 64)
+	if err := binary.Read(&got, binary.LittleEndian, u16s); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(want, u16s); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,181 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+// exportPretokenizers are the regular expressions of the pretokenizers that
+// [parseTokenizer] identifies by their checksum. Other pretokenizers are
+// exported as the default byte level pretokenizer.
+var exportPretokenizers = map[string]string{
+	"llama-bpe": `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`,
+	"qwen2":     `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`,
+}
+
+type exportAddedToken struct {
+	ID         int    `json:"id"`
+	Content    string `json:"content"`
+	SingleWord bool   `json:"single_word"`
+	Lstrip     bool   `json:"lstrip"`
+	Rstrip     bool   `json:"rstrip"`
+	Normalized bool   `json:"normalized"`
+	Special    bool   `json:"special"`
+}
+
+// exportTokenizer writes the tokenizer in kv to dir as tokenizer.json, for
+// BPE tokenizers, or tokenizer.model, for SentencePiece tokenizers, along
+// with a tokenizer_config.json of its special tokens and chat template. It is
+// the inverse of [parseTokenizer]. Nothing is written for a model without a
+// tokenizer.
+func exportTokenizer(kv ggml.KV, dir string) error {
+	if _, ok := kv["tokenizer.ggml.tokens"]; !ok {
+		return nil
+	}
+
+	tokens := kv.Strings("tokenizer.ggml.tokens")
+	var types []uint32
+	if _, ok := kv["tokenizer.ggml.token_type"]; ok {
+		types = kv.Uints("tokenizer.ggml.token_type")
+	}
+
+	var scores []float32
+	if _, ok := kv["tokenizer.ggml.scores"]; ok {
+		scores = kv.Floats("tokenizer.ggml.scores")
+	}
+
+	// control and user defined tokens are added tokens of the tokenizer
+	isAdded := func(i int) bool {
+		return i < len(types) && (int32(types[i]) == tokenTypeControl || int32(types[i]) == tokenTypeUserDefined)
+	}
+
+	var added []exportAddedToken
+	for i, token := range tokens {
+		if isAdded(i) {
+			added = append(added, exportAddedToken{
+				ID:      i,
+				Content: token,
+				Special: int32(types[i]) == tokenTypeControl,
+			})
+		}
+	}
+
+	switch model := kv.String("tokenizer.ggml.model"); model {
+	case "gpt2":
+		vocab := make(map[string]int, len(tokens))
+		for i, token := range tokens {
+			if !isAdded(i) {
+				vocab[token] = i
+			}
+		}
+
+		var merges []string
+		if _, ok := kv["tokenizer.ggml.merges"]; ok {
+			merges = kv.Strings("tokenizer.ggml.merges")
+		}
+
+		var pretokenizer any = map[string]any{"type": "ByteLevel", "add_prefix_space": false, "trim_offsets": true, "use_regex": true}
+		if regex, ok := exportPretokenizers[kv.String("tokenizer.ggml.pre")]; ok {
+			pretokenizer = map[string]any{
+				"type": "Sequence",
+				"pretokenizers": []any{
+					map[string]any{"type": "Split", "pattern": map[string]string{"Regex": regex}, "behavior": "Isolated", "invert": false},
+					map[string]any{"type": "ByteLevel", "add_prefix_space": false, "trim_offsets": true, "use_regex": false},
+				},
+			}
+		}
+
+		if err := writeJSON(filepath.Join(dir, "tokenizer.json"), map[string]any{
+			"version":        "1.0",
+			"added_tokens":   added,
+			"normalizer":     nil,
+			"pre_tokenizer":  pretokenizer,
+			"post_processor": nil,
+			"decoder":        map[string]any{"type": "ByteLevel", "add_prefix_space": true, "trim_offsets": true, "use_regex": true},
+			"model": map[string]any{
+				"type":   "BPE",
+				"vocab":  vocab,
+				"merges": merges,
+			},
+		}); err != nil {
+			return err
+		}
+	case "llama":
+		var spm sentencepiece.ModelProto
+		for i, token := range tokens {
+			piece := &sentencepiece.ModelProto_SentencePiece{Piece: proto.String(token)}
+			if i < len(scores) {
+				piece.Score = proto.Float32(scores[i])
+			}
+
+			if i < len(types) {
+				piece.Type = sentencepiece.ModelProto_SentencePiece_Type(types[i]).Enum()
+				if int32(types[i]) == tokenTypeByte {
+					spm.TrainerSpec = &sentencepiece.TrainerSpec{ByteFallback: proto.Bool(true)}
+				}
+			}
+
+			spm.Pieces = append(spm.Pieces, piece)
+		}
+
+		if spm.TrainerSpec == nil {
+			spm.TrainerSpec = &sentencepiece.TrainerSpec{}
+		}
+		spm.TrainerSpec.ModelType = sentencepiece.TrainerSpec_BPE.Enum()
+
+		bts, err := proto.Marshal(&spm)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "tokenizer.model"), bts, 0o644); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("exporting %q tokenizers is not supported", model)
+	}
+
+	decoder := make(map[string]exportAddedToken, len(added))
+	for _, token := range added {
+		decoder[fmt.Sprint(token.ID)] = token
+	}
+
+	config := map[string]any{"added_tokens_decoder": decoder}
+	if template := kv.ChatTemplate(); template != "" {
+		config["chat_template"] = template
+	}
+
+	var p ModelParameters
+	for _, st := range p.specialTokenTypes() {
+		key := SpecialVocabulary{Type: st}.Key()
+		if _, ok := kv[fmt.Sprintf("tokenizer.ggml.%s_token_id", key)]; !ok {
+			continue
+		}
+
+		if id := int(kv.Uint(fmt.Sprintf("tokenizer.ggml.%s_token_id", key))); id < len(tokens) {
+			config[st+"_token"] = tokens[id]
+		}
+
+		if _, ok := kv[fmt.Sprintf("tokenizer.ggml.add_%s_token", key)]; ok {
+			config[fmt.Sprintf("add_%s_token", st)] = kv.Bool(fmt.Sprintf("tokenizer.ggml.add_%s_token", key))
+		}
+	}
+
+	return writeJSON(filepath.Join(dir, "tokenizer_config.json"), config)
+}
+
+func writeJSON(p string, v any) error {
+	bts, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, bts, 0o644)
+}
@@ -1,9 +1,15 @@
 package convert
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -57,30 +63,168 @@ func (t *tensorBase) SetRepacker(fn repacker) {
 
 type repacker func(string, []float32, []uint64) ([]float32, error)
 
-func parseTensors(fsys fs.FS, replacer *strings.Replacer) ([]Tensor, error) {
-	patterns := []struct {
-		Pattern string
-		Func    func(fs.FS, *strings.Replacer, ...string) ([]Tensor, error)
-	}{
-		{"model-*-of-*.safetensors", parseSafetensors},
-		{"model.safetensors", parseSafetensors},
-		{"adapters.safetensors", parseSafetensors},
-		{"adapter_model.safetensors", parseSafetensors},
-		{"pytorch_model-*-of-*.bin", parseTorch},
-		{"pytorch_model.bin", parseTorch},
-		{"consolidated.*.pth", parseTorch},
+// tensorRenamer renames source tensors to the names expected by a converter.
+// It is usually a [strings.Replacer].
+type tensorRenamer interface {
+	Replace(string) string
+}
+
+// tensorRemap is a rule read from tensor_map.json. Source tensor names
+// matching Pattern are rewritten with Replace, which may refer to submatches,
+// before the converter's own replacements are applied.
+type tensorRemap struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+type remapRenamer struct {
+	rules    []tensorRemap
+	replacer tensorRenamer
+}
+
+func (r remapRenamer) Replace(s string) string {
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllString(s, rule.Replace)
+	}
+
+	return r.replacer.Replace(s)
+}
+
+// parseTensorRemap reads tensor remapping rules from tensor_map.json in fsys,
+// if it exists.
+func parseTensorRemap(fsys fs.FS) ([]tensorRemap, error) {
+	bts, err := fs.ReadFile(fsys, "tensor_map.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rules []tensorRemap
+	if err := json.Unmarshal(bts, &rules); err != nil {
+		return nil, fmt.Errorf("tensor_map.json: %w", err)
+	}
+
+	for i := range rules {
+		rules[i].re, err = regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("tensor_map.json: %w", err)
+		}
+	}
+
+	return rules, nil
+}
+
+var tensorFormats = []struct {
+	Pattern string
+	Format  string
+	Func    func(fs.FS, tensorRenamer, ...string) ([]Tensor, error)
+}{
+	{"model-*-of-*.safetensors", "safetensors", parseSafetensors},
+	{"model.safetensors", "safetensors", parseSafetensors},
+	{"adapters.safetensors", "safetensors", parseSafetensors},
+	{"adapter_model.safetensors", "safetensors", parseSafetensors},
+	{"pytorch_model-*-of-*.bin", "pytorch", parseTorch},
+	{"pytorch_model.bin", "pytorch", parseTorch},
+	{"consolidated.*.pth", "pytorch", parseTorch},
+	{"model.onnx", "onnx", parseONNX},
+	{"decoder_model.onnx", "onnx", parseONNX},
+}
+
+// parseTensors parses tensors from the first of tensorFormats found in fsys.
+// Safetensors are preferred over pytorch files when both are present, in which
+// case the pytorch files must contain tensors of the same names and shapes.
+// Only the first safetensors files found are used; others, such as a leftover
+// adapter, are ignored.
+//
+// Rules in tensor_map.json, if present, rename source tensors before replacer.
+func parseTensors(fsys fs.FS, replacer tensorRenamer) ([]Tensor, error) {
+	rules, err := parseTensorRemap(fsys)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, pattern := range patterns {
+	if len(rules) > 0 {
+		replacer = remapRenamer{rules, replacer}
+	}
+
+	var ts []Tensor
+	var format string
+	var files []string
+	compared := make(map[string]bool)
+	for _, pattern := range tensorFormats {
 		matches, err := fs.Glob(fsys, pattern.Pattern)
 		if err != nil {
 			return nil, err
 		}
 
-		if len(matches) > 0 {
-			return pattern.Func(fsys, replacer, matches...)
+		if len(matches) == 0 {
+			continue
+		}
+
+		switch {
+		case files == nil:
+			ts, err = pattern.Func(fsys, replacer, matches...)
+			if err != nil {
+				return nil, err
+			}
+
+			format, files = pattern.Format, matches
+		case pattern.Format == format || compared[pattern.Format]:
+			slog.Info("ignoring tensor files", "files", files, "ignored_files", matches)
+		default:
+			compared[pattern.Format] = true
+
+			other, err := pattern.Func(fsys, replacer, matches...)
+			if err != nil {
+				slog.Warn("couldn't compare tensors in another format", "format", format, "files", files, "ignored_format", pattern.Format, "ignored_files", matches, "error", err)
+				continue
+			}
+
+			if !sameTensors(ts, other) {
+				return nil, fmt.Errorf("conflicting tensors in %v and %v", files, matches)
+			}
+
+			slog.Info("ignoring tensors in another format", "format", format, "files", files, "ignored_format", pattern.Format, "ignored_files", matches)
+		}
+	}
+
+	if files == nil {
+		return nil, errors.New("unknown tensor format")
+	}
+
+	return ts, nil
+}
+
+// sameTensors reports whether a and b contain tensors with the same names and shapes
+func sameTensors(a, b []Tensor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	shapes := make(map[string][]uint64, len(a))
+	for _, t := range a {
+		shapes[t.Name()] = t.Shape()
+	}
+
+	for _, t := range b {
+		if shape, ok := shapes[t.Name()]; !ok || !slices.Equal(shape, t.Shape()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tensorFormat returns the format of the tensor files parseTensors reads from fsys
+func tensorFormat(fsys fs.FS) string {
+	for _, pattern := range tensorFormats {
+		if matches, _ := fs.Glob(fsys, pattern.Pattern); len(matches) > 0 {
+			return pattern.Format
 		}
 	}
 
-	return nil, errors.New("unknown tensor format")
+	return ""
 }
@@ -0,0 +1,504 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of the parts of onnx.proto that are read
+const (
+	onnxModelGraph = 7
+
+	onnxGraphNode        = 1
+	onnxGraphInitializer = 5
+
+	onnxNodeInput  = 1
+	onnxNodeName   = 3
+	onnxNodeOpType = 4
+
+	onnxTensorDims         = 1
+	onnxTensorDataType     = 2
+	onnxTensorName         = 8
+	onnxTensorRawData      = 9
+	onnxTensorExternalData = 13
+	onnxTensorDataLocation = 14
+
+	onnxEntryKey   = 1
+	onnxEntryValue = 2
+)
+
+// onnxDataTypes maps the ONNX tensor data types that can be converted to the
+// safetensors dtypes that name them
+var onnxDataTypes = map[uint64]string{
+	1:  "F32",
+	10: "F16",
+	16: "BF16",
+}
+
+var errSkipField = errors.New("skip field")
+
+type onnxInitializer struct {
+	name     string
+	dataType uint64
+	dims     []uint64
+
+	// offset and size of the tensor data in path
+	path         string
+	offset, size int64
+}
+
+// parseONNX parses the initializers of the ONNX graphs in ps. Parameters
+// keep their names when they're exported as is; the weights of linear
+// layers, which exporters store transposed as anonymous MatMul inputs, are
+// named after the MatMul node that uses them and transposed back. This covers
+// decoder-only transformers exported with torch.onnx or Optimum. The model's
+// architecture is read from config.json as it is for safetensors.
+func parseONNX(fsys fs.FS, replacer tensorRenamer, ps ...string) ([]Tensor, error) {
+	var ts []Tensor
+	names := make(map[string]struct{})
+	for _, p := range ps {
+		inits, matmuls, err := readONNXGraph(fsys, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		for _, init := range inits {
+			name, transposed := init.name, false
+			if node, ok := matmuls[init.name]; ok && strings.HasPrefix(init.name, "onnx::") {
+				name, transposed = onnxMatMulParameter(node), true
+			}
+
+			// anything else is a constant folded from the graph, such as a
+			// rotary embedding cache
+			if name == "" || !(strings.HasSuffix(name, ".weight") || strings.HasSuffix(name, ".bias")) {
+				continue
+			}
+
+			dtype, ok := onnxDataTypes[init.dataType]
+			if !ok {
+				return nil, fmt.Errorf("%s: unsupported ONNX data type %d for %s", p, init.dataType, init.name)
+			}
+
+			if len(init.dims) == 0 || (transposed && len(init.dims) != 2) {
+				return nil, fmt.Errorf("%s: unsupported shape %v for %s", p, init.dims, init.name)
+			}
+
+			if init.path == "" {
+				return nil, fmt.Errorf("%s: unsupported storage for %s, only raw and external data can be converted", p, init.name)
+			}
+
+			size := int64(2)
+			if dtype == "F32" {
+				size = 4
+			}
+
+			for _, dim := range init.dims {
+				size *= int64(dim)
+			}
+
+			if init.size != size {
+				return nil, fmt.Errorf("%s: %s has %d bytes of data but shape %v", p, init.name, init.size, init.dims)
+			}
+
+			ggufName := replacer.Replace(name)
+			if _, ok := names[ggufName]; ok {
+				return nil, fmt.Errorf("duplicate tensor name '%s' was found for this model", ggufName)
+			}
+			names[ggufName] = struct{}{}
+
+			st := safetensor{
+				fs:     fsys,
+				path:   init.path,
+				dtype:  dtype,
+				offset: init.offset,
+				size:   init.size,
+				tensorBase: &tensorBase{
+					name:  ggufName,
+					shape: init.dims,
+				},
+			}
+
+			if !transposed {
+				ts = append(ts, st)
+				continue
+			}
+
+			st.tensorBase.shape = []uint64{init.dims[1], init.dims[0]}
+			t := onnxMatMulWeight{st}
+			t.SetRepacker(nil)
+			ts = append(ts, t)
+		}
+	}
+
+	return ts, nil
+}
+
+// onnxMatMulParameter returns the name of the parameter exported as the
+// weight of the MatMul node named node, e.g.
+// "/model/layers.0/self_attn/q_proj/MatMul" is the weight of
+// "model.layers.0.self_attn.q_proj".
+func onnxMatMulParameter(node string) string {
+	module, ok := strings.CutSuffix(strings.TrimPrefix(node, "/"), "/MatMul")
+	if !ok || module == "" {
+		return ""
+	}
+
+	return strings.ReplaceAll(module, "/", ".") + ".weight"
+}
+
+// onnxMatMulWeight is a linear layer's weight that's stored transposed as the
+// input of an ONNX MatMul node.
+type onnxMatMulWeight struct {
+	safetensor
+}
+
+func (t onnxMatMulWeight) SetRepacker(fn repacker) {
+	t.tensorBase.SetRepacker(func(name string, data []float32, shape []uint64) ([]float32, error) {
+		rows, cols := shape[1], shape[0]
+		transposed := make([]float32, len(data))
+		for i := range rows {
+			for j := range cols {
+				transposed[j*rows+i] = data[i*cols+j]
+			}
+		}
+
+		if fn != nil {
+			return fn(name, transposed, shape)
+		}
+
+		return transposed, nil
+	})
+}
+
+// readONNXGraph reads the initializers of the graph in the ONNX model p and
+// the names of the MatMul nodes using them. Tensor data isn't read.
+func readONNXGraph(fsys fs.FS, p string) ([]onnxInitializer, map[string]string, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := &onnxReader{r: bufio.NewReader(f)}
+
+	var inits []onnxInitializer
+	matmuls := make(map[string]string)
+	err = r.message(fi.Size(), func(num protowire.Number, typ protowire.Type) error {
+		if num != onnxModelGraph || typ != protowire.BytesType {
+			return errSkipField
+		}
+
+		end, err := r.end()
+		if err != nil {
+			return err
+		}
+
+		return r.message(end, func(num protowire.Number, typ protowire.Type) error {
+			switch {
+			case num == onnxGraphNode && typ == protowire.BytesType:
+				name, opType, inputs, err := r.node()
+				if err != nil {
+					return err
+				}
+
+				if opType == "MatMul" && len(inputs) == 2 {
+					matmuls[inputs[1]] = name
+				}
+
+				return nil
+			case num == onnxGraphInitializer && typ == protowire.BytesType:
+				init, err := r.initializer(fsys, p)
+				if err != nil {
+					return err
+				}
+
+				inits = append(inits, init)
+				return nil
+			default:
+				return errSkipField
+			}
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return inits, matmuls, nil
+}
+
+// onnxReader decodes protobuf messages from r without holding them in
+// memory, so that tensor data stored in the model can be skipped over.
+type onnxReader struct {
+	r *bufio.Reader
+	n int64
+
+	// limit is where the message being read ends. Lengths read from the
+	// model can't run past it, so a corrupt length fails instead of
+	// allocating more than the model holds.
+	limit int64
+}
+
+func (r *onnxReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+
+	return b, err
+}
+
+func (r *onnxReader) varint() (uint64, error) {
+	return binary.ReadUvarint(r)
+}
+
+// end reads the length of a length-delimited field and returns the offset
+// where its value ends.
+func (r *onnxReader) end() (int64, error) {
+	n, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+
+	if n > uint64(r.limit-r.n) {
+		return 0, fmt.Errorf("malformed ONNX model: field of %d bytes at offset %d runs past the end of its message", n, r.n)
+	}
+
+	return r.n + int64(n), nil
+}
+
+func (r *onnxReader) bytes() ([]byte, error) {
+	end, err := r.end()
+	if err != nil {
+		return nil, err
+	}
+
+	n := end - r.n
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+	r.n += n
+
+	return b, nil
+}
+
+func (r *onnxReader) discard(n int64) error {
+	d, err := r.r.Discard(int(n))
+	r.n += int64(d)
+	return err
+}
+
+func (r *onnxReader) skip(typ protowire.Type) error {
+	switch typ {
+	case protowire.VarintType:
+		_, err := r.varint()
+		return err
+	case protowire.Fixed32Type:
+		return r.discard(4)
+	case protowire.Fixed64Type:
+		return r.discard(8)
+	case protowire.BytesType:
+		end, err := r.end()
+		if err != nil {
+			return err
+		}
+
+		return r.discard(end - r.n)
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", typ)
+	}
+}
+
+// message reads the fields of the message ending at end, calling fn with
+// each field's number and type. fn reads the field's value or returns
+// errSkipField to skip it.
+func (r *onnxReader) message(end int64, fn func(protowire.Number, protowire.Type) error) error {
+	limit := r.limit
+	r.limit = end
+	defer func() { r.limit = limit }()
+
+	for r.n < end {
+		tag, err := r.varint()
+		if err != nil {
+			return err
+		}
+
+		num, typ := protowire.DecodeTag(tag)
+		if err := fn(num, typ); errors.Is(err, errSkipField) {
+			if err := r.skip(typ); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if r.n != end {
+		return errors.New("malformed ONNX model")
+	}
+
+	return nil
+}
+
+func (r *onnxReader) node() (name, opType string, inputs []string, err error) {
+	end, err := r.end()
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	err = r.message(end, func(num protowire.Number, typ protowire.Type) error {
+		if typ != protowire.BytesType {
+			return errSkipField
+		}
+
+		var s *string
+		switch num {
+		case onnxNodeInput:
+			inputs = append(inputs, "")
+			s = &inputs[len(inputs)-1]
+		case onnxNodeName:
+			s = &name
+		case onnxNodeOpType:
+			s = &opType
+		default:
+			return errSkipField
+		}
+
+		b, err := r.bytes()
+		*s = string(b)
+		return err
+	})
+
+	return name, opType, inputs, err
+}
+
+func (r *onnxReader) initializer(fsys fs.FS, p string) (onnxInitializer, error) {
+	end, err := r.end()
+	if err != nil {
+		return onnxInitializer{}, err
+	}
+
+	var init onnxInitializer
+	var external bool
+	location := make(map[string]string)
+	err = r.message(end, func(num protowire.Number, typ protowire.Type) error {
+		switch {
+		case num == onnxTensorDims && typ == protowire.VarintType:
+			dim, err := r.varint()
+			init.dims = append(init.dims, dim)
+			return err
+		case num == onnxTensorDims && typ == protowire.BytesType:
+			// packed dims
+			end, err := r.end()
+			if err != nil {
+				return err
+			}
+
+			for r.n < end {
+				dim, err := r.varint()
+				if err != nil {
+					return err
+				}
+				init.dims = append(init.dims, dim)
+			}
+
+			return nil
+		case num == onnxTensorDataType && typ == protowire.VarintType:
+			init.dataType, err = r.varint()
+			return err
+		case num == onnxTensorName && typ == protowire.BytesType:
+			b, err := r.bytes()
+			init.name = string(b)
+			return err
+		case num == onnxTensorRawData && typ == protowire.BytesType:
+			end, err := r.end()
+			if err != nil {
+				return err
+			}
+
+			init.path, init.offset, init.size = p, r.n, end-r.n
+			return r.discard(init.size)
+		case num == onnxTensorExternalData && typ == protowire.BytesType:
+			end, err := r.end()
+			if err != nil {
+				return err
+			}
+
+			var key, value string
+			if err := r.message(end, func(num protowire.Number, typ protowire.Type) error {
+				if typ != protowire.BytesType || (num != onnxEntryKey && num != onnxEntryValue) {
+					return errSkipField
+				}
+
+				b, err := r.bytes()
+				if num == onnxEntryKey {
+					key = string(b)
+				} else {
+					value = string(b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+
+			location[key] = value
+			return nil
+		case num == onnxTensorDataLocation && typ == protowire.VarintType:
+			v, err := r.varint()
+			external = v == 1
+			return err
+		default:
+			return errSkipField
+		}
+	})
+	if err != nil {
+		return onnxInitializer{}, err
+	}
+
+	if external {
+		// external data is relative to the model
+		name := path.Join(path.Dir(p), location["location"])
+		if !fs.ValidPath(name) {
+			return onnxInitializer{}, fmt.Errorf("invalid external data location %q for %s", location["location"], init.name)
+		}
+
+		if v, ok := location["offset"]; ok {
+			if init.offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return onnxInitializer{}, fmt.Errorf("invalid external data offset for %s: %w", init.name, err)
+			}
+		}
+
+		// the data runs to the end of the file if its length isn't given
+		init.path, init.size = name, -1
+		if v, ok := location["length"]; ok {
+			if init.size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return onnxInitializer{}, fmt.Errorf("invalid external data length for %s: %w", init.name, err)
+			}
+		}
+
+		if init.size < 0 {
+			fi, err := fs.Stat(fsys, name)
+			if err != nil {
+				return onnxInitializer{}, err
+			}
+
+			init.size = fi.Size() - init.offset
+		}
+	}
+
+	return init, nil
+}
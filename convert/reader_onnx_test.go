@@ -0,0 +1,172 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/x448/float16"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type onnxTestTensor struct {
+	name     string
+	dims     []uint64
+	data     []float32
+	external string
+	offset   int
+}
+
+func (tt onnxTestTensor) marshal() []byte {
+	var b []byte
+	for _, dim := range tt.dims {
+		b = protowire.AppendTag(b, onnxTensorDims, protowire.VarintType)
+		b = protowire.AppendVarint(b, dim)
+	}
+
+	b = protowire.AppendTag(b, onnxTensorDataType, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, onnxTensorName, protowire.BytesType)
+	b = protowire.AppendString(b, tt.name)
+
+	if tt.external == "" {
+		var data bytes.Buffer
+		binary.Write(&data, binary.LittleEndian, tt.data)
+		b = protowire.AppendTag(b, onnxTensorRawData, protowire.BytesType)
+		return protowire.AppendBytes(b, data.Bytes())
+	}
+
+	for _, kv := range [][2]string{{"location", tt.external}, {"offset", strconv.Itoa(tt.offset)}} {
+		var entry []byte
+		entry = protowire.AppendTag(entry, onnxEntryKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, kv[0])
+		entry = protowire.AppendTag(entry, onnxEntryValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, kv[1])
+		b = protowire.AppendTag(b, onnxTensorExternalData, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	b = protowire.AppendTag(b, onnxTensorDataLocation, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func onnxTestNode(name, opType string, inputs ...string) []byte {
+	var b []byte
+	for _, input := range inputs {
+		b = protowire.AppendTag(b, onnxNodeInput, protowire.BytesType)
+		b = protowire.AppendString(b, input)
+	}
+
+	b = protowire.AppendTag(b, onnxNodeName, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, onnxNodeOpType, protowire.BytesType)
+	return protowire.AppendString(b, opType)
+}
+
+func onnxTestModel(nodes [][]byte, tensors ...onnxTestTensor) []byte {
+	var graph []byte
+	for _, node := range nodes {
+		graph = protowire.AppendTag(graph, onnxGraphNode, protowire.BytesType)
+		graph = protowire.AppendBytes(graph, node)
+	}
+
+	for _, tt := range tensors {
+		graph = protowire.AppendTag(graph, onnxGraphInitializer, protowire.BytesType)
+		graph = protowire.AppendBytes(graph, tt.marshal())
+	}
+
+	var b []byte
+	// ir_version, which is skipped
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 8)
+	b = protowire.AppendTag(b, onnxModelGraph, protowire.BytesType)
+	return protowire.AppendBytes(b, graph)
+}
+
+func TestParseONNX(t *testing.T) {
+	var external bytes.Buffer
+	binary.Write(&external, binary.LittleEndian, []float32{9, 9, 1, 2})
+
+	fsys := fstest.MapFS{
+		"model.onnx": &fstest.MapFile{Data: onnxTestModel(
+			[][]byte{
+				onnxTestNode("/model/embed_tokens/Gather", "Gather", "model.embed_tokens.weight", "input_ids"),
+				onnxTestNode("/model/layers.0/mlp/down_proj/MatMul", "MatMul", "/model/layers.0/mlp/Mul_output_0", "onnx::MatMul_42"),
+			},
+			onnxTestTensor{name: "model.embed_tokens.weight", dims: []uint64{2, 2}, data: []float32{1, 2, 3, 4}},
+			// MatMul weights are stored as the transpose of the parameter
+			onnxTestTensor{name: "onnx::MatMul_42", dims: []uint64{2, 3}, data: []float32{1, 2, 3, 4, 5, 6}},
+			onnxTestTensor{name: "model.norm.weight", dims: []uint64{2}, external: "model.onnx_data", offset: 8},
+			// constants folded from the graph are skipped
+			onnxTestTensor{name: "onnx::Cos_7", dims: []uint64{2}, data: []float32{1, 1}},
+		)},
+		"model.onnx_data": &fstest.MapFile{Data: external.Bytes()},
+	}
+
+	ts, err := parseTensors(fsys, strings.NewReplacer("model.", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tensorFormat(fsys); got != "onnx" {
+		t.Errorf("expected onnx format, got %q", got)
+	}
+
+	type tensor struct {
+		Name  string
+		Shape []uint64
+		Data  []float32
+	}
+
+	var got []tensor
+	for _, tt := range ts {
+		var b bytes.Buffer
+		if _, err := tt.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		// 2D tensors are written as F16
+		var data []float32
+		if tt.Kind() == tensorKindF16 {
+			u16s := make([]uint16, b.Len()/2)
+			binary.Read(&b, binary.LittleEndian, u16s)
+			for _, u16 := range u16s {
+				data = append(data, float16.Frombits(u16).Float32())
+			}
+		} else {
+			data = make([]float32, b.Len()/4)
+			binary.Read(&b, binary.LittleEndian, data)
+		}
+
+		got = append(got, tensor{tt.Name(), tt.Shape(), data})
+	}
+
+	want := []tensor{
+		{"embed_tokens.weight", []uint64{2, 2}, []float32{1, 2, 3, 4}},
+		{"layers.0.mlp.down_proj.weight", []uint64{3, 2}, []float32{1, 4, 2, 5, 3, 6}},
+		{"norm.weight", []uint64{2}, []float32{1, 2}},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseONNXCorruptLength(t *testing.T) {
+	// a node whose name claims to be far longer than the model
+	var node []byte
+	node = protowire.AppendTag(node, onnxNodeName, protowire.BytesType)
+	node = protowire.AppendVarint(node, 1<<60)
+
+	fsys := fstest.MapFS{
+		"model.onnx": &fstest.MapFile{Data: onnxTestModel([][]byte{node})},
+	}
+
+	if _, err := parseTensors(fsys, strings.NewReplacer()); err == nil || !strings.Contains(err.Error(), "runs past the end of its message") {
+		t.Errorf("expected malformed model error, got %v", err)
+	}
+}
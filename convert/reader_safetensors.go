@@ -9,7 +9,6 @@ import (
 	"io"
 	"io/fs"
 	"slices"
-	"strings"
 
 	"github.com/d4l3k/go-bfloat16"
 	"github.com/x448/float16"
@@ -22,29 +21,13 @@ type safetensorMetadata struct {
 	Offsets []int64  `json:"data_offsets"`
 }
 
-func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]Tensor, error) {
+func parseSafetensors(fsys fs.FS, replacer tensorRenamer, ps ...string) ([]Tensor, error) {
 	var ts []Tensor
 	for _, p := range ps {
-		f, err := fsys.Open(p)
+		n, headers, err := readSafetensorsHeader(fsys, p)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
-
-		var n int64
-		if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
-			return nil, err
-		}
-
-		b := bytes.NewBuffer(make([]byte, 0, n))
-		if _, err = io.CopyN(b, f, n); err != nil {
-			return nil, err
-		}
-
-		var headers map[string]safetensorMetadata
-		if err := json.NewDecoder(b).Decode(&headers); err != nil {
-			return nil, err
-		}
 
 		keys := maps.Keys(headers)
 		slices.Sort(keys)
@@ -80,6 +63,34 @@ func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]T
 	return ts, nil
 }
 
+// readSafetensorsHeader returns the size and contents of the header of the
+// safetensors file p. The file is closed before returning so that models
+// with many shards don't hold them all open.
+func readSafetensorsHeader(fsys fs.FS, p string) (int64, map[string]safetensorMetadata, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var n int64
+	if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+		return 0, nil, err
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, n))
+	if _, err = io.CopyN(b, f, n); err != nil {
+		return 0, nil, err
+	}
+
+	var headers map[string]safetensorMetadata
+	if err := json.NewDecoder(b).Decode(&headers); err != nil {
+		return 0, nil, err
+	}
+
+	return n, headers, nil
+}
+
 // safetensorsPad returns the padded size of the safetensors file given a length n and offset s
 func safetensorsPad(n, offset int64) int64 {
 	return 8 + n + offset
@@ -0,0 +1,336 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func safetensorsFile(t *testing.T, shapes map[string][]int) *fstest.MapFile {
+	t.Helper()
+
+	var offset int
+	td := make(map[string]*tensorData)
+	for name, shape := range shapes {
+		size := 4
+		for _, dim := range shape {
+			size *= dim
+		}
+
+		td[name] = &tensorData{Offsets: []int{offset, offset + size}, Type: "F32", Shape: shape}
+		offset += size
+	}
+
+	bts, err := json.Marshal(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Write(bts)
+	b.Write(make([]byte, offset))
+	return &fstest.MapFile{Data: b.Bytes()}
+}
+
+// torchFile returns a pytorch zip file, as written by torch.save, of F32
+// tensors of shapes.
+func torchFile(t *testing.T, shapes map[string][]int) *fstest.MapFile {
+	t.Helper()
+
+	str := func(b *bytes.Buffer, s string) {
+		b.WriteByte('X')
+		binary.Write(b, binary.LittleEndian, uint32(len(s)))
+		b.WriteString(s)
+	}
+
+	tuple := func(b *bytes.Buffer, ints ...int) {
+		b.WriteByte('(')
+		for _, i := range ints {
+			b.WriteByte('J')
+			binary.Write(b, binary.LittleEndian, int32(i))
+		}
+		b.WriteByte('t')
+	}
+
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+
+	// a protocol 2 pickle of the dictionary of tensors
+	var pkl bytes.Buffer
+	pkl.Write([]byte{0x80, 2, '}', '('})
+	for i, name := range slices.Sorted(maps.Keys(shapes)) {
+		shape := shapes[name]
+		stride := make([]int, len(shape))
+		n := 1
+		for j := len(shape) - 1; j >= 0; j-- {
+			stride[j] = n
+			n *= shape[j]
+		}
+
+		str(&pkl, name)
+		pkl.WriteString("ctorch._utils\n_rebuild_tensor_v2\n(")
+
+		// the persistent id of the tensor's storage
+		pkl.WriteByte('(')
+		str(&pkl, "storage")
+		pkl.WriteString("ctorch\nFloatStorage\n")
+		str(&pkl, strconv.Itoa(i))
+		str(&pkl, "cpu")
+		pkl.WriteByte('J')
+		binary.Write(&pkl, binary.LittleEndian, int32(n))
+		pkl.WriteString("tQ")
+
+		pkl.WriteByte('J')
+		binary.Write(&pkl, binary.LittleEndian, int32(0))
+		tuple(&pkl, shape...)
+		tuple(&pkl, stride...)
+		pkl.WriteByte(0x89)
+		pkl.WriteString("ccollections\nOrderedDict\n)RtR")
+
+		f, err := w.Create("archive/data/" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 4*n))
+	}
+	pkl.WriteString("u.")
+
+	f, err := w.Create("archive/data.pkl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(pkl.Bytes())
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &fstest.MapFile{Data: b.Bytes()}
+}
+
+func TestParseTorch(t *testing.T) {
+	file := torchFile(t, map[string][]int{"model.norm.weight": {4}, "model.embed_tokens.weight": {2, 4}})
+
+	type tensor struct {
+		Name  string
+		Shape []uint64
+	}
+
+	want := []tensor{
+		{"embed_tokens.weight", []uint64{2, 4}},
+		{"norm.weight", []uint64{4}},
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pytorch_model.bin"), file.Data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		fsys fs.FS
+	}{
+		{"memory", fstest.MapFS{"pytorch_model.bin": file}},
+		// read from where the file is rather than the working directory
+		{"disk", os.DirFS(dir)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := parseTorch(tt.fsys, strings.NewReplacer("model.", ""), "pytorch_model.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []tensor
+			for _, tt := range ts {
+				got = append(got, tensor{tt.Name(), tt.Shape()})
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseTensorsPrecedence(t *testing.T) {
+	names := func(t *testing.T, ts []Tensor) (s []string) {
+		t.Helper()
+		for _, tensor := range ts {
+			s = append(s, tensor.Name())
+		}
+
+		return s
+	}
+
+	t.Run("safetensors over pytorch", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"model.safetensors": safetensorsFile(t, map[string][]int{"a": {2}, "b": {2, 2}}),
+			// not a valid pickle so the tensors can't be compared
+			"pytorch_model.bin": &fstest.MapFile{Data: []byte("invalid")},
+		}
+
+		ts, err := parseTensors(fsys, strings.NewReplacer())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"a", "b"}, names(t, ts)); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if got := tensorFormat(fsys); got != "safetensors" {
+			t.Errorf("expected safetensors format, got %q", got)
+		}
+	})
+
+	t.Run("leftover adapter", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"model.safetensors":         safetensorsFile(t, map[string][]int{"a": {2}, "b": {2, 2}}),
+			"adapters.safetensors":      safetensorsFile(t, map[string][]int{"a.lora_a": {2, 1}}),
+			"adapter_model.safetensors": safetensorsFile(t, map[string][]int{"a.lora_b": {1, 2}}),
+		}
+
+		ts, err := parseTensors(fsys, strings.NewReplacer())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"a", "b"}, names(t, ts), cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("matching pytorch", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"model.safetensors": safetensorsFile(t, map[string][]int{"a": {2}, "b": {2, 2}}),
+			"pytorch_model.bin": torchFile(t, map[string][]int{"a": {2}, "b": {2, 2}}),
+		}
+
+		if _, err := parseTensors(fsys, strings.NewReplacer()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("conflicting pytorch", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"model.safetensors": safetensorsFile(t, map[string][]int{"a": {2}, "b": {2, 2}}),
+			"pytorch_model.bin": torchFile(t, map[string][]int{"a": {2}, "b": {4, 2}}),
+		}
+
+		if _, err := parseTensors(fsys, strings.NewReplacer()); err == nil || !strings.Contains(err.Error(), "conflicting tensors") {
+			t.Errorf("expected conflicting tensors error, got %v", err)
+		}
+	})
+}
+
+func TestParseTensorsRemap(t *testing.T) {
+	fsys := fstest.MapFS{
+		"model.safetensors": safetensorsFile(t, map[string][]int{"transformer.h.0.attn.weight": {2}, "lm_head.weight": {2}}),
+		"tensor_map.json": &fstest.MapFile{Data: []byte(`[
+			{"pattern": "^transformer\\.h\\.(\\d+)\\.", "replace": "model.layers.${1}."}
+		]`)},
+	}
+
+	ts, err := parseTensors(fsys, strings.NewReplacer("model.layers", "blk", "lm_head", "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, tensor := range ts {
+		names = append(names, tensor.Name())
+	}
+
+	if diff := cmp.Diff([]string{"output.weight", "blk.0.attn.weight"}, names, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	fsys["tensor_map.json"] = &fstest.MapFile{Data: []byte(`[{"pattern": "(", "replace": ""}]`)}
+	if _, err := parseTensors(fsys, strings.NewReplacer()); err == nil || !strings.Contains(err.Error(), "tensor_map.json") {
+		t.Errorf("expected tensor_map.json error, got %v", err)
+	}
+}
+
+func TestSafetensorsBF16(t *testing.T) {
+	// 1, -2, 0.5 and 3.140625 as bfloat16
+	bf16s := []uint16{0x3f80, 0xc000, 0x3f00, 0x4049}
+
+	var data bytes.Buffer
+	for range 2 {
+		if err := binary.Write(&data, binary.LittleEndian, bf16s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bts, err := json.Marshal(map[string]*tensorData{
+		"norm.weight":   {Offsets: []int{0, 8}, Type: "BF16", Shape: []int{4}},
+		"matrix.weight": {Offsets: []int{8, 16}, Type: "BF16", Shape: []int{2, 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(bts)
+	b.Write(data.Bytes())
+
+	ts, err := parseSafetensors(fstest.MapFS{"model.safetensors": &fstest.MapFile{Data: b.Bytes()}}, strings.NewReplacer(), "model.safetensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		// bfloat16 is the upper half of float32
+		"norm.weight":   []uint32{0x3f800000, 0xc0000000, 0x3f000000, 0x40490000},
+		"matrix.weight": []uint16{0x3c00, 0xc000, 0x3800, 0x4248},
+	}
+
+	for _, tensor := range ts {
+		t.Run(tensor.Name(), func(t *testing.T) {
+			var b bytes.Buffer
+			if _, err := tensor.WriteTo(&b); err != nil {
+				t.Fatal(err)
+			}
+
+			var got any
+			switch tensor.Kind() {
+			case tensorKindF32:
+				u32s := make([]uint32, 4)
+				if err := binary.Read(&b, binary.LittleEndian, u32s); err != nil {
+					t.Fatal(err)
+				}
+				got = u32s
+			case tensorKindF16:
+				u16s := make([]uint16, 4)
+				if err := binary.Read(&b, binary.LittleEndian, u16s); err != nil {
+					t.Fatal(err)
+				}
+				got = u16s
+			}
+
+			if diff := cmp.Diff(want[tensor.Name()], got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,34 +1,48 @@
 package convert
 
 import (
+	"archive/zip"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
-	"strings"
+	"os"
+	"path"
 
+	"github.com/nlpodyssey/gopickle/pickle"
 	"github.com/nlpodyssey/gopickle/pytorch"
 	"github.com/nlpodyssey/gopickle/types"
 )
 
-func parseTorch(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]Tensor, error) {
+func parseTorch(fsys fs.FS, replacer tensorRenamer, ps ...string) ([]Tensor, error) {
 	var ts []Tensor
 	for _, p := range ps {
-		pt, err := pytorch.Load(p)
+		pt, err := loadTorch(fsys, p)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", p, err)
 		}
 
-		for _, k := range pt.(*types.Dict).Keys() {
-			t := pt.(*types.Dict).MustGet(k)
+		d, ok := pt.(*types.Dict)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a dictionary of tensors, got %T", p, pt)
+		}
+
+		for _, k := range d.Keys() {
+			name, ok := k.(string)
+			t, tok := d.MustGet(k).(*pytorch.Tensor)
+			if !ok || !tok {
+				return nil, fmt.Errorf("%s: expected a dictionary of tensors", p)
+			}
 
 			var shape []uint64
-			for dim := range t.(*pytorch.Tensor).Size {
+			for _, dim := range t.Size {
 				shape = append(shape, uint64(dim))
 			}
 
 			ts = append(ts, torch{
-				storage: t.(*pytorch.Tensor).Source,
+				storage: t.Source,
 				tensorBase: &tensorBase{
-					name:  replacer.Replace(k.(string)),
+					name:  replacer.Replace(name),
 					shape: shape,
 				},
 			})
@@ -38,6 +52,101 @@ func parseTorch(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]Tensor,
 	return ts, nil
 }
 
+// loadTorch reads the tensors of the pytorch file p in fsys. Tensors of zip
+// files, the format written by torch.save since pytorch 1.6, are read without
+// their data. Files in the legacy format are read from disk in full.
+func loadTorch(fsys fs.FS, p string) (any, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("pytorch files must support random access")
+	}
+
+	zr, err := zip.NewReader(ra, fi.Size())
+	if errors.Is(err, zip.ErrFormat) {
+		// pytorch.Load only reads from disk, so this goes through the
+		// path the file was opened from instead of one relative to the
+		// working directory
+		if osf, ok := f.(*os.File); ok {
+			return pytorch.Load(osf.Name())
+		}
+
+		return nil, errors.New("pytorch files in the legacy format must be read from disk")
+	} else if err != nil {
+		return nil, err
+	}
+
+	var data *zip.File
+	for _, zf := range zr.File {
+		if path.Base(zf.Name) == "data.pkl" {
+			data = zf
+			break
+		}
+	}
+	if data == nil {
+		return nil, errors.New("data.pkl not found")
+	}
+
+	r, err := data.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	u := pickle.NewUnpickler(r)
+	u.FindClass = func(module, name string) (any, error) {
+		if module == "torch._utils" && name == "_rebuild_tensor_v2" {
+			return &pytorch.RebuildTensorV2{}, nil
+		} else if c, ok := torchStorageClasses[name]; ok && module == "torch" {
+			return c, nil
+		}
+
+		return nil, fmt.Errorf("unsupported class %s.%s", module, name)
+	}
+	u.PersistentLoad = func(id any) (any, error) {
+		// ("storage", class, key, location, size) where key names the
+		// archive entry holding the data, which isn't read
+		t, ok := id.(*types.Tuple)
+		if !ok || t.Len() < 5 || t.Get(0) != "storage" {
+			return nil, fmt.Errorf("unexpected persistent id %v", id)
+		}
+
+		c, ok := t.Get(1).(pytorch.StorageClassInterface)
+		location, lok := t.Get(3).(string)
+		size, sok := t.Get(4).(int)
+		if !ok || !lok || !sok {
+			return nil, fmt.Errorf("unexpected persistent id %v", id)
+		}
+
+		return c.New(size, location), nil
+	}
+
+	return u.Load()
+}
+
+var torchStorageClasses = map[string]pytorch.StorageClassInterface{
+	"BFloat16Storage": &pytorch.BFloat16StorageClass{},
+	"BoolStorage":     &pytorch.BoolStorageClass{},
+	"ByteStorage":     &pytorch.ByteStorageClass{},
+	"CharStorage":     &pytorch.CharStorageClass{},
+	"DoubleStorage":   &pytorch.DoubleStorageClass{},
+	"FloatStorage":    &pytorch.FloatStorageClass{},
+	"HalfStorage":     &pytorch.HalfStorageClass{},
+	"IntStorage":      &pytorch.IntStorageClass{},
+	"LongStorage":     &pytorch.LongStorageClass{},
+	"ShortStorage":    &pytorch.ShortStorageClass{},
+}
+
 type torch struct {
 	storage pytorch.StorageInterface
 	*tensorBase
@@ -0,0 +1,111 @@
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"math"
+	"strings"
+
+	"github.com/x448/float16"
+)
+
+// TensorStats summarizes the values of a tensor. NaN and infinite values are
+// counted but not included in Min, Max or Mean.
+type TensorStats struct {
+	Name     string
+	Min, Max float32
+	Mean     float64
+	NaN, Inf int
+}
+
+// Stats reads every tensor in fsys, as loaded for conversion but without
+// renaming or repacking, and returns statistics on their values. It reads all
+// of the tensor data so it's as slow as converting the model.
+func Stats(fsys fs.FS) ([]TensorStats, error) {
+	ts, err := parseTensors(fsys, strings.NewReplacer())
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]TensorStats, 0, len(ts))
+	for _, t := range ts {
+		w := statsWriter{kind: t.Kind()}
+		w.Name = t.Name()
+		if _, err := t.WriteTo(&w); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+
+		if w.count > 0 {
+			w.Mean = w.sum / float64(w.count)
+		}
+
+		stats = append(stats, w.TensorStats)
+	}
+
+	return stats, nil
+}
+
+// statsWriter accumulates [TensorStats] from F32 or F16 tensor data written
+// to it.
+type statsWriter struct {
+	TensorStats
+	kind  uint32
+	count int
+	sum   float64
+
+	// partial holds bytes of a value split across writes
+	partial []byte
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	size := 4
+	switch w.kind {
+	case tensorKindF32:
+	case tensorKindF16:
+		size = 2
+	default:
+		return 0, fmt.Errorf("unknown storage type: %d", w.kind)
+	}
+
+	if len(w.partial) > 0 {
+		p = append(w.partial, p...)
+		w.partial = nil
+	}
+
+	for ; len(p) >= size; p = p[size:] {
+		var f float32
+		if w.kind == tensorKindF16 {
+			f = float16.Frombits(binary.LittleEndian.Uint16(p)).Float32()
+		} else {
+			f = math.Float32frombits(binary.LittleEndian.Uint32(p))
+		}
+
+		w.add(f)
+	}
+
+	w.partial = append(w.partial, p...)
+	return n, nil
+}
+
+func (w *statsWriter) add(f float32) {
+	switch {
+	case math.IsNaN(float64(f)):
+		w.NaN++
+	case math.IsInf(float64(f), 0):
+		w.Inf++
+	default:
+		if w.count == 0 || f < w.Min {
+			w.Min = f
+		}
+
+		if w.count == 0 || f > w.Max {
+			w.Max = f
+		}
+
+		w.count++
+		w.sum += float64(f)
+	}
+}
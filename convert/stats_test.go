@@ -0,0 +1,71 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStats(t *testing.T) {
+	values := []float32{-2, 1, float32(math.NaN()), 4, float32(math.Inf(1)), 3}
+
+	var data bytes.Buffer
+	for range 2 {
+		if err := binary.Write(&data, binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bts, err := json.Marshal(map[string]*tensorData{
+		// written as F32
+		"norm.weight": {Offsets: []int{0, 24}, Type: "F32", Shape: []int{6}},
+		// written as F16
+		"matrix.weight": {Offsets: []int{24, 48}, Type: "F32", Shape: []int{2, 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(bts)
+	b.Write(data.Bytes())
+
+	stats, err := Stats(fstest.MapFS{"model.safetensors": &fstest.MapFile{Data: b.Bytes()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]TensorStats{
+		{Name: "matrix.weight", Min: -2, Max: 4, Mean: 1.5, NaN: 1, Inf: 1},
+		{Name: "norm.weight", Min: -2, Max: 4, Mean: 1.5, NaN: 1, Inf: 1},
+	}, stats); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStatsWriterPartial(t *testing.T) {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, []float32{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// values split across writes are still counted
+	w := statsWriter{kind: tensorKindF32}
+	for _, p := range [][]byte{b.Bytes()[:3], b.Bytes()[3:9], b.Bytes()[9:]} {
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w.count != 3 || w.sum != 6 || w.Min != 1 || w.Max != 3 {
+		t.Errorf("unexpected stats %+v", w)
+	}
+}
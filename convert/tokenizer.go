@@ -171,9 +171,45 @@ func parseTokenizer(fsys fs.FS, specialTokenTypes []string) (*Tokenizer, error)
 		}
 	}
 
+	if t.Template == "" {
+		template, err := parseChatTemplate(fsys)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Template = template
+	}
+
 	return t, nil
 }
 
+// parseChatTemplate reads the chat template saved next to, instead of in,
+// tokenizer_config.json by newer versions of transformers. It returns an
+// empty string if there is none.
+func parseChatTemplate(fsys fs.FS) (string, error) {
+	if bts, err := fs.ReadFile(fsys, "chat_template.jinja"); err == nil {
+		return string(bts), nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	bts, err := fs.ReadFile(fsys, "chat_template.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var p struct {
+		ChatTemplate string `json:"chat_template"`
+	}
+	if err := json.Unmarshal(bts, &p); err != nil {
+		return "", fmt.Errorf("invalid chat_template.json: %w", err)
+	}
+
+	return p.ChatTemplate, nil
+}
+
 type tokenizer struct {
 	AddedTokens []token `json:"added_tokens"`
 	Model       struct {
@@ -234,7 +270,12 @@ func parseVocabularyFromTokenizer(fsys fs.FS) (*Vocabulary, error) {
 	keys := maps.Keys(tokens)
 	slices.Sort(keys)
 
-	v := Vocabulary{Model: "gpt2"}
+	model, err := tokenizerModel(t.Model.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	v := Vocabulary{Model: model}
 	for _, k := range keys {
 		token := tokens[k]
 		v.Tokens = append(v.Tokens, token.Content)
@@ -253,6 +294,18 @@ func parseVocabularyFromTokenizer(fsys fs.FS) (*Vocabulary, error) {
 	return &v, nil
 }
 
+// tokenizerModel maps a tokenizer.json model type to its tokenizer.ggml.model value
+func tokenizerModel(t string) (string, error) {
+	switch t {
+	case "", "BPE":
+		return "gpt2", nil
+	case "WordPiece":
+		return "bert", nil
+	default:
+		return "", fmt.Errorf("unsupported tokenizer model type %q", t)
+	}
+}
+
 func parseVocabulary(fsys fs.FS) (*Vocabulary, error) {
 	patterns := []struct {
 		Pattern string
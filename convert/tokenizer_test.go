@@ -79,6 +79,46 @@ func TestParseTokenizer(t *testing.T) {
 				Template:   "<default template>",
 			},
 		},
+		{
+			name: "jinja chat template",
+			fsys: createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
+				"tokenizer.json":        strings.NewReader(`{}`),
+				"tokenizer_config.json": strings.NewReader(`{}`),
+				"chat_template.jinja":   strings.NewReader(`<jinja template>`),
+			}),
+			want: &Tokenizer{
+				Vocabulary: &Vocabulary{Model: "gpt2"},
+				Pre:        "default",
+				Template:   "<jinja template>",
+			},
+		},
+		{
+			name: "json chat template",
+			fsys: createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
+				"tokenizer.json":     strings.NewReader(`{}`),
+				"chat_template.json": strings.NewReader(`{"chat_template": "<json template>"}`),
+			}),
+			want: &Tokenizer{
+				Vocabulary: &Vocabulary{Model: "gpt2"},
+				Pre:        "default",
+				Template:   "<json template>",
+			},
+		},
+		{
+			name: "config chat template preferred",
+			fsys: createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
+				"tokenizer.json": strings.NewReader(`{}`),
+				"tokenizer_config.json": strings.NewReader(`{
+					"chat_template": "<default template>"
+				}`),
+				"chat_template.jinja": strings.NewReader(`<jinja template>`),
+			}),
+			want: &Tokenizer{
+				Vocabulary: &Vocabulary{Model: "gpt2"},
+				Pre:        "default",
+				Template:   "<default template>",
+			},
+		},
 		{
 			name: "added tokens",
 			fsys: createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
@@ -247,6 +287,22 @@ func TestParseTokenizer(t *testing.T) {
 				Pre: "default",
 			},
 		},
+		{
+			name: "wordpiece model",
+			fsys: createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
+				"tokenizer.json": strings.NewReader(`{
+					"model": {
+						"type": "WordPiece"
+					}
+				}`),
+			}),
+			want: &Tokenizer{
+				Vocabulary: &Vocabulary{
+					Model: "bert",
+				},
+				Pre: "default",
+			},
+		},
 	}
 
 	for _, tt := range cases {
@@ -262,3 +318,17 @@ func TestParseTokenizer(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTokenizerUnsupportedModel(t *testing.T) {
+	fsys := createTokenizerFS(t, t.TempDir(), map[string]io.Reader{
+		"tokenizer.json": strings.NewReader(`{
+			"model": {
+				"type": "Unigram"
+			}
+		}`),
+	})
+
+	if _, err := parseTokenizer(fsys, nil); err == nil || !strings.Contains(err.Error(), "Unigram") {
+		t.Errorf("expected unsupported tokenizer model error, got %v", err)
+	}
+}
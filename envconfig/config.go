@@ -79,6 +79,63 @@ func AllowedOrigins() (origins []string) {
 	return origins
 }
 
+// FetchHosts returns the hosts that model files can be downloaded from when creating models. FetchHosts can be configured via the OLLAMA_FETCH_HOSTS environment variable.
+// Default is none, which disables downloading. "*" allows any host and "*.example.com" any subdomain of example.com.
+func FetchHosts() (hosts []string) {
+	if s := Var("OLLAMA_FETCH_HOSTS"); s != "" {
+		for _, host := range strings.Split(s, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, strings.ToLower(host))
+			}
+		}
+	}
+
+	return hosts
+}
+
+// RegistryMirrors returns the URLs that requests to registry hosts are sent to instead. RegistryMirrors can be configured via the OLLAMA_REGISTRY_MIRRORS environment variable
+// as a comma separated list of host=url pairs, for example "registry.ollama.ai=https://mirror.example.com".
+func RegistryMirrors() map[string]*url.URL {
+	mirrors := make(map[string]*url.URL)
+	for _, pair := range strings.Split(Var("OLLAMA_REGISTRY_MIRRORS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		host, rawURL, _ := strings.Cut(pair, "=")
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if host = strings.TrimSpace(host); host == "" || err != nil || u.Scheme == "" || u.Host == "" {
+			slog.Warn("invalid registry mirror, ignoring", "key", "OLLAMA_REGISTRY_MIRRORS", "value", pair)
+			continue
+		}
+
+		mirrors[host] = u
+	}
+
+	return mirrors
+}
+
+// RegistryHeaders returns headers added to registry requests. RegistryHeaders can be configured via the OLLAMA_REGISTRY_HEADERS environment variable
+// as a comma separated list of name=value pairs.
+func RegistryHeaders() map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(Var("OLLAMA_REGISTRY_HEADERS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			slog.Warn("invalid registry header, ignoring", "key", "OLLAMA_REGISTRY_HEADERS", "value", pair)
+			continue
+		}
+
+		headers[name] = strings.TrimSpace(value)
+	}
+
+	return headers
+}
+
 // Models returns the path to the models directory. Models directory can be configured via the OLLAMA_MODELS environment variable.
 // Default is $HOME/.ollama/models
 func Models() string {
@@ -94,6 +151,26 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// Templates returns the directory of custom templates considered when detecting a model's template. Templates can be configured via the OLLAMA_TEMPLATES environment variable.
+// Default is the templates directory in the models directory
+func Templates() string {
+	if s := Var("OLLAMA_TEMPLATES"); s != "" {
+		return s
+	}
+
+	return filepath.Join(Models(), "templates")
+}
+
+// TmpDir returns the directory used for temporary files when creating models. TmpDir can be configured via the OLLAMA_TMPDIR environment variable.
+// Default is the system temporary directory
+func TmpDir() string {
+	if s := Var("OLLAMA_TMPDIR"); s != "" {
+		return s
+	}
+
+	return os.TempDir()
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -170,6 +247,14 @@ var (
 	NewEngine = Bool("OLLAMA_NEW_ENGINE")
 	// ContextLength sets the default context length
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 2048)
+	// VerifyBlobs verifies the sha256 digest of existing model blobs when they are reused.
+	VerifyBlobs = Bool("OLLAMA_VERIFY_BLOBS")
+	// KeepConverted keeps a copy of models converted from safetensors in the temporary directory.
+	KeepConverted = Bool("OLLAMA_KEEP_CONVERTED")
+	// ForceImport imports models even if their architecture can't be run.
+	ForceImport = Bool("OLLAMA_FORCE_IMPORT")
+	// TensorStats reports statistics on tensor values when importing safetensors models.
+	TensorStats = Bool("OLLAMA_TENSOR_STATS")
 )
 
 func String(s string) func() string {
@@ -211,6 +296,8 @@ var (
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
 	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
 	MaxVRAM = Uint("OLLAMA_MAX_VRAM", 0)
+	// VocabPadding sets the number of token embedding rows allowed beyond the vocabulary when converting models. VocabPadding can be configured via the OLLAMA_VOCAB_PADDING environment variable.
+	VocabPadding = Uint("OLLAMA_VOCAB_PADDING", 1024)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -230,6 +317,12 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 // Set aside VRAM per GPU
 var GpuOverhead = Uint64("OLLAMA_GPU_OVERHEAD", 0)
 
+// MaxUnpackedSize limits the size in bytes of decompressed model files. Zero limits them only by free disk space.
+var MaxUnpackedSize = Uint64("OLLAMA_MAX_UNPACKED_SIZE", 0)
+
+// MaxModelFiles limits the number of files, including adapter files, in a model import.
+var MaxModelFiles = Uint("OLLAMA_MAX_MODEL_FILES", 4096)
+
 type EnvVar struct {
 	Name        string
 	Value       any
@@ -239,24 +332,36 @@ type EnvVar struct {
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
 		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_FETCH_HOSTS":       {"OLLAMA_FETCH_HOSTS", FetchHosts(), "A comma separated list of hosts that model files can be downloaded from when creating models"},
 		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
 		"OLLAMA_KV_CACHE_TYPE":     {"OLLAMA_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
 		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
 		"OLLAMA_HOST":              {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
 		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_FORCE_IMPORT":      {"OLLAMA_FORCE_IMPORT", ForceImport(), "Import models even if their architecture is not supported"},
+		"OLLAMA_KEEP_CONVERTED":    {"OLLAMA_KEEP_CONVERTED", KeepConverted(), "Keep a copy of converted models before quantization for debugging"},
 		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
 		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_MODEL_FILES":   {"OLLAMA_MAX_MODEL_FILES", MaxModelFiles(), "Maximum number of files in a model import"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"OLLAMA_MAX_UNPACKED_SIZE": {"OLLAMA_MAX_UNPACKED_SIZE", MaxUnpackedSize(), "Maximum size of decompressed model files (bytes)"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
 		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
 		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
+		"OLLAMA_REGISTRY_HEADERS":  {"OLLAMA_REGISTRY_HEADERS", RegistryHeaders(), "A comma separated list of name=value headers added to registry requests"},
+		"OLLAMA_REGISTRY_MIRRORS":  {"OLLAMA_REGISTRY_MIRRORS", RegistryMirrors(), "A comma separated list of host=url registry mirrors"},
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_TEMPLATES":         {"OLLAMA_TEMPLATES", Templates(), "The path to custom templates used when detecting a model's template"},
+		"OLLAMA_TENSOR_STATS":      {"OLLAMA_TENSOR_STATS", TensorStats(), "Report statistics on tensor values when importing models"},
+		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir(), "The path to store temporary files when creating models"},
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 2048)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
+		"OLLAMA_VERIFY_BLOBS":      {"OLLAMA_VERIFY_BLOBS", VerifyBlobs(), "Verify the digest of existing model blobs before reusing them"},
+		"OLLAMA_VOCAB_PADDING":     {"OLLAMA_VOCAB_PADDING", VocabPadding(), "Token embedding rows allowed beyond the vocabulary when converting models (default: 1024)"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
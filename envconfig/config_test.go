@@ -145,6 +145,41 @@ func TestOrigins(t *testing.T) {
 	}
 }
 
+func TestFetchHosts(t *testing.T) {
+	cases := map[string][]string{
+		"":                                 nil,
+		"huggingface.co":                   {"huggingface.co"},
+		"HuggingFace.co, *.example.com,, ": {"huggingface.co", "*.example.com"},
+	}
+
+	for value, expect := range cases {
+		t.Run(value, func(t *testing.T) {
+			t.Setenv("OLLAMA_FETCH_HOSTS", value)
+
+			if diff := cmp.Diff(expect, FetchHosts()); diff != "" {
+				t.Errorf("%s: mismatch (-want +got):\n%s", value, diff)
+			}
+		})
+	}
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	t.Setenv("OLLAMA_REGISTRY_MIRRORS", "registry.ollama.ai=https://mirror.example.com/ollama, invalid, example.com=not a url,")
+
+	mirrors := RegistryMirrors()
+	if len(mirrors) != 1 || mirrors["registry.ollama.ai"].String() != "https://mirror.example.com/ollama" {
+		t.Errorf("unexpected mirrors %v", mirrors)
+	}
+}
+
+func TestRegistryHeaders(t *testing.T) {
+	t.Setenv("OLLAMA_REGISTRY_HEADERS", "X-Team=models, X-Empty=, invalid")
+
+	if diff := cmp.Diff(map[string]string{"X-Team": "models", "X-Empty": ""}, RegistryHeaders()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestBool(t *testing.T) {
 	cases := map[string]bool{
 		"":      false,
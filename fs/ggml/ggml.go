@@ -22,6 +22,31 @@ type model interface {
 	Tensors() Tensors
 }
 
+// WithSplits returns f, the first split of a split model, with the tensors of
+// its other splits so that it describes the whole model. Tensor offsets are
+// relative to the data of the split holding each tensor.
+func (f *GGML) WithSplits(splits ...*GGML) *GGML {
+	ts := f.Tensors()
+	items := slices.Clone(ts.items)
+	for _, split := range splits {
+		items = append(items, split.Tensors().items...)
+	}
+
+	return &GGML{
+		container: f.container,
+		model:     splitModel{model: f.model, tensors: Tensors{items: items, Offset: ts.Offset}},
+	}
+}
+
+type splitModel struct {
+	model
+	tensors Tensors
+}
+
+func (m splitModel) Tensors() Tensors {
+	return m.tensors
+}
+
 type KV map[string]any
 
 func (kv KV) Architecture() string {
@@ -37,8 +62,9 @@ func (kv KV) ParameterCount() uint64 {
 }
 
 func (kv KV) FileType() fileType {
-	if t := kv.Uint("general.file_type"); t > 0 {
-		return fileType(t)
+	// F32 is 0 so check the key is set rather than for a non-zero value
+	if _, ok := kv["general.file_type"]; ok {
+		return fileType(kv.Uint("general.file_type"))
 	}
 
 	return fileTypeUnknown
@@ -352,6 +378,10 @@ const (
 
 var ErrUnsupportedFormat = errors.New("unsupported model format")
 
+// ErrUnsupportedVersion is returned by [Decode] for GGUF files of a version it
+// can't read.
+var ErrUnsupportedVersion = errors.New("unsupported GGUF version")
+
 func DetectContentType(b []byte) string {
 	switch binary.LittleEndian.Uint32(b[:4]) {
 	case FILE_MAGIC_GGML:
@@ -582,6 +612,52 @@ func (f GGML) GraphSize(context, batch uint64, kvCacheType string) (kv, partialO
 	return
 }
 
+// tensorFileTypes maps tensor kinds to the file type of a model quantized
+// to that kind. Kinds used by several file types, like Q4_K which is used by
+// both Q4_K_S and Q4_K_M, are left out.
+var tensorFileTypes = map[uint32]fileType{
+	0:  fileTypeF32,
+	1:  fileTypeF16,
+	2:  fileTypeQ4_0,
+	3:  fileTypeQ4_1,
+	6:  fileTypeQ5_0,
+	7:  fileTypeQ5_1,
+	8:  fileTypeQ8_0,
+	14: fileTypeQ6_K,
+	30: fileTypeBF16,
+}
+
+// FileType returns the file type, or quantization, of the model. Files
+// without general.file_type, written by some third party tools, are assumed
+// to have the file type of the kind used by most of their weights.
+func (llm GGML) FileType() fileType {
+	if ft := llm.KV().FileType(); ft != fileTypeUnknown {
+		return ft
+	}
+
+	elements := make(map[uint32]uint64)
+	for _, t := range llm.Tensors().Items() {
+		// 1D tensors, like norms, are kept in F32 regardless of file type
+		if len(t.Shape) > 1 {
+			elements[t.Kind] += t.parameters()
+		}
+	}
+
+	var kind uint32
+	var most uint64
+	for k, n := range elements {
+		if n > most || (n == most && k < kind) {
+			kind, most = k, n
+		}
+	}
+
+	if ft, ok := tensorFileTypes[kind]; ok && most > 0 {
+		return ft
+	}
+
+	return fileTypeUnknown
+}
+
 func (llm GGML) VisionGraphSize() (weights, graphSize uint64) {
 	if llm.KV().Uint("vision.block_count") == 0 {
 		return
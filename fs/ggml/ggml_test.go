@@ -1,6 +1,7 @@
 package ggml
 
 import (
+	"bytes"
 	"maps"
 	"slices"
 	"strconv"
@@ -210,3 +211,67 @@ func TestTensorTypes(t *testing.T) {
 		})
 	}
 }
+
+func TestFileType(t *testing.T) {
+	q8 := func(name string, shape ...uint64) Tensor {
+		tensor := Tensor{Name: name, Kind: 8, Shape: shape}
+		tensor.WriterTo = bytes.NewReader(make([]byte, tensor.Size()))
+		return tensor
+	}
+
+	f32 := func(name string, shape ...uint64) Tensor {
+		tensor := Tensor{Name: name, Kind: 0, Shape: shape}
+		tensor.WriterTo = bytes.NewReader(make([]byte, tensor.Size()))
+		return tensor
+	}
+
+	cases := []struct {
+		name    string
+		kv      KV
+		tensors []Tensor
+		want    string
+	}{
+		{"key", KV{"general.file_type": uint32(15)}, nil, "Q4_K_M"},
+		{"F32 key", KV{"general.file_type": uint32(0)}, nil, "F32"},
+		{"no key or tensors", KV{}, nil, "unknown"},
+		{
+			"weights",
+			KV{},
+			[]Tensor{q8("blk.0.attn_q.weight", 32, 4), q8("blk.0.attn_k.weight", 32, 4), f32("blk.0.attn_norm.weight", 512)},
+			"Q8_0",
+		},
+		{
+			"mixed",
+			KV{},
+			[]Tensor{q8("blk.0.attn_q.weight", 32, 4), f32("token_embd.weight", 32, 8)},
+			"F32",
+		},
+		{
+			"key preferred",
+			KV{"general.file_type": uint32(1)},
+			[]Tensor{q8("blk.0.attn_q.weight", 32, 4)},
+			"F16",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := KV{"general.architecture": "test"}
+			maps.Copy(kv, tt.kv)
+
+			var b bytes.Buffer
+			if err := WriteGGUF(&b, kv, tt.tensors); err != nil {
+				t.Fatal(err)
+			}
+
+			f, _, err := Decode(bytes.NewReader(b.Bytes()), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := f.FileType().String(); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -55,8 +55,10 @@ func (c *containerGGUF) Decode(rs io.ReadSeeker) (model, error) {
 		err = binary.Read(rs, c.ByteOrder, &c.V1)
 	case 2:
 		err = binary.Read(rs, c.ByteOrder, &c.V2)
-	default:
+	case 3:
 		err = binary.Read(rs, c.ByteOrder, &c.V3)
+	default:
+		return nil, fmt.Errorf("%w: GGUF version %d is not supported (supported: 1..3)", ErrUnsupportedVersion, c.Version)
 	}
 	if err != nil {
 		return nil, err
@@ -356,6 +358,8 @@ func writeGGUFString(w io.Writer, s string) error {
 }
 
 type array struct {
+	// typ is the GGUF type of the values, so they can be written again
+	typ    uint32
 	size   int
 	values []any
 }
@@ -375,7 +379,7 @@ func readGGUFV1Array(llm *gguf, r io.Reader) (*array, error) {
 		return nil, err
 	}
 
-	a := &array{size: int(n)}
+	a := &array{typ: t, size: int(n)}
 	if llm.canCollectArray(int(n)) {
 		a.values = make([]any, 0, int(n))
 	}
@@ -437,7 +441,7 @@ func readGGUFArray(llm *gguf, r io.Reader) (*array, error) {
 		return nil, err
 	}
 
-	a := &array{size: int(n)}
+	a := &array{typ: t, size: int(n)}
 	if llm.canCollectArray(int(n)) {
 		a.values = make([]any, int(n))
 	}
@@ -505,7 +509,13 @@ func writeGGUFArray[S ~[]E, E any](w io.Writer, t uint32, s S) error {
 	return binary.Write(w, binary.LittleEndian, s)
 }
 
-func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
+// WriteGGUF writes kv and ts to w in GGUF format. w does not need to be
+// seekable so the output can be streamed.
+//
+// Keys and tensors are written in a canonical order so the same model always
+// produces the same file, whatever the order of kv and ts.
+func WriteGGUF(w io.Writer, kv KV, ts []Tensor) error {
+	ws := &offsetWriter{Writer: w}
 	if err := binary.Write(ws, binary.LittleEndian, []byte("GGUF")); err != nil {
 		return err
 	}
@@ -531,18 +541,14 @@ func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
 		}
 	}
 
-	slices.SortStableFunc(ts, func(a, b Tensor) int {
-		if i, j := a.block(), b.block(); i < 0 && j > 0 {
-			return 1
-		} else if i > 0 && j < 0 {
-			return -1
-		} else {
-			return cmp.Compare(i, j)
-		}
-	})
+	sortTensors(ts)
+
+	var alignment int64 = 32
 
 	var s uint64
 	for _, t := range ts {
+		// tensor data is padded to the alignment
+		s += uint64(ggufPadding(int64(s), alignment))
 		t.Offset = s
 		if err := ggufWriteTensorInfo(ws, t); err != nil {
 			return err
@@ -550,9 +556,107 @@ func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
 		s += t.Size()
 	}
 
-	var alignment int64 = 32
+	tw, _ := w.(TensorWriter)
+	for i, t := range ts {
+		if err := binary.Write(ws, binary.LittleEndian, bytes.Repeat([]byte{0}, int(ggufPadding(ws.offset, alignment)))); err != nil {
+			return err
+		}
+
+		offset := ws.offset
+		if tw != nil {
+			if ok, err := tw.SkipTensor(i, offset, int64(t.Size())); err != nil {
+				return err
+			} else if ok {
+				ws.offset += int64(t.Size())
+				continue
+			}
+		}
+
+		if _, err := t.WriteTo(ws); err != nil {
+			return err
+		}
+
+		if tw != nil {
+			if err := tw.TensorWritten(i, offset, int64(t.Size())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// TensorWriter is implemented by writers that can resume an interrupted
+// [WriteGGUF]. Before the data of each tensor is written, SkipTensor is asked
+// whether the n bytes of the i-th tensor at offset are already written; if so
+// the tensor isn't written again. TensorWritten is called once they are.
+type TensorWriter interface {
+	io.Writer
+	SkipTensor(i int, offset, n int64) (bool, error)
+	TensorWritten(i int, offset, n int64) error
+}
+
+// sortTensors orders ts by block with tensors outside of blocks last. Tensors
+// in the same block are ordered by name.
+func sortTensors(ts []Tensor) {
+	slices.SortStableFunc(ts, func(a, b Tensor) int {
+		if i, j := a.block(), b.block(); i < 0 && j >= 0 {
+			return 1
+		} else if i >= 0 && j < 0 {
+			return -1
+		} else if c := cmp.Compare(i, j); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Name, b.Name)
+	})
+}
+
+// WriteGGUFSplit writes kv and ts as one or more GGUF files in the split
+// format used by llama.cpp's gguf-split. Tensors are written in the same order
+// as [WriteGGUF] and grouped so each split holds at most maxSize bytes of tensor
+// data. Tensors are never divided so a tensor larger than maxSize is written to
+// a split of its own. Only the first split holds kv.
+//
+// create is called for each split i of n to get its writer. A maxSize of 0
+// writes a single file.
+func WriteGGUFSplit(kv KV, ts []Tensor, maxSize uint64, create func(i, n int) (io.Writer, error)) error {
+	sortTensors(ts)
+
+	var splits [][]Tensor
+	var size uint64
 	for _, t := range ts {
-		if err := ggufWriteTensor(ws, t, alignment); err != nil {
+		if len(splits) == 0 || maxSize > 0 && size > 0 && size+t.Size() > maxSize {
+			splits = append(splits, nil)
+			size = 0
+		}
+
+		splits[len(splits)-1] = append(splits[len(splits)-1], t)
+		size += t.Size()
+	}
+
+	if len(splits) == 0 {
+		splits = append(splits, nil)
+	}
+
+	for i, split := range splits {
+		w, err := create(i, len(splits))
+		if err != nil {
+			return err
+		}
+
+		skv := KV{}
+		if i == 0 {
+			maps.Copy(skv, kv)
+		}
+
+		if len(splits) > 1 {
+			skv["split.no"] = uint16(i)
+			skv["split.count"] = uint16(len(splits))
+			skv["split.tensors.count"] = int32(len(ts))
+		}
+
+		if err := WriteGGUF(w, skv, split); err != nil {
 			return err
 		}
 	}
@@ -560,7 +664,7 @@ func WriteGGUF(ws io.WriteSeeker, kv KV, ts []Tensor) error {
 	return nil
 }
 
-func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
+func ggufWriteKV(ws io.Writer, k string, v any) error {
 	slog.Debug(k, "type", fmt.Sprintf("%T", v))
 	if err := binary.Write(ws, binary.LittleEndian, uint64(len(k))); err != nil {
 		return err
@@ -572,10 +676,26 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 
 	var err error
 	switch v := v.(type) {
+	case uint8:
+		err = writeGGUF(ws, ggufTypeUint8, v)
+	case int8:
+		err = writeGGUF(ws, ggufTypeInt8, v)
+	case uint16:
+		err = writeGGUF(ws, ggufTypeUint16, v)
+	case int16:
+		err = writeGGUF(ws, ggufTypeInt16, v)
+	case int32:
+		err = writeGGUF(ws, ggufTypeInt32, v)
 	case uint32:
 		err = writeGGUF(ws, ggufTypeUint32, v)
+	case uint64:
+		err = writeGGUF(ws, ggufTypeUint64, v)
+	case int64:
+		err = writeGGUF(ws, ggufTypeInt64, v)
 	case float32:
 		err = writeGGUF(ws, ggufTypeFloat32, v)
+	case float64:
+		err = writeGGUF(ws, ggufTypeFloat64, v)
 	case bool:
 		err = writeGGUF(ws, ggufTypeBool, v)
 	case string:
@@ -608,6 +728,8 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 				return err
 			}
 		}
+	case *array:
+		err = writeGGUFDecodedArray(ws, v)
 	default:
 		return fmt.Errorf("improper type for '%s'", k)
 	}
@@ -615,7 +737,44 @@ func ggufWriteKV(ws io.WriteSeeker, k string, v any) error {
 	return err
 }
 
-func ggufWriteTensorInfo(ws io.WriteSeeker, t Tensor) error {
+// writeGGUFDecodedArray writes an array read from a GGUF file, so that KV
+// from [Decode] can be written back with [WriteGGUF]. The array must have
+// been decoded in full.
+func writeGGUFDecodedArray(w io.Writer, a *array) error {
+	if len(a.values) != a.size {
+		return fmt.Errorf("array of %d values was only partially decoded", a.size)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ggufTypeArray); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, a.typ); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint64(a.size)); err != nil {
+		return err
+	}
+
+	for _, e := range a.values {
+		if s, ok := e.(string); ok {
+			if err := binary.Write(w, binary.LittleEndian, uint64(len(s))); err != nil {
+				return err
+			}
+
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		} else if err := binary.Write(w, binary.LittleEndian, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ggufWriteTensorInfo(ws io.Writer, t Tensor) error {
 	slog.Debug(t.Name, "kind", t.Kind, "shape", t.Shape, "offset", t.Offset)
 	if err := binary.Write(ws, binary.LittleEndian, uint64(len(t.Name))); err != nil {
 		return err
@@ -642,18 +801,16 @@ func ggufWriteTensorInfo(ws io.WriteSeeker, t Tensor) error {
 	return binary.Write(ws, binary.LittleEndian, t.Offset)
 }
 
-func ggufWriteTensor(ws io.WriteSeeker, t Tensor, alignment int64) error {
-	offset, err := ws.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-
-	if err := binary.Write(ws, binary.LittleEndian, bytes.Repeat([]byte{0}, int(ggufPadding(offset, alignment)))); err != nil {
-		return err
-	}
+// offsetWriter tracks the number of bytes written to the underlying writer
+type offsetWriter struct {
+	io.Writer
+	offset int64
+}
 
-	_, err = t.WriteTo(ws)
-	return err
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.offset += int64(n)
+	return n, err
 }
 
 func ggufPadding(offset, align int64) int64 {
@@ -0,0 +1,282 @@
+package ggml
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteGGUF(t *testing.T) {
+	// the writer is intentionally not seekable
+	var b bytes.Buffer
+	if err := WriteGGUF(struct{ io.Writer }{&b}, KV{
+		"general.architecture": "test",
+		"test.block_count":     uint32(1),
+	}, []Tensor{
+		{Name: "blk.0.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 32))},
+		{Name: "output.weight", Kind: 0, Shape: []uint64{16}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 64))},
+		// smaller than the alignment so following tensors are padded
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{4}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{3}, 16))},
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{4}, 32))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(b.Bytes())
+	f, _, err := Decode(r, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff("test", f.KV().Architecture()); diff != "" {
+		t.Errorf("unexpected architecture (-want +got):\n%s", diff)
+	}
+
+	tensors := f.Tensors()
+	for _, tensor := range tensors.Items() {
+		want := map[string][]byte{
+			"blk.0.attn_q.weight": bytes.Repeat([]byte{1}, 32),
+			"output.weight":       bytes.Repeat([]byte{2}, 64),
+			"output_norm.weight":  bytes.Repeat([]byte{3}, 16),
+			"token_embd.weight":   bytes.Repeat([]byte{4}, 32),
+		}[tensor.Name]
+
+		got := make([]byte, tensor.Size())
+		if _, err := r.ReadAt(got, int64(tensors.Offset+tensor.Offset)); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected %s data (-want +got):\n%s", tensor.Name, diff)
+		}
+	}
+}
+
+func TestWriteGGUFBlockOrder(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteGGUF(&b, KV{"general.architecture": "test"}, []Tensor{
+		{Name: "output.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		{Name: "blk.1.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		{Name: "blk.0.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := Decode(bytes.NewReader(b.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, tensor := range f.Tensors().Items() {
+		names = append(names, tensor.Name)
+	}
+
+	// block 0 is a block like any other and sorts before tensors outside of blocks
+	if diff := cmp.Diff([]string{"blk.0.attn_q.weight", "blk.1.attn_q.weight", "output.weight"}, names); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteGGUFSplit(t *testing.T) {
+	tensors := func() []Tensor {
+		return []Tensor{
+			{Name: "output.weight", Kind: 0, Shape: []uint64{16}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{3}, 64))},
+			{Name: "blk.1.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 32))},
+			{Name: "blk.0.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 32))},
+		}
+	}
+
+	write := func(t *testing.T, maxSize uint64) []*GGML {
+		t.Helper()
+
+		var bs []*bytes.Buffer
+		if err := WriteGGUFSplit(KV{"general.architecture": "test"}, tensors(), maxSize, func(i, n int) (io.Writer, error) {
+			if i != len(bs) {
+				t.Errorf("expected split %d, got %d", len(bs), i)
+			}
+
+			bs = append(bs, &bytes.Buffer{})
+			return bs[i], nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var fs []*GGML
+		for _, b := range bs {
+			f, _, err := Decode(bytes.NewReader(b.Bytes()), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fs = append(fs, f)
+		}
+
+		return fs
+	}
+
+	names := func(f *GGML) (names []string) {
+		for _, t := range f.Tensors().Items() {
+			names = append(names, t.Name)
+		}
+		return names
+	}
+
+	t.Run("single", func(t *testing.T) {
+		fs := write(t, 0)
+		if len(fs) != 1 {
+			t.Fatalf("expected 1 split, got %d", len(fs))
+		}
+
+		if _, ok := fs[0].KV()["split.count"]; ok {
+			t.Error("unexpected split metadata")
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		// both block tensors fit in 64 bytes but output.weight doesn't fit with them
+		fs := write(t, 64)
+		if len(fs) != 2 {
+			t.Fatalf("expected 2 splits, got %d", len(fs))
+		}
+
+		want := [][]string{
+			{"blk.0.attn_q.weight", "blk.1.attn_q.weight"},
+			{"output.weight"},
+		}
+
+		for i, f := range fs {
+			kv := f.KV()
+			if diff := cmp.Diff(want[i], names(f)); diff != "" {
+				t.Errorf("split %d tensors mismatch (-want +got):\n%s", i, diff)
+			}
+
+			if diff := cmp.Diff([]any{uint16(i), uint16(2), int32(3)}, []any{kv["split.no"], kv["split.count"], kv["split.tensors.count"]}); diff != "" {
+				t.Errorf("split %d metadata mismatch (-want +got):\n%s", i, diff)
+			}
+
+			if _, ok := kv["general.architecture"]; ok != (i == 0) {
+				t.Errorf("split %d has general.architecture: %v", i, ok)
+			}
+		}
+	})
+}
+
+func TestWriteGGUFOrder(t *testing.T) {
+	tensors := func() []Tensor {
+		return []Tensor{
+			{Name: "token_embd.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 32))},
+			{Name: "blk.0.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 32))},
+			{Name: "blk.0.attn_k.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{3}, 32))},
+			{Name: "blk.1.attn_q.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{4}, 32))},
+			{Name: "output.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{5}, 32))},
+		}
+	}
+
+	write := func(t *testing.T, ts []Tensor) []byte {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := WriteGGUF(&b, KV{"general.architecture": "test", "test.block_count": uint32(2)}, ts); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes()
+	}
+
+	want := write(t, tensors())
+
+	reversed := tensors()
+	slices.Reverse(reversed)
+	if !bytes.Equal(want, write(t, reversed)) {
+		t.Error("expected the same file regardless of tensor order")
+	}
+
+	f, _, err := Decode(bytes.NewReader(want), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, tensor := range f.Tensors().Items() {
+		names = append(names, tensor.Name)
+	}
+
+	if diff := cmp.Diff([]string{"blk.0.attn_k.weight", "blk.0.attn_q.weight", "blk.1.attn_q.weight", "output.weight", "token_embd.weight"}, names); diff != "" {
+		t.Errorf("unexpected order (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteGGUFDecoded(t *testing.T) {
+	kv := KV{
+		"general.architecture": "test",
+		"general.alignment":    uint32(32),
+		// set when decoding
+		"general.parameter_count": uint64(10),
+		"test.uint8":              uint8(1),
+		"test.int16":              int16(-2),
+		"test.uint64":             uint64(3),
+		"test.float64":            float64(4.5),
+		"test.bool":               true,
+		"test.strings":            []string{"a", "bb", ""},
+		"test.int32s":             []int32{1, -2, 3},
+		"test.float32s":           []float32{0.5, 1.5},
+		"test.empty":              []string{},
+	}
+
+	ts := []Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 3}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 24))},
+		{Name: "output.weight", Kind: 1, Shape: []uint64{4}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 8))},
+	}
+
+	var want bytes.Buffer
+	if err := WriteGGUF(&want, kv, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite := func(t *testing.T, maxArraySize int) ([]byte, error) {
+		t.Helper()
+
+		r := bytes.NewReader(want.Bytes())
+		f, _, err := Decode(r, maxArraySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded []Tensor
+		for _, tensor := range f.Tensors().Items() {
+			// decoded shapes are in the reverse order of those written
+			shape := slices.Clone(tensor.Shape)
+			slices.Reverse(shape)
+
+			decoded = append(decoded, Tensor{
+				Name:     tensor.Name,
+				Kind:     tensor.Kind,
+				Shape:    shape,
+				WriterTo: bufio.NewReader(io.NewSectionReader(r, int64(f.Tensors().Offset+tensor.Offset), int64(tensor.Size()))),
+			})
+		}
+
+		var b bytes.Buffer
+		err = WriteGGUF(&b, f.KV(), decoded)
+		return b.Bytes(), err
+	}
+
+	got, err := rewrite(t, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(want.Bytes(), got) {
+		t.Error("expected rewriting a decoded file to give the same file")
+	}
+
+	if _, err := rewrite(t, 2); err == nil || !strings.Contains(err.Error(), "partially decoded") {
+		t.Errorf("expected partially decoded error, got %v", err)
+	}
+}
@@ -21,6 +21,13 @@ package llama
 
 extern bool llamaProgressCallback(float progress, void *user_data);
 extern void llamaLog(int level, char* text, void* user_data);
+
+static void ggmlToFloat(enum ggml_type type, const void *x, float *y, int64_t k) {
+	// the first ggml_init fills the float16 conversion table used by to_float
+	struct ggml_init_params params = { 0, NULL, true };
+	ggml_free(ggml_init(params));
+	ggml_get_type_traits(type)->to_float(x, y, k);
+}
 */
 import "C"
 
@@ -492,6 +499,30 @@ func Quantize(infile, outfile string, ftype uint32) error {
 	return nil
 }
 
+// Dequantize converts n values of the GGML type kind in data to float32.
+func Dequantize(kind uint32, data []byte, n uint64) ([]float32, error) {
+	if kind >= C.GGML_TYPE_COUNT {
+		return nil, fmt.Errorf("unknown type %d", kind)
+	}
+
+	traits := C.ggml_get_type_traits(C.enum_ggml_type(kind))
+	if traits.to_float == nil || traits.blck_size <= 0 {
+		return nil, fmt.Errorf("can't dequantize type %s", C.GoString(traits.type_name))
+	}
+
+	blocks := n / uint64(traits.blck_size)
+	if n%uint64(traits.blck_size) != 0 || uint64(len(data)) != blocks*uint64(traits.type_size) {
+		return nil, fmt.Errorf("%d bytes don't hold %d values of type %s", len(data), n, C.GoString(traits.type_name))
+	}
+
+	out := make([]float32, n)
+	if n > 0 {
+		C.ggmlToFloat(C.enum_ggml_type(kind), unsafe.Pointer(&data[0]), (*C.float)(&out[0]), C.int64_t(n))
+	}
+
+	return out, nil
+}
+
 // vision processing
 type ClipContext struct {
 	c *C.struct_clip_ctx
@@ -103,3 +103,30 @@ func TestSchemaToGrammer(t *testing.T) {
 		})
 	}
 }
+
+func TestDequantize(t *testing.T) {
+	// a Q8_0 block is a float16 scale followed by 32 int8 values
+	block := []byte{0x00, 0x38} // 0.5
+	for i := range 32 {
+		block = append(block, byte(int8(i-16)))
+	}
+
+	got, err := Dequantize(8, block, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range got {
+		if want := float32(i-16) / 2; v != want {
+			t.Errorf("value %d: expected %v, got %v", i, want, v)
+		}
+	}
+
+	if _, err := Dequantize(8, block[:20], 32); err == nil {
+		t.Error("expected error for short data")
+	}
+
+	if _, err := Dequantize(1000, block, 32); err == nil {
+		t.Error("expected error for unknown type")
+	}
+}
@@ -0,0 +1,74 @@
+package llm
+
+import "slices"
+
+// architectures are the model architectures the runners can load. It follows
+// LLM_ARCH_NAMES in llama/llama.cpp/src/llama-arch.cpp.
+var architectures = []string{
+	"arctic",
+	"baichuan",
+	"bert",
+	"bitnet",
+	"bloom",
+	"chameleon",
+	"chatglm",
+	"codeshell",
+	"cohere2",
+	"command-r",
+	"dbrx",
+	"deci",
+	"deepseek",
+	"deepseek2",
+	"exaone",
+	"falcon",
+	"gemma",
+	"gemma2",
+	"gemma3",
+	"gpt2",
+	"gptj",
+	"gptneox",
+	"granite",
+	"granitemoe",
+	"grok",
+	"internlm2",
+	"jais",
+	"jina-bert-v2",
+	"llama",
+	"mamba",
+	"minicpm",
+	"minicpm3",
+	"mllama",
+	"mpt",
+	"nemotron",
+	"nomic-bert",
+	"olmo",
+	"olmo2",
+	"olmoe",
+	"openelm",
+	"orion",
+	"phi2",
+	"phi3",
+	"phimoe",
+	"plamo",
+	"qwen",
+	"qwen2",
+	"qwen2moe",
+	"qwen2vl",
+	"refact",
+	"rwkv6",
+	"rwkv6qwen2",
+	"solar",
+	"stablelm",
+	"starcoder",
+	"starcoder2",
+	"t5",
+	"t5encoder",
+	"wavtokenizer-dec",
+	"xverse",
+}
+
+// SupportsArchitecture reports whether models with architecture arch can be run.
+func SupportsArchitecture(arch string) bool {
+	_, ok := slices.BinarySearch(architectures, arch)
+	return ok
+}
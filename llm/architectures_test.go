@@ -0,0 +1,22 @@
+package llm
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSupportsArchitecture(t *testing.T) {
+	if !slices.IsSorted(architectures) {
+		t.Fatal("architectures must be sorted")
+	}
+
+	for _, arch := range []string{"llama", "gemma3", "command-r"} {
+		if !SupportsArchitecture(arch) {
+			t.Errorf("expected %s to be supported", arch)
+		}
+	}
+
+	if SupportsArchitecture("unknown") {
+		t.Error("expected unknown to be unsupported")
+	}
+}
@@ -91,8 +91,34 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 	}
 	defer f.Close()
 
-	ggml, _, err := ggml.Decode(f, maxArraySize)
-	return ggml, err
+	g, _, err := ggml.Decode(f, maxArraySize)
+	if err != nil {
+		return nil, err
+	}
+
+	// the other splits of a split model are found by their names, as
+	// llama.cpp does
+	kv := g.KV()
+	if n, _ := kv["split.count"].(uint16); n > 1 && kv["split.no"] == uint16(0) {
+		prefix, ok := strings.CutSuffix(model, fmt.Sprintf("-%05d-of-%05d.gguf", 1, n))
+		if !ok {
+			return nil, fmt.Errorf("%s: split model file name doesn't name the first of %d splits", model, n)
+		}
+
+		splits := make([]*ggml.GGML, 0, n-1)
+		for i := 2; i <= int(n); i++ {
+			split, err := LoadModel(fmt.Sprintf("%s-%05d-of-%05d.gguf", prefix, i, n), maxArraySize)
+			if err != nil {
+				return nil, err
+			}
+
+			splits = append(splits, split)
+		}
+
+		return g.WithSplits(splits...), nil
+	}
+
+	return g, nil
 }
 
 // NewLlamaServer will run a server for the given GPUs
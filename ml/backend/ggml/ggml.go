@@ -69,7 +69,7 @@ func New(ctx context.Context, r *os.File, params ml.BackendParams) (ml.Backend,
 	slog.Info(
 		"",
 		"architecture", meta.KV().Architecture(),
-		"file_type", meta.KV().FileType(),
+		"file_type", meta.FileType(),
 		"name", meta.KV().String("general.name"),
 		"description", meta.KV().String("general.description"),
 		"num_tensors", len(meta.Tensors().Items()),
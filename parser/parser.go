@@ -58,6 +58,17 @@ func (f Modelfile) CreateRequest(relativeDir string) (*api.CreateRequest, error)
 			if errors.Is(err, os.ErrNotExist) {
 				req.From = c.Args
 				continue
+			} else if errors.Is(err, ErrModelNotFound) {
+				// a directory with only a tokenizer updates the tokenizer of
+				// the model in another FROM
+				tokenizer, terr := tokenizerDigestMap(path)
+				if terr != nil {
+					return nil, terr
+				} else if tokenizer == nil {
+					return nil, err
+				}
+
+				digestMap = tokenizer
 			} else if err != nil {
 				return nil, err
 			}
@@ -141,7 +152,7 @@ func fileDigestMap(path string) (map[string]string, error) {
 			return nil, err
 		}
 	} else {
-		files = []string{path}
+		files = append([]string{path}, tensorDataFiles(path)...)
 	}
 
 	for _, f := range files {
@@ -155,6 +166,43 @@ func fileDigestMap(path string) (map[string]string, error) {
 	return fl, nil
 }
 
+// tokenizerFiles are the files of a tokenizer without model weights.
+var tokenizerFiles = []string{
+	"tokenizer.json",
+	"tokenizer.model",
+	"tokenizer_config.json",
+	"special_tokens_map.json",
+	"added_tokens.json",
+	"chat_template.jinja",
+	"chat_template.json",
+}
+
+// tokenizerDigestMap returns the digests of the tokenizer files in the
+// directory path, or nil if it has neither tokenizer.json nor tokenizer.model.
+func tokenizerDigestMap(path string) (map[string]string, error) {
+	fl := make(map[string]string)
+	for _, name := range tokenizerFiles {
+		f := filepath.Join(path, name)
+		if fi, err := os.Stat(f); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		digest, err := digestForFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fl[f] = digest
+	}
+
+	_, hasJSON := fl[filepath.Join(path, "tokenizer.json")]
+	_, hasModel := fl[filepath.Join(path, "tokenizer.model")]
+	if !hasJSON && !hasModel {
+		return nil, nil
+	}
+
+	return fl, nil
+}
+
 func digestForFile(filename string) (string, error) {
 	filepath, err := filepath.EvalSymlinks(filename)
 	if err != nil {
@@ -232,11 +280,20 @@ func filesForModel(path string) ([]string, error) {
 	} else if gg, _ := glob(filepath.Join(path, "*.gguf"), "application/octet-stream"); len(gg) > 0 {
 		// covers gguf files ending in .gguf
 		files = append(files, gg...)
+		files = append(files, tensorDataFiles(gg...)...)
+	} else if ox, _ := glob(filepath.Join(path, "model.onnx"), "application/octet-stream"); len(ox) > 0 {
+		// covers onnx models and their external data
+		files = append(files, ox...)
+		files = append(files, onnxDataFiles(ox...)...)
+	} else if ox, _ := glob(filepath.Join(path, "decoder_model.onnx"), "application/octet-stream"); len(ox) > 0 {
+		// covers decoder-only onnx models exported by optimum
+		files = append(files, ox...)
+		files = append(files, onnxDataFiles(ox...)...)
 	} else if gg, _ := glob(filepath.Join(path, "*.bin"), "application/octet-stream"); len(gg) > 0 {
 		// covers gguf files ending in .bin
 		files = append(files, gg...)
 	} else {
-		return nil, ErrModelNotFound
+		return nil, modelNotFound(path)
 	}
 
 	// add configuration files, json files are detected as text/plain
@@ -263,9 +320,119 @@ func filesForModel(path string) ([]string, error) {
 		files = append(files, tks...)
 	}
 
+	// chat templates may be in their own file rather than in tokenizer_config.json
+	if tpl, _ := glob(filepath.Join(path, "chat_template.jinja"), "text/plain"); len(tpl) > 0 {
+		files = append(files, tpl...)
+	}
+
 	return files, nil
 }
 
+// tensorDataFiles returns the files next to the GGUF files ggufs that hold
+// their tensor data, for tools that write it separately from the metadata.
+func tensorDataFiles(ggufs ...string) []string {
+	var files []string
+	for _, gguf := range ggufs {
+		for _, name := range []string{gguf + ".data", strings.TrimSuffix(gguf, ".gguf") + ".data"} {
+			if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+				files = append(files, name)
+				break
+			}
+		}
+	}
+
+	return files
+}
+
+// onnxDataFiles returns the files next to the ONNX models onnxs that hold
+// their external tensor data.
+func onnxDataFiles(onnxs ...string) []string {
+	var files []string
+	for _, onnx := range onnxs {
+		for _, name := range []string{onnx + "_data", onnx + ".data"} {
+			if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+				files = append(files, name)
+			}
+		}
+	}
+
+	return files
+}
+
+// modelWeights are the patterns of weight files that filesForModel looks for.
+var modelWeights = []string{
+	"model*.safetensors",
+	"adapters.safetensors",
+	"adapter_model.safetensors",
+	"pytorch_model*.bin",
+	"consolidated*.pth",
+	"*.gguf",
+	"model.onnx",
+	"decoder_model.onnx",
+}
+
+// modelNotFound returns an error wrapping ErrModelNotFound that describes
+// what path contains and, if one of its subdirectories up to two levels down
+// has model weights, suggests using that instead.
+func modelNotFound(path string) error {
+	if dir := findModelDir(path, 2); dir != "" {
+		return fmt.Errorf("%w in %s, but %s has model files; did you mean that directory?", ErrModelNotFound, path, dir)
+	}
+
+	var found []string
+	for _, pattern := range []string{"*.json", "*.safetensors", "*.bin", "*.pth", "*.gguf", "*.onnx"} {
+		matches, _ := filepath.Glob(filepath.Join(path, pattern))
+		for _, match := range matches {
+			found = append(found, filepath.Base(match))
+		}
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("%w in %s", ErrModelNotFound, path)
+	}
+
+	const limit = 5
+	if len(found) > limit {
+		found = append(found[:limit], fmt.Sprintf("and %d more", len(found)-limit))
+	}
+
+	return fmt.Errorf("%w in %s: found %s but no model weights", ErrModelNotFound, path, strings.Join(found, ", "))
+}
+
+// findModelDir returns the first directory below path, searching breadth
+// first up to depth levels, with files matching modelWeights.
+func findModelDir(path string, depth int) string {
+	dirs := []string{path}
+	for range depth {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+
+				sub := filepath.Join(dir, entry.Name())
+				for _, pattern := range modelWeights {
+					if matches, _ := filepath.Glob(filepath.Join(sub, pattern)); len(matches) > 0 {
+						return sub
+					}
+				}
+
+				next = append(next, sub)
+			}
+		}
+
+		dirs = next
+	}
+
+	return ""
+}
+
 type Command struct {
 	Name string
 	Args string
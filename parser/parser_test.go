@@ -7,7 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"unicode/utf16"
@@ -830,3 +833,167 @@ func TestCreateRequestFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateRequestTokenizer(t *testing.T) {
+	p := t.TempDir()
+	for _, name := range []string{"tokenizer.json", "tokenizer_config.json", "chat_template.jinja"} {
+		if err := os.WriteFile(filepath.Join(p, name), []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	digest, err := digestForFile(filepath.Join(p, "tokenizer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ParseFile(strings.NewReader(fmt.Sprintf("FROM llama3.2\nFROM %s", p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := f.CreateRequest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &api.CreateRequest{
+		From: "llama3.2",
+		Files: map[string]string{
+			filepath.Join(p, "tokenizer.json"):        digest,
+			filepath.Join(p, "tokenizer_config.json"): digest,
+			filepath.Join(p, "chat_template.jinja"):   digest,
+		},
+	}
+
+	if diff := cmp.Diff(want, req); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// without a tokenizer the directory still isn't a model
+	empty := t.TempDir()
+	f, err = ParseFile(strings.NewReader(fmt.Sprintf("FROM llama3.2\nFROM %s", empty)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.CreateRequest(""); !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("expected %v, got %v", ErrModelNotFound, err)
+	}
+}
+
+func TestFilesForModelNotFound(t *testing.T) {
+	write := func(t *testing.T, name string) {
+		t.Helper()
+
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(name, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("nested", func(t *testing.T) {
+		p := t.TempDir()
+		write(t, filepath.Join(p, "models", "llama", "model.safetensors"))
+
+		_, err := filesForModel(p)
+		if !errors.Is(err, ErrModelNotFound) {
+			t.Fatalf("expected %v, got %v", ErrModelNotFound, err)
+		}
+
+		if !strings.Contains(err.Error(), filepath.Join(p, "models", "llama")) {
+			t.Errorf("expected nested model directory in error, got %v", err)
+		}
+	})
+
+	t.Run("no weights", func(t *testing.T) {
+		p := t.TempDir()
+		write(t, filepath.Join(p, "config.json"))
+
+		_, err := filesForModel(p)
+		if !errors.Is(err, ErrModelNotFound) || !strings.Contains(err.Error(), "found config.json but no model weights") {
+			t.Errorf("expected found files in error, got %v", err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if _, err := filesForModel(t.TempDir()); !errors.Is(err, ErrModelNotFound) {
+			t.Errorf("expected %v, got %v", ErrModelNotFound, err)
+		}
+	})
+}
+
+func TestFileDigestMapTensorData(t *testing.T) {
+	for _, data := range []string{"model.gguf.data", "model.data"} {
+		t.Run(data, func(t *testing.T) {
+			p := t.TempDir()
+			for _, name := range []string{"model.gguf", data} {
+				if err := os.WriteFile(filepath.Join(p, name), []byte("GGUF\x03\x00\x00\x00"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := []string{filepath.Join(p, "model.gguf"), filepath.Join(p, data)}
+			slices.Sort(want)
+			for _, path := range []string{filepath.Join(p, "model.gguf"), p} {
+				files, err := fileDigestMap(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := slices.Sorted(maps.Keys(files)); !slices.Equal(want, got) {
+					t.Errorf("%s: expected %v, got %v", path, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesForModelChatTemplate(t *testing.T) {
+	p := t.TempDir()
+	for name, data := range map[string][]byte{
+		"model.safetensors":   make([]byte, 16),
+		"config.json":         []byte(`{}`),
+		"chat_template.jinja": []byte(`{% for message in messages %}{{ message.content }}{% endfor %}`),
+	} {
+		if err := os.WriteFile(filepath.Join(p, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filesForModel(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(files, filepath.Join(p, "chat_template.jinja")) {
+		t.Errorf("expected chat_template.jinja in %v", files)
+	}
+}
+
+func TestFilesForModelONNX(t *testing.T) {
+	p := t.TempDir()
+	for name, data := range map[string][]byte{
+		"model.onnx":      {0x08, 0x08},
+		"model.onnx_data": make([]byte, 16),
+		"config.json":     []byte(`{}`),
+	} {
+		if err := os.WriteFile(filepath.Join(p, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filesForModel(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"model.onnx", "model.onnx_data", "config.json"} {
+		if !slices.Contains(files, filepath.Join(p, name)) {
+			t.Errorf("expected %s in %v", name, files)
+		}
+	}
+}
@@ -1,20 +1,26 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -24,9 +30,11 @@ import (
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/types/errtypes"
 	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
 )
 
 var (
@@ -36,8 +44,55 @@ var (
 	errUnknownType             = errors.New("unknown type")
 	errNeitherFromOrFiles      = errors.New("neither 'from' or 'files' was specified")
 	errFilePath                = errors.New("file path must be relative")
+	errInsufficientSpace       = errors.New("insufficient disk space")
+	errDecompressedTooLarge    = errors.New("decompressed file is too large")
+	errIncompatibleProjector   = errors.New("projector is incompatible with model")
+	errTooManyFiles            = errors.New("too many files")
+	errNoTokenizerModel        = errors.New("tokenizer files require a model in 'from' to update")
+	errAdapterWithoutBase      = errors.New("files contain an adapter, which requires a base model in 'from'")
+	errSplitQuantize           = errors.New("quantization is not supported for split models")
 )
 
+// Errors wrapped by the functions that parse model files. The wrapping error
+// carries the detail.
+var (
+	ErrUnsupportedContentType  = errors.New("unsupported content type")
+	ErrCorruptGGUF             = errors.New("corrupt GGUF file")
+	ErrUnsupportedArchitecture = convert.ErrUnsupportedArchitecture
+	ErrUnsupportedGGUFVersion  = ggml.ErrUnsupportedVersion
+)
+
+// errorCode returns a stable code for err that clients can use to tell
+// failures apart, or an empty string if there is none.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrUnsupportedContentType):
+		return "unsupported_content_type"
+	case errors.Is(err, ErrCorruptGGUF):
+		return "corrupt_gguf"
+	case errors.Is(err, ErrUnsupportedArchitecture):
+		return "unsupported_architecture"
+	case errors.Is(err, ErrUnsupportedGGUFVersion):
+		return "unsupported_gguf_version"
+	default:
+		return ""
+	}
+}
+
+// createError returns the streamed response for an error creating a model.
+func createError(err error, status int) gin.H {
+	h := gin.H{"error": err.Error()}
+	if status != 0 {
+		h["status"] = status
+	}
+
+	if code := errorCode(err); code != "" {
+		h["code"] = code
+	}
+
+	return h
+}
+
 func (s *Server) CreateHandler(c *gin.Context) {
 	var r api.CreateRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
@@ -55,6 +110,31 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		}
 	}
 
+	if n, limit := len(r.Files)+len(r.Adapters), envconfig.MaxModelFiles(); uint(n) > limit {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: %d exceeds the limit of %d, set OLLAMA_MAX_MODEL_FILES to raise it", errTooManyFiles, n, limit)})
+		return
+	}
+
+	if r.From == "" && isTokenizerFiles(r.Files) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errNoTokenizerModel.Error()})
+		return
+	}
+
+	if r.SplitSize > 0 && cmp.Or(r.Quantize, r.Quantization) != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errSplitQuantize.Error()})
+		return
+	}
+
+	// safetensors LoRA adapters are commonly imported as the model files
+	if r.Adapters == nil && isAdapterFiles(r.Files) {
+		if r.From == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errAdapterWithoutBase.Error()})
+			return
+		}
+
+		r.Adapters, r.Files = r.Files, nil
+	}
+
 	name := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !name.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
@@ -85,23 +165,63 @@ func (s *Server) CreateHandler(c *gin.Context) {
 				return
 			}
 
-			ctx, cancel := context.WithCancel(c.Request.Context())
+			// a base model that isn't available locally is pulled with the
+			// configured mirrors and headers
+			ctx, cancel := context.WithCancel(withRegistryOptions(c.Request.Context(), newRegistryOptions(false)))
 			defer cancel()
 
 			baseLayers, err = parseFromModel(ctx, fromName, fn)
 			if err != nil {
 				ch <- gin.H{"error": err.Error()}
+				return
+			}
+
+			if isTokenizerFiles(r.Files) {
+				files, err := fetchFiles(c.Request.Context(), r.Files, fn)
+				if err != nil {
+					ch <- createError(err, fetchStatus(err))
+					return
+				}
+
+				baseLayers, err = updateTokenizer(baseLayers, files, r.NoTemplate, fn)
+				if err != nil {
+					ch <- createError(err, http.StatusBadRequest)
+					return
+				}
 			}
 		} else if r.Files != nil {
-			baseLayers, err = convertModelFromFiles(r.Files, baseLayers, false, fn)
+			files, err := fetchFiles(c.Request.Context(), r.Files, fn)
+			if err != nil {
+				ch <- createError(err, fetchStatus(err))
+				return
+			}
+
+			baseLayers, err = convertModelFromFiles(files, baseLayers, false, r.NoTemplate, r.SplitSize, func(layers []*layerGGML) ([]*layerGGML, error) {
+				if r.Template != "" {
+					// drop the autodetected template and its parameters in favor of the
+					// template in the request
+					layers = stripLayers(layers, "application/vnd.ollama.image.template", "application/vnd.ollama.image.params")
+				}
+
+				layer, err := generationParams(files)
+				if err != nil {
+					return nil, err
+				}
+
+				if layer != nil {
+					layers = append(layers, layer)
+				}
+
+				return layers, nil
+			}, fn)
 			if err != nil {
-				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType} {
+				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType, errDecompressedTooLarge, ErrUnsupportedContentType, ErrCorruptGGUF, ErrUnsupportedArchitecture, ErrUnsupportedGGUFVersion} {
 					if errors.Is(err, badReq) {
-						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+						ch <- createError(err, http.StatusBadRequest)
 						return
 					}
 				}
-				ch <- gin.H{"error": err.Error()}
+				ch <- createError(err, 0)
 				return
 			}
 		} else {
@@ -111,25 +231,32 @@ func (s *Server) CreateHandler(c *gin.Context) {
 
 		var adapterLayers []*layerGGML
 		if r.Adapters != nil {
-			adapterLayers, err = convertModelFromFiles(r.Adapters, baseLayers, true, fn)
+			adapters, err := fetchFiles(c.Request.Context(), r.Adapters, fn)
 			if err != nil {
-				for _, badReq := range []error{errNoFilesProvided, errOnlyOneAdapterSupported, errOnlyGGUFSupported, errUnknownType, errFilePath} {
-					if errors.Is(err, badReq) {
-						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
-						return
-					}
-				}
-				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+				ch <- createError(err, fetchStatus(err))
+				return
+			}
+
+			adapterLayers, err = convertModelFromFiles(adapters, baseLayers, true, r.NoTemplate, 0, nil, fn)
+			if err != nil {
+				ch <- createError(err, http.StatusBadRequest)
 				return
 			}
 		}
 
 		if len(adapterLayers) > 0 {
+			// adapters created from a model record it as their base
+			for _, layer := range adapterLayers {
+				if isGGMLMediaType(layer.MediaType) {
+					layer.Base = model.ParseName(r.From).String()
+				}
+			}
+
 			baseLayers = append(baseLayers, adapterLayers...)
 		}
 
 		if err := createModel(r, name, baseLayers, fn); err != nil {
-			if errors.Is(err, errBadTemplate) {
+			if errors.Is(err, errBadTemplate) || errors.Is(err, errIncompatibleProjector) || errors.Is(err, errSplitQuantize) {
 				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
 				return
 			}
@@ -154,44 +281,215 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
-func convertModelFromFiles(files map[string]string, baseLayers []*layerGGML, isAdapter bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+// layerProcessor transforms the layers parsed from model files, after
+// template detection, before they're used to create the model. Returning an
+// error aborts the import.
+type layerProcessor func([]*layerGGML) ([]*layerGGML, error)
+
+// convertModelFromFiles parses the model or, if isAdapter is true, the
+// adapter in files. Chat templates found in the files are attached as
+// template layers unless noTemplate is true. Models converted from
+// safetensors or ONNX are split by splitSize, see [convertFromSafetensors].
+func convertModelFromFiles(files map[string]string, baseLayers []*layerGGML, isAdapter, noTemplate bool, splitSize uint64, process layerProcessor, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+	var layers []*layerGGML
 	switch detectModelTypeFromFiles(files) {
-	case "safetensors":
-		layers, err := convertFromSafetensors(files, baseLayers, isAdapter, fn)
+	case "safetensors", "onnx":
+		var err error
+		layers, err = convertFromSafetensors(files, baseLayers, isAdapter, noTemplate, splitSize, fn)
 		if err != nil {
 			slog.Error("error converting from safetensors", "error", err)
 			return nil, err
 		}
-		return layers, nil
 	case "gguf":
+		files, err := joinTensorData(files, fn)
+		if err != nil {
+			return nil, err
+		}
+
 		if len(files) == 0 {
 			return nil, errNoFilesProvided
 		} else if len(files) > 1 && isAdapter {
 			return nil, errOnlyOneAdapterSupported
 		}
 
-		var digest string
-		var allLayers []*layerGGML
-		for _, v := range files {
-			digest = v
-			layers, err := ggufLayers(digest, fn)
+		for _, digest := range files {
+			ls, err := ggufLayers(digest, noTemplate, fn)
 			if err != nil {
 				return nil, err
 			}
-			allLayers = append(allLayers, layers...)
+			layers = append(layers, ls...)
 		}
-		return allLayers, nil
 	default:
 		return nil, errUnknownType
 	}
+
+	if process != nil {
+		return process(layers)
+	}
+
+	return layers, nil
+}
+
+// isAdapterFiles reports whether files are a safetensors LoRA adapter, which
+// is described by an adapter_config.json, rather than a model.
+func isAdapterFiles(files map[string]string) bool {
+	_, ok := files["adapter_config.json"]
+	return ok
+}
+
+// tokenizerFiles are the files, besides weights and config.json, that
+// describe a model's tokenizer and chat template.
+var tokenizerFiles = []string{
+	"tokenizer.json",
+	"tokenizer.model",
+	"tokenizer_config.json",
+	"special_tokens_map.json",
+	"added_tokens.json",
+	"chat_template.jinja",
+	"chat_template.json",
+}
+
+// isTokenizerFiles reports whether files are only a tokenizer, with no
+// weights, so they update the tokenizer of an existing model.
+func isTokenizerFiles(files map[string]string) bool {
+	_, hasJSON := files["tokenizer.json"]
+	_, hasModel := files["tokenizer.model"]
+	if !hasJSON && !hasModel {
+		return false
+	}
+
+	for name := range files {
+		if !slices.Contains(tokenizerFiles, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// blobsFS is an [fs.FS] of the blobs in a map of file names to digests.
+type blobsFS map[string]string
+
+func (b blobsFS) Open(name string) (fs.File, error) {
+	digest, ok := b[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+// updateTokenizer replaces the tokenizer of the model layer in layers with
+// the tokenizer in files. The model's tensors are copied unchanged, so this
+// is much faster than converting the model again. Unless noTemplate is true,
+// a chat template detected from the new tokenizer replaces the model's
+// template.
+func updateTokenizer(layers []*layerGGML, files map[string]string, noTemplate bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+	i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+		return l.GGML != nil && l.MediaType == "application/vnd.ollama.image.model"
+	})
+	if i < 0 {
+		return nil, errNoTokenizerModel
+	}
+
+	p, err := GetBlobsPath(layers[i].Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	// decode again without limiting array sizes so all of the metadata can
+	// be written back
+	f, _, err := ggml.Decode(blob, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := f.KV()
+	tokenizer, err := convert.ConvertTokenizer(blobsFS(files), kv.Architecture(), len(kv.Strings("tokenizer.ggml.tokens")))
+	if err != nil {
+		return nil, err
+	}
+
+	maps.DeleteFunc(kv, func(k string, _ any) bool {
+		return strings.HasPrefix(k, "tokenizer.")
+	})
+	maps.Copy(kv, tokenizer)
+
+	ts := copyTensors(blob, f.Tensors())
+
+	status := "updating tokenizer"
+	fn(api.ProgressResponse{Status: status})
+	layer, err := newLayerFromConverter(func(w io.Writer) error {
+		return ggml.WriteGGUF(w, kv, ts)
+	}, layers[i].MediaType, conversionKey(files, layers[i:i+1], layers[i].MediaType))
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := layer.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bin.Close()
+
+	g, _, err := ggml.Decode(bin, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	layers = slices.Clone(layers)
+	layers[i] = &layerGGML{layer, g}
+	if noTemplate {
+		return layers, nil
+	}
+
+	detected, err := detectChatTemplate([]*layerGGML{layers[i]})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(detected) > 1 {
+		detected = detected[1:]
+		if j := slices.IndexFunc(detected, func(l *layerGGML) bool {
+			return l.MediaType == "application/vnd.ollama.image.params"
+		}); j >= 0 {
+			// parameters set on the base model are kept over those of the
+			// detected template
+			params, err := mergeParams(detected[j], layers)
+			if err != nil {
+				return nil, err
+			}
+
+			layers = stripLayers(layers, "application/vnd.ollama.image.params")
+			detected[j] = params
+		}
+
+		layers = stripLayers(layers, "application/vnd.ollama.image.template")
+		layers = append(layers, detected...)
+	}
+
+	return layers, nil
 }
 
 func detectModelTypeFromFiles(files map[string]string) string {
 	for fn := range files {
 		if strings.HasSuffix(fn, ".safetensors") {
 			return "safetensors"
-		} else if strings.HasSuffix(fn, ".gguf") {
+		} else if strings.HasSuffix(fn, ".gguf") || strings.HasSuffix(fn, ".gguf.gz") {
 			return "gguf"
+		} else if strings.HasSuffix(fn, ".onnx") {
+			return "onnx"
 		} else {
 			// try to see if we can find a gguf file even without the file extension
 			blobPath, err := GetBlobsPath(files[fn])
@@ -205,10 +503,9 @@ func detectModelTypeFromFiles(files map[string]string) string {
 				slog.Error("error reading file", "error", err)
 				return ""
 			}
-			defer f.Close()
-
 			buf := make([]byte, 4)
 			_, err = f.Read(buf)
+			f.Close()
 			if err != nil {
 				slog.Error("error reading file", "error", err)
 				return ""
@@ -224,12 +521,83 @@ func detectModelTypeFromFiles(files map[string]string) string {
 	return ""
 }
 
-func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, isAdapter bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
-	tmpDir, err := os.MkdirTemp("", "ollama-safetensors")
+// convertFromSafetensors converts the model or, if isAdapter is true, the
+// adapter in files. A model larger than a non-zero splitSize is split into
+// multiple model layers of at most splitSize bytes of tensor data each.
+func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, isAdapter, noTemplate bool, splitSize uint64, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+	var size uint64
+	for _, digest := range files {
+		blobPath, err := GetBlobsPath(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := os.Stat(blobPath)
+		if err != nil {
+			return nil, err
+		}
+
+		size += uint64(fi.Size())
+	}
+
+	// the converted model is streamed into the blobs directory and is at most
+	// as large as its inputs
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFreeSpace(blobs, size); err != nil {
+		return nil, err
+	}
+
+	// the files are unpacked into the temporary directory, where they're
+	// copied if they can't be linked
+	if tmp := envconfig.TmpDir(); !sameDevice(blobs, tmp) {
+		if err := checkFreeSpace(tmp, size); err != nil {
+			return nil, err
+		}
+	}
+
+	pruneUnpacked()
+
+	// the files are unpacked into a directory named by its contents and left
+	// behind if conversion fails so that retrying soon after doesn't copy them
+	// again. Conversions of the same files take its lock file so they don't
+	// remove it while another is using it.
+	tmpDir := filepath.Join(envconfig.TmpDir(), "ollama-safetensors-"+conversionKey(files, nil, ""))
+	unlock, err := lockFile(context.Background(), tmpDir+".lock")
 	if err != nil {
 		return nil, err
 	}
-	defer os.RemoveAll(tmpDir)
+	defer unlock()
+
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// reusing the directory restarts its expiry
+	now := time.Now()
+	if err := os.Chtimes(tmpDir, now, now); err != nil {
+		return nil, err
+	}
+
+	var converted bool
+	defer func() {
+		if !converted {
+			slog.Info("keeping unpacked model files for retrying", "path", tmpDir, "expires", now.Add(unpackedExpiry))
+			return
+		}
+
+		if err := os.RemoveAll(tmpDir); err != nil {
+			slog.Warn("couldn't remove temporary directory", "path", tmpDir, "error", err)
+		}
+	}()
+
+	if err := removeUnexpected(tmpDir, files); err != nil {
+		return nil, err
+	}
+
 	// Set up a root to validate paths
 	root, err := os.OpenRoot(tmpDir)
 	if err != nil {
@@ -237,11 +605,14 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 	}
 	defer root.Close()
 
+	var unpacked int64
 	for fp, digest := range files {
 		if !fs.ValidPath(fp) {
 			return nil, fmt.Errorf("%w: %s", errFilePath, fp)
 		}
-		if _, err := root.Stat(fp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// files kept from an earlier attempt are links to blobs outside the
+		// root, so they're checked without following them
+		if _, err := root.Lstat(fp); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			// Path is likely outside the root
 			return nil, fmt.Errorf("%w: %s: %s", errFilePath, err, fp)
 		}
@@ -250,61 +621,556 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 		if err != nil {
 			return nil, err
 		}
-		if err := createLink(blobPath, filepath.Join(tmpDir, fp)); err != nil {
+		if ok, err := isUnpacked(filepath.Join(tmpDir, fp), digest); err != nil {
 			return nil, err
+		} else if !ok {
+			if err := createLink(blobPath, filepath.Join(tmpDir, fp)); err != nil {
+				return nil, err
+			}
 		}
+
+		fi, err := os.Stat(blobPath)
+		if err != nil {
+			return nil, err
+		}
+
+		unpacked += fi.Size()
+		fn(api.ProgressResponse{Status: "unpacking model metadata", Total: int64(size), Completed: unpacked})
 	}
 
-	t, err := os.CreateTemp(tmpDir, "fp16")
-	if err != nil {
-		return nil, err
+	if envconfig.TensorStats() {
+		if err := reportTensorStats(os.DirFS(tmpDir), fn); err != nil {
+			return nil, err
+		}
 	}
-	defer t.Close()
 
-	var mediaType string
+	// the converted model records which files it was converted from
+	fsys := convert.WithSourceDigest(os.DirFS(tmpDir), "sha256:"+conversionKey(files, nil, ""))
+
+	var status, mediaType string
+	var convertFn func(io.Writer) error
 	if !isAdapter {
-		fn(api.ProgressResponse{Status: "converting model"})
+		status = "converting model"
 		mediaType = "application/vnd.ollama.image.model"
-		if err := convert.ConvertModel(os.DirFS(tmpDir), t); err != nil {
-			return nil, err
+		convertFn = func(w io.Writer) error {
+			return convert.ConvertModel(fsys, w)
 		}
 	} else {
 		kv, err := kvFromLayers(baseLayers)
 		if err != nil {
 			return nil, err
 		}
-		fn(api.ProgressResponse{Status: "converting adapter"})
+		status = "converting adapter"
 		mediaType = "application/vnd.ollama.image.adapter"
-		if err := convert.ConvertAdapter(os.DirFS(tmpDir), t, kv); err != nil {
+		convertFn = func(w io.Writer) error {
+			return convert.ConvertAdapter(fsys, w, kv)
+		}
+	}
+
+	// the converted size isn't known until conversion finishes so progress is
+	// estimated from the size of the inputs
+	fn(api.ProgressResponse{Status: status, Total: int64(size)})
+	key := conversionKey(files, baseLayers, mediaType)
+	w := &convertProgressWriter{status: status, total: int64(size), fn: fn}
+	outputs, err := newLayersFromConverter(func(create func(key string) (io.Writer, error)) error {
+		if isAdapter || splitSize == 0 {
+			var err error
+			w.Writer, err = create(key)
+			if err != nil {
+				return err
+			}
+
+			return convertFn(w)
+		}
+
+		// each split is its own model layer
+		return convert.ConvertModelSplit(fsys, splitSize, func(i, n int) (io.Writer, error) {
+			var err error
+			w.Writer, err = create(fmt.Sprintf("%s-%d-%05d-of-%05d", key, splitSize, i+1, n))
+			return w, err
+		})
+	}, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	fn(api.ProgressResponse{Status: status, Total: int64(size), Completed: int64(size)})
+	converted = true
+
+	var layers []*layerGGML
+	for i, layer := range outputs {
+		if envconfig.KeepConverted() {
+			p, err := keepConverted(layer)
+			if err != nil {
+				return nil, err
+			}
+
+			fn(api.ProgressResponse{Status: fmt.Sprintf("keeping converted model at %s", p)})
+		}
+
+		// only the first split has the model's metadata
+		if i > 0 {
+			layers = append(layers, &layerGGML{layer, nil})
+			continue
+		}
+
+		bin, err := layer.Open()
+		if err != nil {
 			return nil, err
 		}
+
+		f, _, err := ggml.Decode(bin, 0)
+		bin.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, &layerGGML{layer, f})
+	}
+
+	if !isAdapter && !noTemplate {
+		return detectChatTemplate(layers)
+	}
+	return layers, nil
+}
+
+// unpackedExpiry is how long the files of a failed conversion are kept for
+// retrying.
+var unpackedExpiry = 24 * time.Hour
+
+// pruneUnpacked removes the directories of files unpacked for conversions that
+// failed more than unpackedExpiry ago and aren't being used again.
+func pruneUnpacked() {
+	dirs, err := filepath.Glob(filepath.Join(envconfig.TmpDir(), "ollama-safetensors-*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() || time.Since(fi.ModTime()) < unpackedExpiry {
+			continue
+		}
+
+		unlock, ok, err := tryLockFile(dir + ".lock")
+		if err != nil || !ok {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("couldn't remove unpacked model files", "path", dir, "error", err)
+		}
+		unlock()
+	}
+}
+
+// removeUnexpected removes anything in dir, a directory of files unpacked for
+// conversion, that isn't one of files.
+func removeUnexpected(dir string, files map[string]string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := files[filepath.ToSlash(rel)]; ok {
+			return nil
+		}
+
+		return os.Remove(p)
+	})
+}
+
+// isUnpacked reports whether p is a copy of the blob digest left by a
+// previous conversion. Links aren't reported since they're cheap to create
+// again.
+func isUnpacked(p, digest string) (bool, error) {
+	fi, err := os.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+
+	blobPath, err := GetBlobsPath(digest)
+	if err != nil {
+		return false, err
+	}
+
+	blob, err := os.Stat(blobPath)
+	if err != nil {
+		return false, err
+	}
+
+	if fi.Size() != blob.Size() {
+		return false, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)) == digest, nil
+}
+
+// keepConverted copies the blob of a converted layer into the temporary
+// directory, outside of the blobs directory where it may be pruned, and
+// returns its path.
+func keepConverted(layer Layer) (string, error) {
+	blob, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(envconfig.TmpDir(), fmt.Sprintf("ollama-converted-%s.gguf", strings.TrimPrefix(layer.Digest, "sha256:")))
+	if err := os.Link(blob, p); err == nil || errors.Is(err, os.ErrExist) {
+		return p, nil
+	}
+
+	return p, copyFile(blob, p)
+}
+
+// conversionKey identifies a conversion by its inputs so only the same
+// conversion can resume from a partial output.
+func conversionKey(files map[string]string, baseLayers []*layerGGML, mediatype string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, mediatype)
+	for _, layer := range baseLayers {
+		if layer.GGML != nil {
+			fmt.Fprintln(h, layer.Digest)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintln(h, name, files[name])
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// newLayerFromConverter creates a new layer from the output of convertFn. The
+// output is written to a partial blob named by key and left behind if
+// conversion fails, with a progress file recording the tensors it completed.
+// Converting again with the same key resumes from it: [ggml.WriteGGUF] skips
+// the completed tensors instead of converting them again. Conversions with the
+// same key wait for each other rather than sharing the partial blob.
+func newLayerFromConverter(convertFn func(io.Writer) error, mediatype, key string) (Layer, error) {
+	layers, err := newLayersFromConverter(func(create func(key string) (io.Writer, error)) error {
+		w, err := create(key)
+		if err != nil {
+			return err
+		}
+
+		return convertFn(w)
+	}, mediatype)
+	if err != nil {
+		return Layer{}, err
 	}
 
-	if _, err := t.Seek(0, io.SeekStart); err != nil {
+	return layers[0], nil
+}
+
+// newLayersFromConverter is like [newLayerFromConverter] but creates a layer
+// for each output convertFn creates, in order, with the keys of their partial
+// blobs.
+func newLayersFromConverter(convertFn func(create func(key string) (io.Writer, error)) error, mediatype string) ([]Layer, error) {
+	var partials []*partialBlob
+	defer func() {
+		for _, b := range partials {
+			b.release()
+		}
+	}()
+
+	if err := func() (err error) {
+		// a panic here would take down the server; surface it as an error instead
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("error converting model: %v", r)
+			}
+		}()
+
+		return convertFn(func(key string) (io.Writer, error) {
+			b, err := openPartialBlob(key)
+			if err != nil {
+				return nil, err
+			}
+
+			partials = append(partials, b)
+			return b, nil
+		})
+	}(); err != nil {
 		return nil, err
 	}
 
-	layer, err := NewLayer(t, mediaType)
+	layers := make([]Layer, 0, len(partials))
+	for _, b := range partials {
+		layer, err := b.layer(mediatype)
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
+
+// partialBlob is the partial blob of a conversion output, held locked until
+// it's released.
+type partialBlob struct {
+	*resumeWriter
+	path   string
+	unlock func()
+}
+
+func openPartialBlob(key string) (*partialBlob, error) {
+	blobs, err := GetBlobsPath("")
 	if err != nil {
 		return nil, err
 	}
 
-	bin, err := layer.Open()
+	partial := filepath.Join(blobs, fmt.Sprintf("sha256-%s-partial", key))
+	unlock, err := lockFile(context.Background(), partial+".lock")
 	if err != nil {
 		return nil, err
 	}
-	defer bin.Close()
 
-	f, _, err := ggml.Decode(bin, 0)
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
+		unlock()
 		return nil, err
 	}
-	layers := []*layerGGML{{layer, f}}
 
-	if !isAdapter {
-		return detectChatTemplate(layers)
+	w := &resumeWriter{File: f, hash: sha256.New(), progress: partial + ".progress"}
+	if err := w.readProgress(); err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+
+	if len(w.tensors) > 0 {
+		slog.Info("resuming conversion", "path", partial, "tensors", len(w.tensors))
+	}
+
+	return &partialBlob{resumeWriter: w, path: partial, unlock: unlock}, nil
+}
+
+// layer moves the partial blob into place as a layer once it's complete.
+func (b *partialBlob) layer(mediatype string) (Layer, error) {
+	// the partial blob may be longer than the output if the inputs changed
+	if err := b.Truncate(b.offset); err != nil {
+		return Layer{}, err
+	}
+
+	if err := b.File.Close(); err != nil {
+		return Layer{}, err
+	}
+
+	if err := os.Remove(b.progress); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Layer{}, err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", b.hash.Sum(nil))
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	status := "using existing layer"
+	if _, err := os.Stat(blob); err != nil {
+		status = "creating new layer"
+		if err := os.Rename(b.path, blob); err != nil {
+			return Layer{}, err
+		}
+	} else if err := os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Layer{}, err
+	}
+
+	return Layer{
+		MediaType: mediatype,
+		Digest:    digest,
+		Size:      b.offset,
+		status:    fmt.Sprintf("%s %s", status, digest),
+	}, nil
+}
+
+func (b *partialBlob) release() {
+	// the file is already closed if it became a layer
+	_ = b.File.Close()
+	b.unlock()
+}
+
+// resumeWriter writes to a partial file which may already hold some of the
+// output. The tensors completed in the file are recorded in a progress file
+// next to it so that [ggml.WriteGGUF] can skip them when the output is written
+// again. Everything else is written again; it's deterministic for a key so
+// this overwrites the file with the same bytes.
+type resumeWriter struct {
+	*os.File
+	hash hash.Hash
+
+	// offset is how much of the output has been written or skipped
+	offset int64
+
+	progress string
+	tensors  []partialTensor
+}
+
+// partialTensor is the position of a tensor's data in a partial file.
+type partialTensor struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// partialProgress is the contents of a partial file's progress file. Progress
+// from another version is ignored since its output may differ.
+type partialProgress struct {
+	Version string          `json:"version"`
+	Tensors []partialTensor `json:"tensors"`
+}
+
+func (w *resumeWriter) readProgress() error {
+	bts, err := os.ReadFile(w.progress)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var p partialProgress
+	if err := json.Unmarshal(bts, &p); err != nil {
+		// the progress file was only partly written
+		slog.Warn("discarding conversion progress", "path", w.progress, "error", err)
+		return nil
+	}
+
+	fi, err := w.Stat()
+	if err != nil {
+		return err
+	}
+
+	if p.Version == version.Version {
+		// tensors past the end of the file weren't completed after all
+		for _, t := range p.Tensors {
+			if t.Offset+t.Size > fi.Size() {
+				break
+			}
+
+			w.tensors = append(w.tensors, t)
+		}
+	}
+
+	return nil
+}
+
+func (w *resumeWriter) writeProgress() error {
+	bts, err := json.Marshal(partialProgress{Version: version.Version, Tensors: w.tensors})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(w.progress, bts, 0o644)
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteAt(p, w.offset)
+	w.hash.Write(p[:n])
+	w.offset += int64(n)
+	return n, err
+}
+
+// SkipTensor skips the i-th tensor if it was completed in the partial file,
+// reading its data back for the digest. Otherwise the tensor and those after
+// it are forgotten before they're overwritten.
+func (w *resumeWriter) SkipTensor(i int, offset, n int64) (bool, error) {
+	if i < len(w.tensors) && w.tensors[i] == (partialTensor{offset, n}) && offset == w.offset {
+		if _, err := io.Copy(w.hash, io.NewSectionReader(w.File, offset, n)); err != nil {
+			return false, err
+		}
+
+		w.offset += n
+		return true, nil
+	}
+
+	if i < len(w.tensors) {
+		w.tensors = w.tensors[:i]
+		if err := w.writeProgress(); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func (w *resumeWriter) TensorWritten(i int, offset, n int64) error {
+	w.tensors = append(w.tensors[:min(i, len(w.tensors))], partialTensor{offset, n})
+	return w.writeProgress()
+}
+
+// convertProgressWriter reports the bytes written through it to fn each time another
+// percent of total is completed. Completed never exceeds total.
+type convertProgressWriter struct {
+	io.Writer
+	status string
+	total  int64
+	fn     func(api.ProgressResponse)
+
+	completed, reported int64
+}
+
+func (w *convertProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.add(int64(n))
+	return n, err
+}
+
+func (w *convertProgressWriter) add(n int64) {
+	w.completed += n
+	if w.total > 0 {
+		completed := min(w.completed, w.total)
+		if completed*100/w.total > w.reported*100/w.total {
+			w.reported = completed
+			w.fn(api.ProgressResponse{Status: w.status, Total: w.total, Completed: completed})
+		}
+	}
+}
+
+// SkipTensor and TensorWritten pass through to the underlying writer so that
+// resumed conversions skip completed tensors, which count as progress.
+func (w *convertProgressWriter) SkipTensor(i int, offset, n int64) (bool, error) {
+	tw, ok := w.Writer.(ggml.TensorWriter)
+	if !ok {
+		return false, nil
+	}
+
+	skip, err := tw.SkipTensor(i, offset, n)
+	if skip {
+		w.add(n)
+	}
+
+	return skip, err
+}
+
+func (w *convertProgressWriter) TensorWritten(i int, offset, n int64) error {
+	if tw, ok := w.Writer.(ggml.TensorWriter); ok {
+		return tw.TensorWritten(i, offset, n)
 	}
-	return layers, nil
+
+	return nil
 }
 
 func kvFromLayers(baseLayers []*layerGGML) (ggml.KV, error) {
@@ -325,17 +1191,39 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 		},
 	}
 
+	if err := checkProjectors(baseLayers); err != nil {
+		return err
+	}
+
+	// the base model of adapters created from a model is resolved when the
+	// adapters are used instead of being copied
+	var base string
+	if r.From != "" && r.Adapters != nil {
+		base = model.ParseName(r.From).String()
+	}
+
 	var layers []Layer
-	for _, layer := range baseLayers {
+	for i, layer := range baseLayers {
+		if base != "" && layer.Base != base && isGGMLMediaType(layer.MediaType) {
+			if layer.GGML != nil {
+				config.ModelFamilies = append(config.ModelFamilies, layer.GGML.KV().Architecture())
+			}
+			continue
+		}
+
 		if layer.GGML != nil {
 			quantType := strings.ToUpper(cmp.Or(r.Quantize, r.Quantization))
 			if quantType != "" && layer.GGML.Name() == "gguf" && layer.MediaType == "application/vnd.ollama.image.model" {
+				if _, ok := layer.KV()["split.count"]; ok {
+					return errSplitQuantize
+				}
+
 				want, err := ggml.ParseFileType(quantType)
 				if err != nil {
 					return err
 				}
 
-				ft := layer.GGML.KV().FileType()
+				ft := layer.GGML.FileType()
 				if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
 					return errors.New("quantization is only supported for F16 and F32 models")
 				} else if ft != want {
@@ -343,17 +1231,23 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 					if err != nil {
 						return err
 					}
+					baseLayers[i] = layer
 				}
 			}
-			config.ModelFormat = cmp.Or(config.ModelFormat, layer.GGML.Name())
-			config.ModelFamily = cmp.Or(config.ModelFamily, layer.GGML.KV().Architecture())
-			config.ModelType = cmp.Or(config.ModelType, format.HumanNumber(layer.GGML.KV().ParameterCount()))
-			config.FileType = cmp.Or(config.FileType, layer.GGML.KV().FileType().String())
 			config.ModelFamilies = append(config.ModelFamilies, layer.GGML.KV().Architecture())
 		}
 		layers = append(layers, layer.Layer)
 	}
 
+	summary := summarizeLayers(baseLayers)
+	slog.Debug("model summary", "format", summary.Format, "architecture", summary.Architecture, "parameters", summary.ParameterCount, "file_type", summary.FileType)
+	if summary.Format != "" {
+		config.ModelFormat = summary.Format
+		config.ModelFamily = summary.Architecture
+		config.ModelType = format.HumanNumber(summary.ParameterCount)
+		config.FileType = summary.FileType
+	}
+
 	if r.Template != "" {
 		layers, err = setTemplate(layers, r.Template)
 		if err != nil {
@@ -424,7 +1318,7 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 }
 
 func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.ProgressResponse)) (*layerGGML, error) {
-	ft := layer.GGML.KV().FileType()
+	ft := layer.GGML.FileType()
 	fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantizeType)})
 
 	want, err := ggml.ParseFileType(quantizeType)
@@ -466,7 +1360,19 @@ func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.Progr
 	return &layerGGML{newLayer, f}, nil
 }
 
-func ggufLayers(digest string, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+// isGGMLMediaType reports whether layers of mediatype are GGML files.
+func isGGMLMediaType(mediatype string) bool {
+	switch mediatype {
+	case "application/vnd.ollama.image.model",
+		"application/vnd.ollama.image.projector",
+		"application/vnd.ollama.image.adapter":
+		return true
+	}
+
+	return false
+}
+
+func ggufLayers(digest string, noTemplate bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
 	var layers []*layerGGML
 
 	fn(api.ProgressResponse{Status: "parsing GGUF"})
@@ -487,9 +1393,43 @@ func ggufLayers(digest string, fn func(resp api.ProgressResponse)) ([]*layerGGML
 		return nil, err
 	}
 
-	if contentType != "gguf" {
+	switch contentType {
+	case "gguf":
+	case "gzip":
+		// decompress into a new blob and parse that instead
+		fn(api.ProgressResponse{Status: "decompressing GGUF"})
+		zr, err := gzip.NewReader(blob)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		var r io.Reader = zr
+		if limit := decompressLimit(); limit > 0 {
+			r = &limitedReader{Reader: zr, limit: limit, n: int64(limit)}
+		}
+
+		layer, err := NewLayer(r, "application/octet-stream")
+		if err != nil {
+			return nil, err
+		}
+
+		layers, err := ggufLayers(layer.Digest, noTemplate, fn)
+		// the decompressed file is only kept as a layer if it's already in
+		// canonical order
+		if !slices.ContainsFunc(layers, func(l *layerGGML) bool { return l.Digest == layer.Digest }) {
+			if err := layer.Remove(); err != nil {
+				slog.Warn("couldn't remove blob", "digest", layer.Digest, "error", err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return layers, nil
+	default:
 		slog.Error(fmt.Sprintf("unsupported content type: %s", contentType))
-		return nil, errOnlyGGUFSupported
+		return nil, fmt.Errorf("%w (%w: %s)", errOnlyGGUFSupported, ErrUnsupportedContentType, contentType)
 	}
 
 	stat, err := blob.Stat()
@@ -502,41 +1442,264 @@ func ggufLayers(digest string, fn func(resp api.ProgressResponse)) ([]*layerGGML
 		f, n, err := ggml.Decode(blob, 0)
 		if errors.Is(err, io.EOF) {
 			break
-		} else if err != nil {
+		} else if errors.Is(err, ggml.ErrUnsupportedVersion) {
 			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptGGUF, err)
 		}
 
-		mediatype := "application/vnd.ollama.image.model"
-		if f.KV().Kind() == "adapter" {
-			mediatype = "application/vnd.ollama.image.adapter"
-		} else if _, ok := f.KV()[fmt.Sprintf("%s.vision.block_count", f.KV().Architecture())]; ok || f.KV().Kind() == "projector" {
-			mediatype = "application/vnd.ollama.image.projector"
+		mediatype, err := ggufMediaType(f)
+		if err != nil {
+			return nil, err
 		}
 
-		var layer Layer
-		if digest != "" && n == stat.Size() && offset == 0 {
-			layer, err = NewLayerFromLayer(digest, mediatype, blob.Name())
-			if err != nil {
-				slog.Debug("could not create new layer from layer", "error", err)
-				return nil, err
+		if arch, _ := f.KV()["general.architecture"].(string); mediatype == "application/vnd.ollama.image.model" && arch != "" && !llm.SupportsArchitecture(arch) {
+			if !envconfig.ForceImport() {
+				return nil, fmt.Errorf("%w %q, set OLLAMA_FORCE_IMPORT=1 to import it anyway", ErrUnsupportedArchitecture, arch)
 			}
+
+			slog.Warn("importing model with unsupported architecture", "arch", arch)
 		}
 
-		// Fallback to creating layer from file copy (either NewLayerFromLayer failed, or digest empty/n != stat.Size())
-		if layer.Digest == "" {
-			layer, err = NewLayer(io.NewSectionReader(blob, offset, n), mediatype)
-			if err != nil {
-				return nil, err
-			}
+		layer, err := canonicalLayer(io.NewSectionReader(blob, offset, stat.Size()-offset), mediatype, fn)
+		if err != nil {
+			return nil, err
 		}
 
 		layers = append(layers, &layerGGML{layer, f})
 		offset = n
 	}
 
+	if noTemplate {
+		return layers, nil
+	}
+
 	return detectChatTemplate(layers)
 }
 
+// canonicalLayer creates a layer from the GGUF file at the start of r with
+// its keys and tensors written in a canonical order, so that files of the
+// same model have the same digest whatever the order of their tensors.
+func canonicalLayer(r *io.SectionReader, mediatype string, fn func(resp api.ProgressResponse)) (Layer, error) {
+	// decode without limiting array sizes so all of the metadata can be
+	// written back
+	f, _, err := ggml.Decode(r, -1)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	// tensors are always written with the default alignment and the
+	// parameter count is added whenever a file is decoded
+	kv := f.KV()
+	delete(kv, "general.alignment")
+	delete(kv, "general.parameter_count")
+
+	ts := copyTensors(r, f.Tensors())
+
+	fn(api.ProgressResponse{Status: "ordering tensors"})
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(ggml.WriteGGUF(pw, kv, ts))
+	}()
+
+	return NewLayer(pr, mediatype)
+}
+
+// copyTensors returns tensors, decoded from r, to be written with their data
+// read from r.
+func copyTensors(r io.ReaderAt, tensors ggml.Tensors) []ggml.Tensor {
+	ts := make([]ggml.Tensor, 0, len(tensors.Items()))
+	for _, t := range tensors.Items() {
+		// decoded shapes are in the reverse order of those written
+		shape := slices.Clone(t.Shape)
+		slices.Reverse(shape)
+
+		ts = append(ts, ggml.Tensor{
+			Name:     t.Name,
+			Kind:     t.Kind,
+			Shape:    shape,
+			WriterTo: bufio.NewReader(io.NewSectionReader(r, int64(tensors.Offset+t.Offset), int64(t.Size()))),
+		})
+	}
+
+	return ts
+}
+
+// tensorDataNames returns the names of the file that may hold the tensor
+// data of the GGUF file name, for tools that write it separately from the
+// metadata.
+func tensorDataNames(name string) []string {
+	names := []string{name + ".data"}
+	if base, ok := strings.CutSuffix(name, ".gguf"); ok {
+		names = append(names, base+".data")
+	}
+
+	return names
+}
+
+// joinTensorData returns files with each GGUF file whose tensor data is in a
+// separate .data file replaced by a GGUF file with the data inline.
+func joinTensorData(files map[string]string, fn func(resp api.ProgressResponse)) (map[string]string, error) {
+	joined := maps.Clone(files)
+	for name, digest := range files {
+		i := slices.IndexFunc(tensorDataNames(name), func(n string) bool {
+			_, ok := files[n]
+			return ok
+		})
+		if i < 0 {
+			continue
+		}
+
+		dataName := tensorDataNames(name)[i]
+		layer, err := joinGGUF(digest, files[dataName], fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		joined[name] = layer.Digest
+		delete(joined, dataName)
+	}
+
+	return joined, nil
+}
+
+// joinGGUF writes the GGUF metadata in the blob meta followed by the tensor
+// data in the blob data to a new blob.
+func joinGGUF(meta, data string, fn func(resp api.ProgressResponse)) (Layer, error) {
+	metaPath, err := GetBlobsPath(meta)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	m, err := os.Open(metaPath)
+	if err != nil {
+		return Layer{}, err
+	}
+	defer m.Close()
+
+	if ct, err := detectContentType(io.NewSectionReader(m, 0, 512)); err != nil {
+		return Layer{}, err
+	} else if ct != "gguf" {
+		return Layer{}, fmt.Errorf("%w (%w: %s)", errOnlyGGUFSupported, ErrUnsupportedContentType, ct)
+	}
+
+	f, n, err := ggml.Decode(m, 0)
+	if errors.Is(err, ggml.ErrUnsupportedVersion) {
+		return Layer{}, err
+	} else if err != nil {
+		return Layer{}, fmt.Errorf("%w: %w", ErrCorruptGGUF, err)
+	}
+
+	offset := int64(f.Tensors().Offset)
+	stat, err := m.Stat()
+	if err != nil {
+		return Layer{}, err
+	}
+
+	// the metadata may or may not be padded to where the tensor data starts
+	if stat.Size() > offset {
+		return Layer{}, fmt.Errorf("%w: tensor data is both inline and in a separate file", ErrCorruptGGUF)
+	}
+
+	dataPath, err := GetBlobsPath(data)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	d, err := os.Open(dataPath)
+	if err != nil {
+		return Layer{}, err
+	}
+	defer d.Close()
+
+	dataStat, err := d.Stat()
+	if err != nil {
+		return Layer{}, err
+	}
+
+	if size := n - offset; dataStat.Size() != size {
+		return Layer{}, fmt.Errorf("%w: tensor data file is %d bytes, expected %d", ErrCorruptGGUF, dataStat.Size(), size)
+	}
+
+	if _, err := m.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, err
+	}
+
+	fn(api.ProgressResponse{Status: "joining GGUF tensor data"})
+	padding := io.LimitReader(zeroReader{}, offset-stat.Size())
+	return NewLayer(io.MultiReader(m, padding, d), "application/octet-stream")
+}
+
+// zeroReader is an infinite stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// reportTensorStats logs statistics for each tensor in fsys and warns about
+// tensors with NaN or infinite values, which usually mean the checkpoint is
+// broken.
+func reportTensorStats(fsys fs.FS, fn func(api.ProgressResponse)) error {
+	fn(api.ProgressResponse{Status: "checking tensors"})
+	stats, err := convert.Stats(fsys)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		slog.Info("tensor stats", "name", s.Name, "min", s.Min, "max", s.Max, "mean", s.Mean, "nan", s.NaN, "inf", s.Inf)
+		if s.NaN > 0 || s.Inf > 0 {
+			fn(api.ProgressResponse{Status: fmt.Sprintf("warning: tensor %s has %d NaN and %d infinite values", s.Name, s.NaN, s.Inf)})
+		}
+	}
+
+	return nil
+}
+
+// ggufMediaType returns the layer media type for f. Files without
+// general.architecture are classified by their tensor names instead.
+func ggufMediaType(f *ggml.GGML) (string, error) {
+	kv := f.KV()
+	switch {
+	case kv.Kind() == "adapter":
+		return "application/vnd.ollama.image.adapter", nil
+	case kv.Kind() == "projector":
+		return "application/vnd.ollama.image.projector", nil
+	}
+
+	if _, ok := kv["general.architecture"]; ok {
+		if _, ok := kv[fmt.Sprintf("%s.vision.block_count", kv.Architecture())]; ok {
+			return "application/vnd.ollama.image.projector", nil
+		}
+
+		return "application/vnd.ollama.image.model", nil
+	}
+
+	tensors := f.Tensors()
+	if len(tensors.Items()) == 0 {
+		return "application/vnd.ollama.image.model", nil
+	}
+
+	hasPrefix := func(prefixes ...string) bool {
+		return slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return len(tensors.Items(prefix)) > 0
+		})
+	}
+
+	switch {
+	case hasPrefix("v.", "mm."):
+		return "application/vnd.ollama.image.projector", nil
+	case hasPrefix("blk.", "token_embd.", "output.", "output_norm."):
+		return "application/vnd.ollama.image.model", nil
+	default:
+		return "", fmt.Errorf("%w: unable to classify GGUF file without general.architecture", errUnknownType)
+	}
+}
+
 func removeLayer(layers []Layer, mediatype string) []Layer {
 	return slices.DeleteFunc(layers, func(layer Layer) bool {
 		if layer.MediaType != mediatype {
@@ -552,6 +1715,145 @@ func removeLayer(layers []Layer, mediatype string) []Layer {
 	})
 }
 
+// generationOptions maps generation_config.json keys to the options they set.
+var generationOptions = map[string]string{
+	"temperature":        "temperature",
+	"top_p":              "top_p",
+	"top_k":              "top_k",
+	"min_p":              "min_p",
+	"typical_p":          "typical_p",
+	"repetition_penalty": "repeat_penalty",
+}
+
+// generationParams returns a params layer with the default sampling options
+// in generation_config.json in files, or nil if there are none.
+func generationParams(files map[string]string) (*layerGGML, error) {
+	digest, ok := files["generation_config.json"]
+	if !ok {
+		return nil, nil
+	}
+
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := os.ReadFile(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]any
+	if err := json.Unmarshal(bts, &config); err != nil {
+		return nil, fmt.Errorf("generation_config.json: %w", err)
+	}
+
+	// without sampling the model decodes greedily and the sampling options
+	// don't apply
+	if sample, ok := config["do_sample"].(bool); ok && !sample {
+		slog.Debug("ignoring generation_config.json sampling options", "do_sample", sample)
+		return nil, nil
+	}
+
+	params := make(map[string]any)
+	for k, v := range config {
+		option, ok := generationOptions[k]
+		if !ok {
+			slog.Debug("ignoring unsupported generation_config.json option", "key", k)
+			continue
+		}
+
+		f, ok := v.(float64)
+		if !ok {
+			slog.Debug("ignoring generation_config.json option with unexpected value", "key", k, "value", v)
+			continue
+		}
+
+		if option == "top_k" {
+			params[option] = int(f)
+		} else {
+			params[option] = f
+		}
+	}
+
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(params); err != nil {
+		return nil, err
+	}
+
+	layer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+	if err != nil {
+		return nil, err
+	}
+
+	layer.status = "using generation_config.json defaults"
+	return &layerGGML{layer, nil}, nil
+}
+
+// mergeParams returns a params layer with the parameters of params and those
+// of any params layer in layers, which take precedence.
+func mergeParams(params *layerGGML, layers []*layerGGML) (*layerGGML, error) {
+	merged := make(map[string]any)
+	for _, layer := range append([]*layerGGML{params}, layers...) {
+		if layer.MediaType != "application/vnd.ollama.image.params" {
+			continue
+		}
+
+		f, err := layer.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		var p map[string]any
+		err = json.NewDecoder(f).Decode(&p)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		maps.Copy(merged, p)
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(merged); err != nil {
+		return nil, err
+	}
+
+	layer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+	if err != nil {
+		return nil, err
+	}
+
+	if layer.Digest != params.Digest {
+		if err := params.Remove(); err != nil {
+			slog.Warn("couldn't remove blob", "digest", params.Digest, "error", err)
+		}
+	}
+
+	layer.status = params.status
+	return &layerGGML{layer, nil}, nil
+}
+
+// stripLayers returns layers without any layers of the given media types.
+// Blobs of the stripped layers are removed if no other model uses them.
+func stripLayers(layers []*layerGGML, mediatypes ...string) []*layerGGML {
+	return slices.DeleteFunc(layers, func(layer *layerGGML) bool {
+		if !slices.Contains(mediatypes, layer.MediaType) {
+			return false
+		}
+
+		if err := layer.Remove(); err != nil {
+			slog.Warn("couldn't remove blob", "digest", layer.Digest, "error", err)
+		}
+
+		return true
+	})
+}
+
 func setTemplate(layers []Layer, t string) ([]Layer, error) {
 	layers = removeLayer(layers, "application/vnd.ollama.image.template")
 	if _, err := template.Parse(t); err != nil {
@@ -612,10 +1914,10 @@ func setParameters(layers []Layer, p map[string]any) ([]Layer, error) {
 		if err != nil {
 			return nil, err
 		}
-		defer fn.Close()
-
 		var existing map[string]any
-		if err := json.NewDecoder(fn).Decode(&existing); err != nil {
+		err = json.NewDecoder(fn).Decode(&existing)
+		fn.Close()
+		if err != nil {
 			return nil, err
 		}
 
@@ -684,19 +1986,85 @@ func createConfigLayer(layers []Layer, config ConfigV2) (*Layer, error) {
 	return &layer, nil
 }
 
+// decompressLimit returns the maximum number of bytes a compressed model file
+// may expand to, or zero if there is no limit.
+func decompressLimit() uint64 {
+	limit := envconfig.MaxUnpackedSize()
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return limit
+	}
+
+	if available, err := freeSpace(blobs); err == nil && (limit == 0 || available < limit) {
+		limit = available
+	}
+
+	return limit
+}
+
+// limitedReader is an io.Reader that fails with err, or errDecompressedTooLarge
+// if err is nil, once more than n bytes have been read.
+type limitedReader struct {
+	io.Reader
+	limit uint64
+	n     int64
+	err   error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.n -= int64(n); r.n < 0 {
+		return n, fmt.Errorf("%w: exceeds limit of %d bytes", cmp.Or(r.err, errDecompressedTooLarge), r.limit)
+	}
+
+	return n, err
+}
+
+// checkFreeSpace returns errInsufficientSpace if dir has fewer than required
+// bytes available. Filesystems which can't report free space are not checked.
+func checkFreeSpace(dir string, required uint64) error {
+	available, err := freeSpace(dir)
+	if err != nil {
+		slog.Debug("couldn't determine free space", "path", dir, "error", err)
+		return nil
+	}
+
+	if available < required {
+		return fmt.Errorf("%w: %s requires %d bytes but only %d bytes are available", errInsufficientSpace, dir, required, available)
+	}
+
+	return nil
+}
+
+// createLink links dst to src, or copies src to dst if it can't be linked.
+// The link is made under a temporary name and renamed into place so that
+// others using dst never find it missing or partially copied.
 func createLink(src, dst string) error {
 	// make any subdirs for dst
 	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return err
 	}
 
-	_ = os.Remove(dst)
-	if err := os.Symlink(src, dst); err != nil {
-		if err := copyFile(src, dst); err != nil {
+	temp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	// the name is reserved by the file, which the link replaces
+	if err := os.Remove(temp.Name()); err != nil {
+		return err
+	}
+
+	if err := os.Symlink(src, temp.Name()); err != nil {
+		if err := copyFile(src, temp.Name()); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	return os.Rename(temp.Name(), dst)
 }
 
 func copyFile(src, dst string) error {
@@ -2,16 +2,46 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
 )
 
+// tinySafetensors returns a safetensors file with the tensors required of a
+// llama model without any blocks and a single token.
+func tinySafetensors(t *testing.T) string {
+	t.Helper()
+
+	header := `{
+		"model.embed_tokens.weight": {"dtype": "F32", "shape": [1, 4], "data_offsets": [0, 16]},
+		"model.norm.weight": {"dtype": "F32", "shape": [4], "data_offsets": [16, 32]}
+	}`
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString(header)
+	b.Write(make([]byte, 32))
+	return b.String()
+}
+
 func TestConvertFromSafetensors(t *testing.T) {
 	t.Setenv("OLLAMA_MODELS", t.TempDir())
 
@@ -24,16 +54,10 @@ func TestConvertFromSafetensors(t *testing.T) {
 		return l.Digest
 	}
 
-	// Create a safetensors compatible file with empty JSON content
-	var buf bytes.Buffer
-	headerSize := int64(len("{}"))
-	binary.Write(&buf, binary.LittleEndian, headerSize)
-	buf.WriteString("{}")
-
-	model := makeTemp(buf.String())
+	model := makeTemp(tinySafetensors(t))
 	config := makeTemp(`{
 		"architectures": ["LlamaForCausalLM"], 
-		"vocab_size": 32000
+		"vocab_size": 1
 	}`)
 	tokenizer := makeTemp(`{
 		"version": "1.0",
@@ -94,7 +118,7 @@ func TestConvertFromSafetensors(t *testing.T) {
 				"tokenizer.json": tokenizer,
 			}
 
-			_, err := convertFromSafetensors(files, nil, false, func(resp api.ProgressResponse) {})
+			_, err := convertFromSafetensors(files, nil, false, false, 0, func(resp api.ProgressResponse) {})
 
 			if (tt.wantErr == nil && err != nil) ||
 				(tt.wantErr != nil && err == nil) ||
@@ -104,3 +128,988 @@ func TestConvertFromSafetensors(t *testing.T) {
 		})
 	}
 }
+
+func TestConvertFromSafetensorsCleanup(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	makeTemp := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		return l.Digest
+	}
+
+	makeSafetensors := func(header string, data []byte) string {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, int64(len(header)))
+		buf.WriteString(header)
+		buf.Write(data)
+		return makeTemp(buf.String())
+	}
+
+	tokenizer := makeTemp(`{"added_tokens": [{"id": 0, "content": "<|endoftext|>", "special": true}]}`)
+	header := `{"model.layers.0.self_attn.q_proj.weight": {"dtype": "F32", "shape": [2, 2], "data_offsets": [0, 16]}}`
+
+	tests := []struct {
+		name   string
+		config string
+		model  string
+	}{
+		{
+			// tensor data is missing so writing the tensor fails
+			name:   "TruncatedTensor",
+			config: `{"architectures": ["LlamaForCausalLM"], "num_attention_heads": 1}`,
+			model:  makeSafetensors(header, nil),
+		},
+		{
+			// missing head count causes the repacker to panic
+			name:   "RepackPanic",
+			config: `{"architectures": ["LlamaForCausalLM"]}`,
+			model:  makeSafetensors(header, make([]byte, 16)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("OLLAMA_TMPDIR", tmp)
+
+			files := map[string]string{
+				"model.safetensors": tt.model,
+				"config.json":       makeTemp(tt.config),
+				"tokenizer.json":    tokenizer,
+			}
+
+			if _, err := convertFromSafetensors(files, nil, false, false, 0, func(api.ProgressResponse) {}); err == nil {
+				t.Fatal("expected error but didn't get one")
+			}
+
+			entries, err := os.ReadDir(tmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only the unpacked files are kept for retrying
+			want := "ollama-safetensors-" + conversionKey(files, nil, "")
+			if len(entries) != 1 || entries[0].Name() != want {
+				t.Errorf("expected only %s to be kept, found %v", want, entries)
+			}
+		})
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := checkFreeSpace(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkFreeSpace(dir, math.MaxUint64); !errors.Is(err, errInsufficientSpace) {
+		t.Errorf("expected %v, got %v", errInsufficientSpace, err)
+	}
+}
+
+func TestCreateLinkConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "links", "dst")
+
+	var g errgroup.Group
+	for range 8 {
+		g.Go(func() error {
+			for range 100 {
+				if err := createLink(src, dst); err != nil {
+					return err
+				}
+
+				// others replacing the link never leave it missing
+				if b, err := os.ReadFile(dst); err != nil {
+					return err
+				} else if string(b) != "data" {
+					return fmt.Errorf("unexpected contents %q", b)
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("expected only the link to be left, found %v", entries)
+	}
+}
+
+func TestSameDevice(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameDevice(dir, sub) {
+		t.Errorf("expected %s and %s to be on the same device", dir, sub)
+	}
+}
+
+func TestGGUFMediaType(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	tensor := func(name string) ggml.Tensor {
+		return ggml.Tensor{Name: name, Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))}
+	}
+
+	tests := []struct {
+		name    string
+		kv      ggml.KV
+		tensors []ggml.Tensor
+		want    string
+		wantErr error
+	}{
+		{
+			name: "model",
+			kv:   ggml.KV{"general.architecture": "llama"},
+			want: "application/vnd.ollama.image.model",
+		},
+		{
+			name: "vision block count",
+			kv:   ggml.KV{"general.architecture": "clip", "clip.vision.block_count": uint32(1)},
+			want: "application/vnd.ollama.image.projector",
+		},
+		{
+			name: "adapter",
+			kv:   ggml.KV{"general.architecture": "llama", "general.type": "adapter"},
+			want: "application/vnd.ollama.image.adapter",
+		},
+		{
+			name:    "no architecture with vision tensors",
+			tensors: []ggml.Tensor{tensor("v.blk.0.attn_q.weight")},
+			want:    "application/vnd.ollama.image.projector",
+		},
+		{
+			name:    "no architecture with multimodal tensors",
+			tensors: []ggml.Tensor{tensor("mm.0.weight")},
+			want:    "application/vnd.ollama.image.projector",
+		},
+		{
+			name:    "no architecture with model tensors",
+			tensors: []ggml.Tensor{tensor("token_embd.weight"), tensor("blk.0.attn_q.weight")},
+			want:    "application/vnd.ollama.image.model",
+		},
+		{
+			name:    "no architecture with unknown tensors",
+			tensors: []ggml.Tensor{tensor("unknown.weight")},
+			wantErr: errUnknownType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, _ := createBinFile(t, tt.kv, tt.tensors)
+
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			gguf, _, err := ggml.Decode(f, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ggufMediaType(gguf)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConvertProgressWriter(t *testing.T) {
+	var reports []api.ProgressResponse
+	w := &convertProgressWriter{Writer: io.Discard, status: "converting model", total: 200, fn: func(resp api.ProgressResponse) {
+		reports = append(reports, resp)
+	}}
+
+	// write past the estimated total
+	for range 300 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(reports) != 100 {
+		t.Fatalf("expected 100 progress reports, got %d", len(reports))
+	}
+
+	last := reports[len(reports)-1]
+	if last.Status != "converting model" || last.Total != 200 || last.Completed != 200 {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+}
+
+func TestConvertFromSafetensorsKeepConverted(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	tmp := t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", tmp)
+	t.Setenv("OLLAMA_KEEP_CONVERTED", "1")
+
+	makeTemp := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		return l.Digest
+	}
+
+	model := tinySafetensors(t)
+
+	files := map[string]string{
+		"model.safetensors": makeTemp(model),
+		"config.json":       makeTemp(`{"architectures": ["LlamaForCausalLM"]}`),
+		"tokenizer.json":    makeTemp(`{"added_tokens": [{"id": 0, "content": "<|endoftext|>", "special": true}]}`),
+	}
+
+	var statuses []string
+	layers, err := convertFromSafetensors(files, nil, false, false, 0, func(resp api.ProgressResponse) {
+		statuses = append(statuses, resp.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(tmp, fmt.Sprintf("ollama-converted-%s.gguf", strings.TrimPrefix(layers[0].Digest, "sha256:")))
+	if _, err := os.Stat(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(statuses, "keeping converted model at "+p) {
+		t.Errorf("expected status with converted model path, got %v", statuses)
+	}
+}
+
+func TestConvertFromSafetensorsChatTemplate(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	makeTemp := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		return l.Digest
+	}
+
+	model := tinySafetensors(t)
+
+	config, err := json.Marshal(map[string]string{
+		"chat_template": "{{ bos_token }}{% for message in messages %}{{'<|' + message['role'] + '|>' + '\n' + message['content'] + '<|end|>\n' }}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"model.safetensors":     makeTemp(model),
+		"config.json":           makeTemp(`{"architectures": ["LlamaForCausalLM"]}`),
+		"tokenizer.json":        makeTemp(`{}`),
+		"tokenizer_config.json": makeTemp(string(config)),
+	}
+
+	layers, err := convertFromSafetensors(files, nil, false, false, 0, func(api.ProgressResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+		return l.MediaType == "application/vnd.ollama.image.template"
+	})
+	if i < 0 {
+		t.Fatalf("expected a template layer, got %v", layers)
+	}
+
+	if want := "using autodetected template phi-3"; layers[i].status != want {
+		t.Errorf("expected status %q, got %q", want, layers[i].status)
+	}
+}
+
+func TestConvertFromSafetensorsReuseUnpacked(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	tmp := t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", tmp)
+
+	makeTemp := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		return l.Digest
+	}
+
+	model := tinySafetensors(t)
+
+	files := map[string]string{
+		"model.safetensors": makeTemp(model),
+		"config.json":       makeTemp(`{"architectures": ["UnknownForCausalLM"]}`),
+		"tokenizer.json":    makeTemp(`{}`),
+	}
+
+	// files left by a previous attempt that copied them
+	dir := filepath.Join(tmp, "ollama-safetensors-"+conversionKey(files, nil, ""))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{
+		"config.json":    `{"architectures": ["UnknownForCausalLM"]}`,
+		"tokenizer.json": `{"x"}`,
+		"extra.json":     `{}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := convertFromSafetensors(files, nil, false, false, 0, func(api.ProgressResponse) {}); err == nil {
+		t.Fatal("expected error for unsupported architecture")
+	}
+
+	fi, err := os.Lstat(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("expected matching copy of config.json to be reused, got mode %s", fi.Mode())
+	}
+
+	bts, err := os.ReadFile(filepath.Join(dir, "tokenizer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != `{}` {
+		t.Errorf("expected mismatched tokenizer.json to be replaced, got %q", bts)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "extra.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected extra.json to be removed, got %v", err)
+	}
+
+	// a successful conversion removes the directory
+	files["config.json"] = makeTemp(`{"architectures": ["LlamaForCausalLM"]}`)
+	if _, err := convertFromSafetensors(files, nil, false, false, 0, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(tmp, "ollama-safetensors-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0] != dir {
+		t.Errorf("expected only the failed attempt's directory to remain, got %v", dirs)
+	}
+}
+
+func TestConvertFromSafetensorsConcurrent(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	tmp := t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", tmp)
+
+	makeTemp := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		return l.Digest
+	}
+
+	model := tinySafetensors(t)
+
+	files := map[string]string{
+		"model.safetensors": makeTemp(model),
+		"config.json":       makeTemp(`{"architectures": ["LlamaForCausalLM"]}`),
+		"tokenizer.json":    makeTemp(`{}`),
+	}
+
+	// identical conversions share the unpacked directory, neither removes it
+	// while the other is converting
+	var g errgroup.Group
+	for range 4 {
+		g.Go(func() error {
+			_, err := convertFromSafetensors(files, nil, false, true, 0, func(api.ProgressResponse) {})
+			return err
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) > 0 {
+		t.Errorf("expected temporary files to be removed, found %v", entries)
+	}
+}
+
+func TestPruneUnpacked(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("OLLAMA_TMPDIR", tmp)
+
+	old := time.Now().Add(-2 * unpackedExpiry)
+	dir := func(t *testing.T, name string, mtime time.Time) string {
+		t.Helper()
+
+		p := filepath.Join(tmp, name)
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(p, "config.json"), []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	expired := dir(t, "ollama-safetensors-expired", old)
+	recent := dir(t, "ollama-safetensors-recent", time.Now())
+	locked := dir(t, "ollama-safetensors-locked", old)
+	other := dir(t, "other", old)
+
+	unlock, err := lockFile(t.Context(), locked+".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	pruneUnpacked()
+
+	for p, kept := range map[string]bool{expired: false, recent: true, locked: true, other: true} {
+		if _, err := os.Stat(p); (err == nil) != kept {
+			t.Errorf("%s: expected kept %t, got %v", filepath.Base(p), kept, err)
+		}
+	}
+}
+
+func TestNewLayerFromConverterResume(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	want := bytes.Repeat([]byte("0123456789"), 100)
+	partial := filepath.Join(p, "blobs", "sha256-key-partial")
+
+	cases := []struct {
+		name    string
+		partial []byte
+	}{
+		{"empty", nil},
+		{"prefix", want[:500]},
+		{"mismatch", append(append([]byte{}, want[:100]...), bytes.Repeat([]byte{'x'}, 400)...)},
+		{"longer", append(append([]byte{}, want...), 'x')},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := GetBlobsPath(""); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(partial, tt.partial, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			layer, err := newLayerFromConverter(func(w io.Writer) error {
+				// write in uneven chunks to cross the end of the partial blob
+				for b := want; len(b) > 0; b = b[min(len(b), 333):] {
+					if _, err := w.Write(b[:min(len(b), 333)]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, "application/vnd.ollama.image.model", "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(want)); layer.Digest != digest || layer.Size != int64(len(want)) {
+				t.Fatalf("expected digest %s and size %d, got %s and %d", digest, len(want), layer.Digest, layer.Size)
+			}
+
+			blob, err := GetBlobsPath(layer.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(want, got) {
+				t.Errorf("unexpected blob contents %q", got)
+			}
+
+			if _, err := os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected partial blob to be removed, got %v", err)
+			}
+		})
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		if _, err := newLayerFromConverter(func(w io.Writer) error {
+			if _, err := w.Write(want[:500]); err != nil {
+				return err
+			}
+			return errors.New("disk full")
+		}, "application/vnd.ollama.image.model", "key"); err == nil {
+			t.Fatal("expected error but didn't get one")
+		}
+
+		got, err := os.ReadFile(partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(want[:500], got) {
+			t.Errorf("expected partial blob to be kept, got %q", got)
+		}
+
+		if err := PruneLayers(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(partial); err != nil {
+			t.Errorf("expected partial blob to survive pruning, got %v", err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var g errgroup.Group
+		for range 4 {
+			g.Go(func() error {
+				layer, err := newLayerFromConverter(func(w io.Writer) error {
+					for b := want; len(b) > 0; b = b[min(len(b), 100):] {
+						if _, err := w.Write(b[:min(len(b), 100)]); err != nil {
+							return err
+						}
+					}
+					return nil
+				}, "application/vnd.ollama.image.model", "key")
+				if err != nil {
+					return err
+				}
+
+				if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(want)); layer.Digest != digest {
+					return fmt.Errorf("expected digest %s, got %s", digest, layer.Digest)
+				}
+				return nil
+			})
+		}
+
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		blob, err := GetBlobsPath(fmt.Sprintf("sha256:%x", sha256.Sum256(want)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := os.ReadFile(blob); err != nil || !bytes.Equal(want, got) {
+			t.Errorf("unexpected blob contents %q %v", got, err)
+		}
+	})
+}
+
+// resumeTestTensor is tensor data that counts how often it's converted and
+// fails when told to.
+type resumeTestTensor struct {
+	data      []byte
+	converted *int
+	fail      *bool
+}
+
+func (tt resumeTestTensor) WriteTo(w io.Writer) (int64, error) {
+	if *tt.fail {
+		return 0, errors.New("conversion interrupted")
+	}
+
+	*tt.converted++
+	n, err := w.Write(tt.data)
+	return int64(n), err
+}
+
+func TestNewLayerFromConverterResumeTensors(t *testing.T) {
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	progress := filepath.Join(p, "blobs", "sha256-key-partial.progress")
+	kv := ggml.KV{"general.architecture": "llama"}
+
+	converted := make([]int, 4)
+	fail := make([]bool, 4)
+	var ts []ggml.Tensor
+	for i, name := range []string{"blk.0.attn_q.weight", "blk.0.attn_k.weight", "blk.1.attn_q.weight", "output.weight"} {
+		ts = append(ts, ggml.Tensor{
+			Name:     name,
+			Shape:    []uint64{8},
+			WriterTo: resumeTestTensor{bytes.Repeat([]byte{byte(i + 1)}, 32), &converted[i], &fail[i]},
+		})
+	}
+
+	var want bytes.Buffer
+	if err := ggml.WriteGGUF(&want, kv, slices.Clone(ts)); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func() (Layer, error) {
+		clear(converted)
+		return newLayerFromConverter(func(w io.Writer) error {
+			return ggml.WriteGGUF(w, kv, slices.Clone(ts))
+		}, "application/vnd.ollama.image.model", "key")
+	}
+
+	readProgress := func(t *testing.T) partialProgress {
+		t.Helper()
+		bts, err := os.ReadFile(progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var p partialProgress
+		if err := json.Unmarshal(bts, &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	check := func(t *testing.T, layer Layer, wantConverted []int) {
+		t.Helper()
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(want.Bytes())); layer.Digest != digest {
+			t.Fatalf("expected digest %s, got %s", digest, layer.Digest)
+		}
+
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := os.ReadFile(blob); err != nil || !bytes.Equal(want.Bytes(), got) {
+			t.Errorf("unexpected blob contents %v", err)
+		}
+
+		if !slices.Equal(converted, wantConverted) {
+			t.Errorf("expected tensors converted %v, got %v", wantConverted, converted)
+		}
+
+		if _, err := os.Stat(progress); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected progress file to be removed, got %v", err)
+		}
+
+		if err := os.Remove(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		fail[2] = true
+		if _, err := convert(); err == nil {
+			t.Fatal("expected error but didn't get one")
+		}
+		fail[2] = false
+
+		if p := readProgress(t); len(p.Tensors) != 2 {
+			t.Fatalf("expected progress of 2 tensors, got %v", p.Tensors)
+		}
+
+		if err := PruneLayers(); err != nil {
+			t.Fatal(err)
+		}
+
+		layer, err := convert()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, layer, []int{0, 0, 1, 1})
+	})
+
+	t.Run("other version", func(t *testing.T) {
+		fail[3] = true
+		if _, err := convert(); err == nil {
+			t.Fatal("expected error but didn't get one")
+		}
+		fail[3] = false
+
+		p := readProgress(t)
+		p.Version = "other"
+		bts, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(progress, bts, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		layer, err := convert()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, layer, []int{1, 1, 1, 1})
+	})
+}
+
+func TestGGUFLayersErrors(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, ggml.KV{"general.architecture": "llama"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a GGUF file from the future
+	future := bytes.Clone(b.Bytes())
+	binary.LittleEndian.PutUint32(future[4:], 4)
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+		code string
+	}{
+		{"unsupported content type", []byte("not a model"), ErrUnsupportedContentType, "unsupported_content_type"},
+		{"corrupt gguf", b.Bytes()[:b.Len()-1], ErrCorruptGGUF, "corrupt_gguf"},
+		{"unsupported version", future, ErrUnsupportedGGUFVersion, "unsupported_gguf_version"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			layer, err := NewLayer(bytes.NewReader(tt.data), "application/octet-stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ggufLayers(layer.Digest, false, fn)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("expected code %q, got %q", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestGGUFLayersCanonicalOrder(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	// gguf writes a GGUF file with a F32 tensor of one element for each of
+	// names, in order, as other tools do rather than with ggml.WriteGGUF
+	gguf := func(names ...string) string {
+		var b bytes.Buffer
+		write := func(vs ...any) {
+			for _, v := range vs {
+				if s, ok := v.(string); ok {
+					binary.Write(&b, binary.LittleEndian, uint64(len(s)))
+					b.WriteString(s)
+				} else {
+					binary.Write(&b, binary.LittleEndian, v)
+				}
+			}
+		}
+
+		b.WriteString("GGUF")
+		write(uint32(3), uint64(len(names)), uint64(1))
+		write("general.architecture", uint32(8), "llama")
+
+		for i, name := range names {
+			// one dimension of one element, F32 and the offset of its data
+			write(name, uint32(1), uint64(1), uint32(0), uint64(i*32))
+		}
+
+		for i, name := range names {
+			b.Write(make([]byte, (32-b.Len()%32)%32))
+			binary.Write(&b, binary.LittleEndian, float32(len(name)))
+			if i < len(names)-1 {
+				b.Write(make([]byte, 28))
+			}
+		}
+
+		layer, err := NewLayer(&b, "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return layer.Digest
+	}
+
+	var digests []string
+	for _, digest := range []string{
+		gguf("output_norm.weight", "blk.0.attn_norm.weight", "token_embd.weight"),
+		gguf("token_embd.weight", "blk.0.attn_norm.weight", "output_norm.weight"),
+	} {
+		layers, err := ggufLayers(digest, true, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(layers) != 1 {
+			t.Fatalf("expected 1 layer, got %d", len(layers))
+		}
+
+		digests = append(digests, layers[0].Digest)
+	}
+
+	// the same tensors written by ggml.WriteGGUF are already in canonical order
+	var b bytes.Buffer
+	var ts []ggml.Tensor
+	for _, name := range []string{"token_embd.weight", "output_norm.weight", "blk.0.attn_norm.weight"} {
+		var data bytes.Buffer
+		binary.Write(&data, binary.LittleEndian, float32(len(name)))
+		ts = append(ts, ggml.Tensor{Name: name, Shape: []uint64{1}, WriterTo: &data})
+	}
+
+	if err := ggml.WriteGGUF(&b, ggml.KV{"general.architecture": "llama"}, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	canonical := fmt.Sprintf("sha256:%x", sha256.Sum256(b.Bytes()))
+	if diff := cmp.Diff([]string{canonical, canonical}, digests); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGenerationParams(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	files := func(t *testing.T, config string) map[string]string {
+		t.Helper()
+
+		layer, err := NewLayer(strings.NewReader(config), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return map[string]string{"model.safetensors": "sha256:abc123", "generation_config.json": layer.Digest}
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		layer, err := generationParams(files(t, `{"do_sample": true, "temperature": 0.6, "top_p": 0.9, "top_k": 20, "repetition_penalty": 1.1, "eos_token_id": [1, 2], "transformers_version": "4.45.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := os.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got map[string]any
+		if err := json.Unmarshal(bts, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(map[string]any{"temperature": 0.6, "top_p": 0.9, "top_k": float64(20), "repeat_penalty": 1.1}, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("greedy", func(t *testing.T) {
+		layer, err := generationParams(files(t, `{"do_sample": false, "temperature": 0.6}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if layer != nil {
+			t.Errorf("expected no params layer, got %v", layer)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		layer, err := generationParams(map[string]string{"model.safetensors": "sha256:abc123"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if layer != nil {
+			t.Errorf("expected no params layer, got %v", layer)
+		}
+	})
+}
+
+func TestConvertModelFromFilesProcess(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+	files := map[string]string{"model.gguf": digest}
+
+	system, err := NewLayer(strings.NewReader("you are a test"), "application/vnd.ollama.image.system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("transform", func(t *testing.T) {
+		layers, err := convertModelFromFiles(files, nil, false, false, 0, func(layers []*layerGGML) ([]*layerGGML, error) {
+			return append(layers, &layerGGML{system, nil}), nil
+		}, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+
+		if diff := cmp.Diff([]string{"application/vnd.ollama.image.model", "application/vnd.ollama.image.system"}, mediatypes); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		errAbort := errors.New("abort")
+		if _, err := convertModelFromFiles(files, nil, false, false, 0, func([]*layerGGML) ([]*layerGGML, error) {
+			return nil, errAbort
+		}, fn); !errors.Is(err, errAbort) {
+			t.Errorf("expected %v, got %v", errAbort, err)
+		}
+	})
+}
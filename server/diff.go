@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/types/errtypes"
+	"github.com/ollama/ollama/types/model"
+)
+
+type noPullKey struct{}
+
+// withoutPull returns a context derived from ctx in which parseFromModel
+// reports missing models as errors instead of pulling them.
+func withoutPull(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noPullKey{}, true)
+}
+
+func pullDisabled(ctx context.Context) bool {
+	v, _ := ctx.Value(noPullKey{}).(bool)
+	return v
+}
+
+// DiffModels compares the layers of models a and b. Layers are matched by
+// media type, in order, and reported if their digests differ. For matched
+// GGML layers, key metadata such as architecture, context length, rope
+// settings and quantization is compared as well. Layers the models share
+// aren't decoded.
+//
+// Missing models are pulled only if pull is true.
+func DiffModels(ctx context.Context, a, b model.Name, pull bool, fn func(api.ProgressResponse)) (*api.DiffResponse, error) {
+	if !pull {
+		ctx = withoutPull(ctx)
+	}
+
+	// layers the models share have the same metadata so only the others
+	// are decoded
+	shared := make(map[string]int)
+	for _, name := range []model.Name{a, b} {
+		layers, err := parseFromModelFunc(ctx, name, func(Layer) bool { return false }, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool)
+		for _, layer := range layers {
+			if !seen[layer.Digest] {
+				seen[layer.Digest] = true
+				shared[layer.Digest]++
+			}
+		}
+	}
+
+	differs := func(l Layer) bool { return shared[l.Digest] < 2 }
+
+	as, err := parseFromModelFunc(ctx, a, differs, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := parseFromModelFunc(ctx, b, differs, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff api.DiffResponse
+	for _, mediatype := range diffMediaTypes(as, bs) {
+		al, bl := layersOfType(as, mediatype), layersOfType(bs, mediatype)
+		for i := range max(len(al), len(bl)) {
+			var l, r *layerGGML
+			if i < len(al) {
+				l = al[i]
+			}
+			if i < len(bl) {
+				r = bl[i]
+			}
+
+			if l == nil || r == nil || l.Digest != r.Digest {
+				ld := api.LayerDiff{MediaType: mediatype}
+				if l != nil {
+					ld.A = l.Digest
+				}
+				if r != nil {
+					ld.B = r.Digest
+				}
+
+				diff.Layers = append(diff.Layers, ld)
+			}
+
+			if l != nil && r != nil && l.GGML != nil && r.GGML != nil {
+				diff.KV = append(diff.KV, diffKV(mediatype, l.KV(), r.KV())...)
+			}
+		}
+	}
+
+	return &diff, nil
+}
+
+func (s *Server) DiffHandler(c *gin.Context) {
+	var req api.DiffRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, b := model.ParseName(req.A), model.ParseName(req.B)
+	if !a.IsValid() || !b.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	// missing models are pulled with the configured mirrors and headers
+	ctx := withRegistryOptions(c.Request.Context(), newRegistryOptions(false))
+	diff, err := DiffModels(ctx, a, b, req.Pull, func(api.ProgressResponse) {})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// diffMediaTypes returns the media types found in either set of layers in
+// the order they first appear.
+func diffMediaTypes(as, bs []*layerGGML) (mediatypes []string) {
+	for _, layer := range append(slices.Clone(as), bs...) {
+		if !slices.Contains(mediatypes, layer.MediaType) {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+	}
+
+	return mediatypes
+}
+
+func layersOfType(layers []*layerGGML, mediatype string) (matched []*layerGGML) {
+	for _, layer := range layers {
+		if layer.MediaType == mediatype {
+			matched = append(matched, layer)
+		}
+	}
+
+	return matched
+}
+
+// diffKV compares the architecture, context length, rope settings and file
+// type of a and b.
+func diffKV(mediatype string, a, b ggml.KV) (diffs []api.KVDiff) {
+	keys := []string{"general.architecture", "general.file_type"}
+	for _, kv := range []ggml.KV{a, b} {
+		arch := kv.Architecture()
+		if arch == "" {
+			continue
+		}
+
+		for k := range kv {
+			if k == arch+".context_length" || strings.HasPrefix(k, arch+".rope.") {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	slices.Sort(keys[2:])
+	keys = slices.Compact(keys)
+
+	for _, k := range keys {
+		av, aok := a[k]
+		bv, bok := b[k]
+		if !aok && !bok || aok && bok && fmt.Sprint(av) == fmt.Sprint(bv) {
+			continue
+		}
+
+		if k == "general.file_type" {
+			av, bv = fileTypeValue(av, aok), fileTypeValue(bv, bok)
+		}
+
+		diffs = append(diffs, api.KVDiff{MediaType: mediatype, Key: k, A: av, B: bv})
+	}
+
+	return diffs
+}
+
+func fileTypeValue(v any, ok bool) any {
+	if !ok {
+		return nil
+	}
+
+	return ggml.KV{"general.file_type": v}.FileType().String()
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestDiffModels(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	createModel := func(t *testing.T, name string, kv ggml.KV, system string) (model.Name, []Layer) {
+		t.Helper()
+
+		_, digest := createBinFile(t, kv, nil)
+		modelLayers, err := ggufLayers(digest, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var layers []Layer
+		for _, layer := range modelLayers {
+			layers = append(layers, layer.Layer)
+		}
+
+		if system != "" {
+			layer, err := NewLayer(bytes.NewReader([]byte(system)), "application/vnd.ollama.image.system")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			layers = append(layers, layer)
+		}
+
+		config, err := createConfigLayer(layers, ConfigV2{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := model.ParseName(name)
+		if err := WriteManifest(n, *config, layers); err != nil {
+			t.Fatal(err)
+		}
+
+		return n, layers
+	}
+
+	base, baseLayers := createModel(t, "base", ggml.KV{
+		"general.architecture":   "llama",
+		"general.file_type":      uint32(1),
+		"llama.context_length":   uint32(4096),
+		"llama.rope.freq_base":   float32(10000),
+		"llama.embedding_length": uint32(16),
+	}, "")
+
+	tuned, tunedLayers := createModel(t, "tuned", ggml.KV{
+		"general.architecture":   "llama",
+		"general.file_type":      uint32(2),
+		"llama.context_length":   uint32(8192),
+		"llama.rope.freq_base":   float32(10000),
+		"llama.embedding_length": uint32(32),
+	}, "you are a tuned model")
+
+	t.Run("same", func(t *testing.T) {
+		diff, err := DiffModels(t.Context(), base, base, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(&api.DiffResponse{}, diff); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("different", func(t *testing.T) {
+		diff, err := DiffModels(t.Context(), base, tuned, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(&api.DiffResponse{
+			Layers: []api.LayerDiff{
+				{MediaType: "application/vnd.ollama.image.model", A: baseLayers[0].Digest, B: tunedLayers[0].Digest},
+				{MediaType: "application/vnd.ollama.image.system", B: tunedLayers[1].Digest},
+			},
+			KV: []api.KVDiff{
+				{MediaType: "application/vnd.ollama.image.model", Key: "general.file_type", A: "F16", B: "Q4_0"},
+				{MediaType: "application/vnd.ollama.image.model", Key: "llama.context_length", A: uint32(4096), B: uint32(8192)},
+			},
+		}, diff); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("shared layers aren't decoded", func(t *testing.T) {
+		// the projector can't be decoded but both models have it
+		projector, err := NewLayer(strings.NewReader("not a gguf file"), "application/vnd.ollama.image.projector")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers := append(slices.Clone(baseLayers), projector)
+		config, err := createConfigLayer(layers, ConfigV2{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := model.ParseName("shared")
+		if err := WriteManifest(n, *config, layers); err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := DiffModels(t.Context(), n, n, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(&api.DiffResponse{}, diff); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing without pull", func(t *testing.T) {
+		// the registry is unreachable so this fails quickly if a pull is attempted
+		missing := model.ParseName("127.0.0.1:1/library/missing")
+		_, err := DiffModels(t.Context(), base, missing, false, fn)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected not exist error, got %v", err)
+		}
+	})
+}
+
+func TestDiffHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	for name, fileType := range map[string]uint32{"base": 1, "tuned": 2} {
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama", "general.file_type": fileType}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   name,
+			Files:  map[string]string{"test.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	t.Run("different", func(t *testing.T) {
+		w := createRequest(t, s.DiffHandler, api.DiffRequest{A: "base", B: "tuned"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.DiffResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Layers) != 1 || resp.Layers[0].MediaType != "application/vnd.ollama.image.model" {
+			t.Errorf("expected the model layers to differ, got %v", resp.Layers)
+		}
+
+		if diff := cmp.Diff([]api.KVDiff{
+			{MediaType: "application/vnd.ollama.image.model", Key: "general.file_type", A: "F16", B: "Q4_0"},
+		}, resp.KV); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		w := createRequest(t, s.DiffHandler, api.DiffRequest{A: "base", B: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		w := createRequest(t, s.DiffHandler, api.DiffRequest{A: "base", B: "invalid//name"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d", w.Code)
+		}
+	})
+}
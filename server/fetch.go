@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+var (
+	errFetchNotAllowed  = errors.New("downloading model files is not allowed")
+	errFetchPrivateAddr = errors.New("downloading model files from a private address is not allowed")
+	errDownloadTooLarge = errors.New("downloaded file is too large")
+)
+
+// fetchClient downloads model files. It doesn't use a proxy since the
+// address it connects to is checked by refusePrivate.
+var fetchClient = newFetchClient()
+
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   refusePrivate,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			return checkFetchAllowed(req.URL)
+		},
+	}
+}
+
+// refusePrivate is a [net.Dialer] Control function that refuses connections
+// to loopback, link-local, private and unspecified addresses. It's called
+// with the resolved address so a public host name can't resolve to one.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", errFetchPrivateAddr, host)
+	}
+
+	return nil
+}
+
+// checkFetchAllowed returns errFetchNotAllowed unless the host of u is
+// allowed by OLLAMA_FETCH_HOSTS.
+func checkFetchAllowed(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range envconfig.FetchHosts() {
+		if allowed == "*" || allowed == host ||
+			strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w from %s, add it to OLLAMA_FETCH_HOSTS to allow it", errFetchNotAllowed, host)
+}
+
+// fetchStatus returns the HTTP status for an error from fetchFiles: bad
+// request for URLs that can't be downloaded, zero otherwise.
+func fetchStatus(err error) int {
+	for _, badReq := range []error{errFetchNotAllowed, errFetchPrivateAddr, errDownloadTooLarge, errInsufficientSpace} {
+		if errors.Is(err, badReq) {
+			return http.StatusBadRequest
+		}
+	}
+
+	return 0
+}
+
+// isFileURL reports whether v, a value of [api.CreateRequest.Files], is a URL
+// to download rather than the digest of an uploaded blob.
+func isFileURL(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
+
+// fetchFiles returns files with each URL replaced by the digest of the blob
+// downloaded from it.
+func fetchFiles(ctx context.Context, files map[string]string, fn func(api.ProgressResponse)) (map[string]string, error) {
+	fetched := maps.Clone(files)
+	for name, v := range files {
+		if !isFileURL(v) {
+			continue
+		}
+
+		digest, err := fetchBlob(ctx, v, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched[name] = digest
+	}
+
+	return fetched, nil
+}
+
+// fetchBlob downloads rawURL into the blob store, hashing it as it's written,
+// and returns its digest. Interrupted downloads are resumed with a range
+// request if the server supports them and the file hasn't changed since, as
+// told by its ETag or Last-Modified time saved next to the partial download.
+// Otherwise the download starts over.
+func fetchBlob(ctx context.Context, rawURL string, fn func(api.ProgressResponse)) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkFetchAllowed(u); err != nil {
+		return "", err
+	}
+
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	// partial downloads aren't valid digests so they're removed when pruning
+	partial := filepath.Join(dir, fmt.Sprintf("url-%x-partial", sha256.Sum256([]byte(rawURL))))
+
+	// identical downloads share the partial file so they're done one at a time
+	unlock, err := lockFile(ctx, partial+".lock")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// hash what was downloaded before so the download can continue from there
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	validator, err := os.ReadFile(partial + ".validator")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	resp, err := fetchRange(ctx, rawURL, offset, string(validator))
+	if err != nil {
+		return "", err
+	}
+
+	if offset > 0 && !continuesDownload(resp, offset, string(validator)) {
+		// the file changed or can't be resumed from where the partial
+		// download stopped so start over
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			resp, err = fetchRange(ctx, rawURL, 0, "")
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if err := f.Truncate(0); err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+
+		h.Reset()
+		offset = 0
+	}
+	defer resp.Body.Close()
+
+	status := fmt.Sprintf("downloading %s", u.Redacted())
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the previous download got everything but was interrupted before
+		// being moved into place
+		resp.Body = http.NoBody
+	case resp.StatusCode == http.StatusOK:
+		// a download without a validator can't be resumed
+		if v := responseValidator(resp); v != "" {
+			if err := os.WriteFile(partial+".validator", []byte(v), 0o644); err != nil {
+				return "", err
+			}
+		} else if err := os.Remove(partial + ".validator"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("downloading %s: %s", u.Redacted(), resp.Status)
+	}
+
+	var total int64
+	if resp.ContentLength > 0 {
+		total = offset + resp.ContentLength
+	}
+
+	// the rest of the download is limited by OLLAMA_MAX_UNPACKED_SIZE and the
+	// free space in the blobs directory. The length isn't always known in
+	// advance so the limit is applied while downloading.
+	n := int64(math.MaxInt64)
+	if limit := envconfig.MaxUnpackedSize(); limit > 0 {
+		n = int64(limit) - offset
+	}
+
+	if available, err := freeSpace(dir); err == nil {
+		n = min(n, int64(available))
+	}
+
+	if resp.ContentLength > n {
+		return "", fmt.Errorf("downloading %s: %w: %d bytes exceeds limit of %d bytes", u.Redacted(), errDownloadTooLarge, total, offset+n)
+	}
+
+	body := &limitedReader{Reader: resp.Body, limit: uint64(offset + n), n: n, err: errDownloadTooLarge}
+
+	fn(api.ProgressResponse{Status: status, Total: total, Completed: offset})
+	w := &convertProgressWriter{Writer: io.MultiWriter(f, h), status: status, total: total, fn: fn, completed: offset, reported: offset}
+	if _, err := io.Copy(w, body); err != nil {
+		return "", fmt.Errorf("downloading %s: %w", u.Redacted(), err)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(partial, blob); err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(partial + ".validator"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// fetchRange requests rawURL from offset if the file is still the one
+// identified by validator.
+func fetchRange(ctx context.Context, rawURL string, offset int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 && validator != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+
+	return fetchClient.Do(req)
+}
+
+// responseValidator returns the value of resp that identifies the version of
+// the file being downloaded for If-Range: its ETag, unless it's a weak ETag
+// which If-Range doesn't allow, or its Last-Modified time.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
+// continuesDownload reports whether resp continues a partial download of
+// offset bytes of the file identified by validator.
+func continuesDownload(resp *http.Response, offset int64, validator string) bool {
+	if validator == "" {
+		return false
+	}
+
+	// servers that ignore If-Range might still send the file's validator
+	if v := responseValidator(resp); v != "" && v != validator {
+		return false
+	}
+
+	contentRange := resp.Header.Get("Content-Range")
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end int64
+		_, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end)
+		return err == nil && start == offset
+	case http.StatusRequestedRangeNotSatisfiable:
+		size, ok := strings.CutPrefix(contentRange, "bytes */")
+		return ok && size == strconv.FormatInt(offset, 10)
+	}
+
+	return false
+}
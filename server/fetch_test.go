@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/api"
+)
+
+// allowLoopbackFetch allows downloading model files from test servers, which
+// listen on a loopback address.
+func allowLoopbackFetch(t *testing.T) {
+	t.Helper()
+	t.Setenv("OLLAMA_FETCH_HOSTS", "127.0.0.1")
+
+	client := fetchClient
+	t.Cleanup(func() { fetchClient = client })
+	fetchClient = &http.Client{CheckRedirect: client.CheckRedirect}
+}
+
+func TestFetchBlob(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	want := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "model.gguf", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	fn := func(api.ProgressResponse) {}
+	allowLoopbackFetch(t)
+
+	t.Run("download", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		ranges = nil
+
+		digest, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest != want {
+			t.Errorf("expected digest %s, got %s", want, digest)
+		}
+
+		blob, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, err := os.ReadFile(blob); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Error("blob doesn't match downloaded data")
+		}
+
+		if len(ranges) != 1 || ranges[0] != "" {
+			t.Errorf("expected a request without range, got %q", ranges)
+		}
+	})
+
+	// resume leaves a partial download of the first 300 bytes with validator
+	// and checks the requests made to finish it
+	resume := func(t *testing.T, srvURL, validator string, wantRanges ...string) {
+		t.Helper()
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		ranges = nil
+
+		rawURL := srvURL + "/model.gguf"
+		dir, err := GetBlobsPath("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partial := filepath.Join(dir, fmt.Sprintf("url-%x-partial", sha256.Sum256([]byte(rawURL))))
+		if err := os.WriteFile(partial, data[:300], 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if validator != "" {
+			if err := os.WriteFile(partial+".validator", []byte(validator), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		digest, err := fetchBlob(t.Context(), rawURL, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if digest != want {
+			t.Errorf("expected digest %s, got %s", want, digest)
+		}
+
+		if !slices.Equal(ranges, wantRanges) {
+			t.Errorf("expected requests with ranges %q, got %q", wantRanges, ranges)
+		}
+
+		for _, p := range []string{partial, partial + ".validator"} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed, got %v", filepath.Base(p), err)
+			}
+		}
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		resume(t, srv.URL, `"v1"`, "bytes=300-")
+	})
+
+	t.Run("resume changed", func(t *testing.T) {
+		// the server ignores the range of a file that changed
+		resume(t, srv.URL, `"v0"`, "bytes=300-")
+	})
+
+	t.Run("resume without validator", func(t *testing.T) {
+		resume(t, srv.URL, "", "")
+	})
+
+	t.Run("resume wrong range", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("Range") != "" {
+				// a range other than the one requested
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(data)
+				return
+			}
+
+			w.Write(data)
+		}))
+		defer srv.Close()
+
+		resume(t, srv.URL, `"v1"`, "bytes=300-", "")
+	})
+
+	t.Run("resume complete", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		ranges = nil
+
+		rawURL := srv.URL + "/model.gguf"
+		dir, err := GetBlobsPath("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partial := filepath.Join(dir, fmt.Sprintf("url-%x-partial", sha256.Sum256([]byte(rawURL))))
+		if err := os.WriteFile(partial, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(partial+".validator", []byte(`"v1"`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if digest, err := fetchBlob(t.Context(), rawURL, fn); err != nil {
+			t.Fatal(err)
+		} else if digest != want {
+			t.Errorf("expected digest %s, got %s", want, digest)
+		}
+
+		if want := []string{fmt.Sprintf("bytes=%d-", len(data))}; !slices.Equal(ranges, want) {
+			t.Errorf("expected requests with ranges %q, got %q", want, ranges)
+		}
+	})
+
+	t.Run("validator", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		// the validator is kept while the download is incomplete
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Write(data[:300])
+		}))
+		defer srv.Close()
+
+		rawURL := srv.URL + "/model.gguf"
+		if _, err := fetchBlob(t.Context(), rawURL, fn); err == nil {
+			t.Fatal("expected error")
+		}
+
+		dir, err := GetBlobsPath("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partial := filepath.Join(dir, fmt.Sprintf("url-%x-partial", sha256.Sum256([]byte(rawURL))))
+		if got, err := os.ReadFile(partial + ".validator"); err != nil || string(got) != `"v1"` {
+			t.Errorf("expected validator %q, got %q %v", `"v1"`, got, err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		if _, err := fetchBlob(t.Context(), srv.URL+"/missing.gguf", fn); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		t.Setenv("OLLAMA_MAX_UNPACKED_SIZE", "100")
+
+		if _, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn); !errors.Is(err, errDownloadTooLarge) {
+			t.Errorf("expected %v, got %v", errDownloadTooLarge, err)
+		}
+	})
+
+	t.Run("too large without length", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		t.Setenv("OLLAMA_MAX_UNPACKED_SIZE", "100")
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			w.Write(data)
+		}))
+		defer srv.Close()
+
+		if _, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn); !errors.Is(err, errDownloadTooLarge) {
+			t.Errorf("expected %v, got %v", errDownloadTooLarge, err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		var g errgroup.Group
+		for range 4 {
+			g.Go(func() error {
+				digest, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn)
+				if err == nil && digest != want {
+					err = fmt.Errorf("expected digest %s, got %s", want, digest)
+				}
+				return err
+			})
+		}
+
+		if err := g.Wait(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestFetchBlobNotAllowed(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost/model.gguf", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	fn := func(api.ProgressResponse) {}
+
+	cases := []struct {
+		name  string
+		hosts string
+		want  error
+	}{
+		{"disabled", "", errFetchNotAllowed},
+		{"other host", "huggingface.co,*.example.com", errFetchNotAllowed},
+		// the allowed host resolves to a loopback address
+		{"loopback", "127.0.0.1", errFetchPrivateAddr},
+		{"any host", "*", errFetchPrivateAddr},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_FETCH_HOSTS", tt.hosts)
+
+			_, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+
+			if status := fetchStatus(err); status != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, status)
+			}
+		})
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		allowLoopbackFetch(t)
+
+		// localhost isn't allowed even though 127.0.0.1 is
+		if _, err := fetchBlob(t.Context(), srv.URL+"/model.gguf", fn); !errors.Is(err, errFetchNotAllowed) {
+			t.Errorf("expected %v, got %v", errFetchNotAllowed, err)
+		}
+	})
+}
+
+func TestRefusePrivate(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1:80":               false,
+		"[::1]:80":                   false,
+		"10.0.0.1:80":                false,
+		"192.168.1.1:443":            false,
+		"172.16.0.1:443":             false,
+		"169.254.169.254:80":         false,
+		"[fe80::1]:80":               false,
+		"[::ffff:127.0.0.1]:80":      false,
+		"0.0.0.0:80":                 false,
+		"[fd00::1]:80":               false,
+		"8.8.8.8:443":                true,
+		"[2001:4860:4860::8888]:443": true,
+	}
+
+	for address, ok := range cases {
+		if err := refusePrivate("tcp", address, nil); (err == nil) != ok {
+			t.Errorf("%s: expected allowed %t, got %v", address, ok, err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package server
+
+import "golang.org/x/sys/unix"
+
+func freeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// sameDevice reports whether a and b are on the same filesystem. Paths which
+// can't be checked aren't on the same filesystem.
+func sameDevice(a, b string) bool {
+	var sa, sb unix.Stat_t
+	if unix.Stat(a, &sa) != nil || unix.Stat(b, &sb) != nil {
+		return false
+	}
+
+	return sa.Dev == sb.Dev
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"net"
@@ -20,6 +22,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
@@ -51,9 +54,54 @@ type registryOptions struct {
 	Password string
 	Token    string
 
+	// Headers are added to each request unless the request already sets them.
+	Headers http.Header
+
+	// Mirrors maps registry hosts to the URL requests for that host are
+	// sent to instead.
+	Mirrors map[string]*url.URL
+
 	CheckRedirect func(req *http.Request, via []*http.Request) error
 }
 
+type registryOptionsKey struct{}
+
+// withRegistryOptions returns a context derived from ctx in which pulls that
+// are not started by a user request, such as those by parseFromModel, use
+// opts.
+func withRegistryOptions(ctx context.Context, opts *registryOptions) context.Context {
+	return context.WithValue(ctx, registryOptionsKey{}, opts)
+}
+
+// registryOptionsFromContext returns a copy of the registry options associated
+// with ctx, or empty options if there are none.
+func registryOptionsFromContext(ctx context.Context) *registryOptions {
+	var opts registryOptions
+	if o, ok := ctx.Value(registryOptionsKey{}).(*registryOptions); ok && o != nil {
+		opts = *o
+	}
+
+	return &opts
+}
+
+// newRegistryOptions returns registry options with the mirrors and headers
+// configured by OLLAMA_REGISTRY_MIRRORS and OLLAMA_REGISTRY_HEADERS.
+func newRegistryOptions(insecure bool) *registryOptions {
+	opts := registryOptions{
+		Insecure: insecure,
+		Mirrors:  envconfig.RegistryMirrors(),
+	}
+
+	if headers := envconfig.RegistryHeaders(); len(headers) > 0 {
+		opts.Headers = make(http.Header)
+		for k, v := range headers {
+			opts.Headers.Set(k, v)
+		}
+	}
+
+	return &opts
+}
+
 type Model struct {
 	Name           string `json:"name"`
 	Config         ConfigV2
@@ -69,6 +117,10 @@ type Model struct {
 	Messages       []api.Message
 
 	Template *template.Template
+
+	// base is the base model of the model's adapters if the base model isn't
+	// part of the model
+	base string
 }
 
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
@@ -228,6 +280,21 @@ func GetManifest(mp ModelPath) (*Manifest, string, error) {
 }
 
 func GetModel(name string) (*Model, error) {
+	m, err := getModel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.resolveBase(0); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// getModel is like GetModel but doesn't resolve the base model of the
+// model's adapters.
+func getModel(name string) (*Model, error) {
 	mp := ParseModelPath(name)
 	manifest, digest, err := GetManifest(mp)
 	if err != nil {
@@ -258,6 +325,8 @@ func GetModel(name string) (*Model, error) {
 		}
 	}
 
+	var modelPaths []string
+	var base string
 	for _, layer := range manifest.Layers {
 		filename, err := GetBlobsPath(layer.Digest)
 		if err != nil {
@@ -268,12 +337,14 @@ func GetModel(name string) (*Model, error) {
 		case "application/vnd.ollama.image.model":
 			model.ModelPath = filename
 			model.ParentModel = layer.From
+			modelPaths = append(modelPaths, filename)
 		case "application/vnd.ollama.image.embed":
 			// Deprecated in versions  > 0.1.2
 			// TODO: remove this warning in a future version
 			slog.Info("WARNING: model contains embeddings, but embeddings in modelfiles have been deprecated and will be ignored.")
 		case "application/vnd.ollama.image.adapter":
 			model.AdapterPaths = append(model.AdapterPaths, filename)
+			base = cmp.Or(base, layer.Base)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
 		case "application/vnd.ollama.image.prompt",
@@ -299,10 +370,10 @@ func GetModel(name string) (*Model, error) {
 			if err != nil {
 				return nil, err
 			}
-			defer params.Close()
-
 			// parse model options parameters into a map so that we can see which fields have been specified explicitly
-			if err = json.NewDecoder(params).Decode(&model.Options); err != nil {
+			err = json.NewDecoder(params).Decode(&model.Options)
+			params.Close()
+			if err != nil {
 				return nil, err
 			}
 		case "application/vnd.ollama.image.messages":
@@ -310,9 +381,9 @@ func GetModel(name string) (*Model, error) {
 			if err != nil {
 				return nil, err
 			}
-			defer msgs.Close()
-
-			if err = json.NewDecoder(msgs).Decode(&model.Messages); err != nil {
+			err = json.NewDecoder(msgs).Decode(&model.Messages)
+			msgs.Close()
+			if err != nil {
 				return nil, err
 			}
 		case "application/vnd.ollama.image.license":
@@ -324,9 +395,129 @@ func GetModel(name string) (*Model, error) {
 		}
 	}
 
+	if len(modelPaths) > 1 {
+		p, err := linkSplits(modelPaths)
+		if err != nil {
+			return nil, err
+		} else if p != "" {
+			model.ModelPath = p
+		}
+	}
+
+	// the base model of an adapter is only copied into models created from
+	// the adapter model
+	if model.ModelPath == "" {
+		model.base = base
+	}
+
 	return model, nil
 }
 
+// resolveBase uses the model file of the base model of m's adapters, along
+// with its adapters and projectors, if it isn't part of m. depth is the number
+// of adapters that depend on m as their base model.
+func (m *Model) resolveBase(depth int) error {
+	if m.base == "" {
+		return nil
+	}
+
+	if depth >= maxBaseDepth {
+		return fmt.Errorf("adapter %s has more than %d base models", m.ShortName, maxBaseDepth)
+	}
+
+	base, err := getModel(m.base)
+	if err == nil {
+		err = base.resolveBase(depth + 1)
+	}
+	if err != nil {
+		return fmt.Errorf("adapter %s requires base model %s: %w", m.ShortName, ParseModelPath(m.base).GetShortTagname(), err)
+	}
+
+	m.ModelPath = base.ModelPath
+	m.ParentModel = base.ShortName
+	m.AdapterPaths = append(base.AdapterPaths, m.AdapterPaths...)
+	m.ProjectorPaths = append(base.ProjectorPaths, m.ProjectorPaths...)
+	m.base = ""
+	return nil
+}
+
+// linkSplits links the model layers at paths, if they're the splits of a
+// split model, under names that llama.cpp finds the splits by and returns the
+// path of the first split. It returns an empty path for other models.
+func linkSplits(paths []string) (string, error) {
+	f, err := os.Open(paths[0])
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	g, _, err := ggml.Decode(f, 0)
+	if err != nil {
+		return "", err
+	}
+
+	if n, _ := g.KV()["split.count"].(uint16); int(n) != len(paths) {
+		return "", nil
+	}
+
+	dir, err := splitsPath(filepath.Base(paths[0]))
+	if err != nil {
+		return "", err
+	}
+
+	links := make([]string, len(paths))
+	for i, p := range paths {
+		links[i] = filepath.Join(dir, fmt.Sprintf("model-%05d-of-%05d.gguf", i+1, len(paths)))
+		if _, err := os.Lstat(links[i]); err == nil {
+			continue
+		}
+
+		if err := createLink(p, links[i]); err != nil {
+			return "", err
+		}
+	}
+
+	return links[0], nil
+}
+
+// splitsPath returns the directory the splits of the split model whose first
+// split is the blob named name are linked in.
+func splitsPath(name string) (string, error) {
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(blobs), "splits", name), nil
+}
+
+// pruneSplits removes the links to split models whose first split has been
+// removed.
+func pruneSplits() {
+	dir, err := splitsPath("")
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(blobs, e.Name())); errors.Is(err, fs.ErrNotExist) {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				slog.Warn("couldn't remove split model links", "path", filepath.Join(dir, e.Name()), "error", err)
+			}
+		}
+	}
+}
+
 func CopyModel(src, dst model.Name) error {
 	if !dst.IsFullyQualified() {
 		return model.Unqualified(dst)
@@ -394,9 +585,30 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 		}
 	}
 
+	pruneSplits()
 	return nil
 }
 
+// keepPartialBlob reports whether a partial blob, its progress or validator
+// file or its lock file should be kept when pruning. Partial conversions are
+// kept as long as unpacked model files so that retrying can resume them, and
+// lock files are kept while held.
+func keepPartialBlob(blob fs.DirEntry) bool {
+	fi, err := blob.Info()
+	if err != nil {
+		return false
+	}
+
+	switch name := blob.Name(); {
+	case strings.HasSuffix(name, ".lock"):
+		return time.Since(fi.ModTime()) < lockStale
+	case strings.HasSuffix(name, "-partial"), strings.HasSuffix(name, "-partial.progress"), strings.HasSuffix(name, "-partial.validator"):
+		return time.Since(fi.ModTime()) < unpackedExpiry
+	}
+
+	return false
+}
+
 func PruneLayers() error {
 	deleteMap := make(map[string]struct{})
 	p, err := GetBlobsPath("")
@@ -416,6 +628,10 @@ func PruneLayers() error {
 
 		_, err := GetBlobsPath(name)
 		if err != nil {
+			if keepPartialBlob(blob) {
+				continue
+			}
+
 			if errors.Is(err, ErrInvalidDigestFormat) {
 				// remove invalid blobs (e.g. partial downloads)
 				if err := os.Remove(filepath.Join(p, blob.Name())); err != nil {
@@ -723,6 +939,14 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 var testMakeRequestDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
 func makeRequest(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.Reader, regOpts *registryOptions) (*http.Response, error) {
+	if regOpts != nil {
+		if mirror, ok := regOpts.Mirrors[requestURL.Host]; ok {
+			u, m := *requestURL, mirror.JoinPath(requestURL.Path)
+			u.Scheme, u.Host, u.Path, u.RawPath = m.Scheme, m.Host, m.Path, m.RawPath
+			requestURL = &u
+		}
+	}
+
 	if requestURL.Scheme != "http" && regOpts != nil && regOpts.Insecure {
 		requestURL.Scheme = "http"
 	}
@@ -737,6 +961,14 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 	}
 
 	if regOpts != nil {
+		for k, vs := range regOpts.Headers {
+			if req.Header.Get(k) == "" {
+				for _, v := range vs {
+					req.Header.Add(k, v)
+				}
+			}
+		}
+
 		if regOpts.Token != "" {
 			req.Header.Set("Authorization", "Bearer "+regOpts.Token)
 		} else if regOpts.Username != "" && regOpts.Password != "" {
@@ -13,7 +13,9 @@ type Layer struct {
 	Digest    string `json:"digest"`
 	Size      int64  `json:"size"`
 	From      string `json:"from,omitempty"`
-	status    string
+	// Base is the model an adapter layer was created against
+	Base   string `json:"base,omitempty"`
+	status string
 }
 
 func NewLayer(r io.Reader, mediatype string) (Layer, error) {
@@ -88,6 +90,23 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 	}, nil
 }
 
+// newLayerFromManifestLayer returns the existing layer for the manifest layer
+// l. The blob is only checked for presence and against the size recorded in
+// the manifest; its contents are not read.
+func newLayerFromManifestLayer(l Layer, from string) (Layer, error) {
+	layer, err := NewLayerFromLayer(l.Digest, l.MediaType, from)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	if l.Size > 0 && layer.Size != l.Size {
+		return Layer{}, fmt.Errorf("blob %s has size %d, expected %d", l.Digest, layer.Size, l.Size)
+	}
+
+	layer.Base = l.Base
+	return layer, nil
+}
+
 func (l *Layer) Open() (io.ReadSeekCloser, error) {
 	if l.Digest == "" {
 		return nil, errors.New("opening layer with empty digest")
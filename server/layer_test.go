@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// patternReader is a non-seekable reader of n bytes of unknown length.
+type patternReader struct {
+	n, i int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.i >= r.n {
+		return 0, io.EOF
+	}
+
+	p = p[:min(int64(len(p)), r.n-r.i)]
+	for j := range p {
+		p[j] = byte((r.i + int64(j)) % 251)
+	}
+
+	r.i += int64(len(p))
+	return len(p), nil
+}
+
+func TestNewLayerStreaming(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	const size = 64 << 20
+
+	h := sha256.New()
+	if _, err := io.Copy(h, &patternReader{n: size}); err != nil {
+		t.Fatal(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	layer, err := NewLayer(&patternReader{n: size}, "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	// the reader is streamed to the blob rather than buffered
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("expected bounded memory use, allocated %d bytes for a %d byte layer", allocated, size)
+	}
+
+	if layer.Digest != digest {
+		t.Errorf("expected digest %s, got %s", digest, layer.Digest)
+	}
+
+	if layer.Size != size {
+		t.Errorf("expected size %d, got %d", size, layer.Size)
+	}
+
+	blob, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(blob); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != size {
+		t.Errorf("expected blob of %d bytes, got %d", size, fi.Size())
+	}
+}
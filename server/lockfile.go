@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// lockPoll is how often a lock file held by another process is checked
+	lockPoll = 100 * time.Millisecond
+	// lockRefresh is how often a held lock file is touched
+	lockRefresh = 10 * time.Second
+	// lockStale is how long a lock file can go untouched before it's assumed
+	// to have been left behind by a process that exited without releasing it
+	lockStale = time.Minute
+)
+
+// lockFiles serializes holders of the same lock file within this process so
+// that only one of them waits on the file itself.
+var lockFiles = struct {
+	sync.Mutex
+	m map[string]*lockFileMutex
+}{m: make(map[string]*lockFileMutex)}
+
+type lockFileMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lockFile takes the lock file at p, waiting until any other holder releases
+// it, and returns a function that releases it. The lock file is touched while
+// it's held so that one left behind by a process that exited is taken over
+// once it's stale.
+func lockFile(ctx context.Context, p string) (func(), error) {
+	unlock, _, err := acquireLockFile(ctx, p, true)
+	return unlock, err
+}
+
+// tryLockFile is like lockFile but reports false instead of waiting if the
+// lock file is held.
+func tryLockFile(p string) (func(), bool, error) {
+	return acquireLockFile(context.Background(), p, false)
+}
+
+func acquireLockFile(ctx context.Context, p string, wait bool) (func(), bool, error) {
+	lockFiles.Lock()
+	mu, ok := lockFiles.m[p]
+	if !ok {
+		mu = &lockFileMutex{}
+		lockFiles.m[p] = mu
+	}
+	mu.refs++
+	lockFiles.Unlock()
+
+	unref := func() {
+		lockFiles.Lock()
+		defer lockFiles.Unlock()
+		if mu.refs--; mu.refs == 0 {
+			delete(lockFiles.m, p)
+		}
+	}
+
+	if !wait {
+		if !mu.TryLock() {
+			unref()
+			return nil, false, nil
+		}
+	} else {
+		mu.Lock()
+	}
+
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			break
+		} else if !errors.Is(err, fs.ErrExist) {
+			mu.Unlock()
+			unref()
+			return nil, false, err
+		}
+
+		if fi, err := os.Stat(p); err == nil && time.Since(fi.ModTime()) > lockStale {
+			_ = os.Remove(p)
+			continue
+		}
+
+		if !wait {
+			mu.Unlock()
+			unref()
+			return nil, false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			mu.Unlock()
+			unref()
+			return nil, false, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(lockRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				_ = os.Chtimes(p, now, now)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		_ = os.Remove(p)
+		mu.Unlock()
+		unref()
+	}, true, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.lock")
+
+	t.Run("exclusive", func(t *testing.T) {
+		var held atomic.Int32
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := lockFile(t.Context(), p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer unlock()
+
+				if n := held.Add(1); n != 1 {
+					t.Errorf("expected one holder, got %d", n)
+				}
+				time.Sleep(time.Millisecond)
+				held.Add(-1)
+			}()
+		}
+		wg.Wait()
+
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected lock file to be removed, got %v", err)
+		}
+	})
+
+	t.Run("held by another process", func(t *testing.T) {
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(p)
+
+		ctx, cancel := context.WithTimeout(t.Context(), 3*lockPoll)
+		defer cancel()
+
+		if _, err := lockFile(ctx, p); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("try", func(t *testing.T) {
+		unlock, err := lockFile(t.Context(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok, err := tryLockFile(p); err != nil || ok {
+			t.Errorf("expected held lock not to be taken, got %t %v", ok, err)
+		}
+
+		unlock()
+
+		unlock, ok, err := tryLockFile(p)
+		if err != nil || !ok {
+			t.Fatalf("expected released lock to be taken, got %t %v", ok, err)
+		}
+		unlock()
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		old := time.Now().Add(-2 * lockStale)
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		unlock, err := lockFile(t.Context(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	})
+}
@@ -57,6 +57,7 @@ func (m *Manifest) RemoveLayers() error {
 		}
 	}
 
+	pruneSplits()
 	return nil
 }
 
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,28 +11,194 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"text/template/parse"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/types/model"
 )
 
-var intermediateBlobs map[string]string = make(map[string]string)
+// intermediateBlobs maps the digests of uploaded blobs to the digests of the
+// blobs created from them. It is safe for concurrent use through
+// intermediateBlob, setIntermediateBlob and deleteIntermediateBlob.
+var intermediateBlobs = struct {
+	mu sync.Mutex
+	m  map[string]string
+}{m: make(map[string]string)}
+
+func intermediateBlob(digest string) (string, bool) {
+	intermediateBlobs.mu.Lock()
+	defer intermediateBlobs.mu.Unlock()
+	ib, ok := intermediateBlobs.m[digest]
+	return ib, ok
+}
+
+func setIntermediateBlob(digest, ib string) {
+	intermediateBlobs.mu.Lock()
+	defer intermediateBlobs.mu.Unlock()
+	intermediateBlobs.m[digest] = ib
+}
+
+func deleteIntermediateBlob(digest string) {
+	intermediateBlobs.mu.Lock()
+	defer intermediateBlobs.mu.Unlock()
+	delete(intermediateBlobs.m, digest)
+}
 
 type layerGGML struct {
 	Layer
 	*ggml.GGML
 }
 
+// layerOrder is the canonical order of layers by media type. Layers with
+// other media types sort after these.
+var layerOrder = []string{
+	"application/vnd.ollama.image.model",
+	"application/vnd.ollama.image.embed",
+	"application/vnd.ollama.image.projector",
+	"application/vnd.ollama.image.adapter",
+	"application/vnd.ollama.image.template",
+	"application/vnd.ollama.image.system",
+	"application/vnd.ollama.image.params",
+	"application/vnd.ollama.image.messages",
+	"application/vnd.ollama.image.license",
+}
+
+// sortLayers sorts layers into canonical order. Layers with the same media
+// type keep their relative order.
+func sortLayers(layers []*layerGGML) []*layerGGML {
+	rank := func(l *layerGGML) int {
+		if i := slices.Index(layerOrder, l.MediaType); i >= 0 {
+			return i
+		}
+
+		return len(layerOrder)
+	}
+
+	slices.SortStableFunc(layers, func(a, b *layerGGML) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+
+	return layers
+}
+
+// modelSummary describes the primary model found in a set of parsed layers.
+type modelSummary struct {
+	Format         string
+	Architecture   string
+	ParameterCount uint64
+	FileType       string
+}
+
+// summarizeLayers returns a summary of the model layer in layers. If there is
+// no model layer, the first layer with GGML metadata is used instead.
+func summarizeLayers(layers []*layerGGML) (s modelSummary) {
+	i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+		return l.GGML != nil && l.MediaType == "application/vnd.ollama.image.model"
+	})
+	if i < 0 {
+		i = slices.IndexFunc(layers, func(l *layerGGML) bool { return l.GGML != nil })
+	}
+	if i < 0 {
+		return s
+	}
+
+	kv := layers[i].KV()
+	return modelSummary{
+		Format:         layers[i].Name(),
+		Architecture:   kv.Architecture(),
+		ParameterCount: kv.ParameterCount(),
+		FileType:       layers[i].FileType().String(),
+	}
+}
+
+// projectorEmbeddingLength returns the length of the embeddings produced by
+// projector f or 0 if it can't be determined from its tensors.
+func projectorEmbeddingLength(f *ggml.GGML) uint64 {
+	// llava style MLP projectors end with mm.2
+	for _, t := range f.Tensors().Items("mm.2.") {
+		if t.Name == "mm.2.bias" && len(t.Shape) > 0 {
+			return t.Shape[0]
+		}
+	}
+
+	return 0
+}
+
+// checkProjectors returns an error if a projector in layers produces
+// embeddings of a different length than the model's.
+func checkProjectors(layers []*layerGGML) error {
+	i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+		return l.GGML != nil && l.MediaType == "application/vnd.ollama.image.model"
+	})
+	if i < 0 {
+		return nil
+	}
+
+	want := layers[i].KV().EmbeddingLength()
+	if want == 0 {
+		return nil
+	}
+
+	for _, layer := range layers {
+		if layer.GGML == nil || layer.MediaType != "application/vnd.ollama.image.projector" {
+			continue
+		}
+
+		if got := projectorEmbeddingLength(layer.GGML); got != 0 && got != want {
+			return fmt.Errorf("%w: projector embedding length %d does not match model embedding length %d", errIncompatibleProjector, got, want)
+		}
+	}
+
+	return nil
+}
+
 func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	return parseFromModelFunc(ctx, name, nil, fn)
+}
+
+// parseFromModelFunc is like parseFromModel but only decodes the GGML layers
+// for which match returns true. Other layers are returned without a decoded
+// GGML. A nil match decodes every layer. The base model of an adapter is
+// always decoded in full since it's needed to check compatibility.
+func parseFromModelFunc(ctx context.Context, name model.Name, match func(Layer) bool, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
+	return parseModel(ctx, name, match, nil, fn)
+}
+
+// parseFromModelPartial is like parseFromModel but doesn't fail if a GGML
+// layer can't be decoded or an adapter or projector doesn't match its model.
+// Such layers are kept without their GGML and their errors are returned in
+// failed, keyed by digest, so that a partially corrupt model can still be
+// inspected. Layers are decoded with their arrays in full.
+func parseFromModelPartial(ctx context.Context, name model.Name, fn func(api.ProgressResponse)) (layers []*layerGGML, failed map[string]error, err error) {
+	failed = make(map[string]error)
+	layers, err = parseModel(ctx, name, nil, failed, fn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return layers, failed, nil
+}
+
+// parseModel implements parseFromModelFunc. If failed is non-nil, it
+// implements parseFromModelPartial instead.
+func parseModel(ctx context.Context, name model.Name, match func(Layer) bool, failed map[string]error, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	m, err := ParseNamedManifest(name)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
-		if err := PullModel(ctx, name.String(), &registryOptions{}, fn); err != nil {
+		if pullDisabled(ctx) {
+			return nil, fmt.Errorf("model %s not found locally: %w", name.DisplayShortest(), err)
+		}
+
+		if err := PullModel(ctx, name.String(), registryOptionsFromContext(ctx), fn); err != nil {
 			return nil, err
 		}
 
@@ -44,42 +211,203 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	}
 
 	for _, layer := range m.Layers {
-		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
+		layer, err := newLayerFromManifestLayer(layer, name.DisplayShortest())
 		if err != nil {
 			return nil, err
 		}
 
+		layers = append(layers, &layerGGML{layer, nil})
+	}
+
+	maxArraySize := 0
+	if failed != nil {
+		maxArraySize = -1
+	}
+
+	// report adds err to failed for each of the layers of mediaType, or
+	// returns it if errors aren't being collected
+	report := func(err error, mediaType string) error {
+		if failed == nil {
+			return err
+		}
+
+		for _, l := range layers {
+			if l.MediaType == mediaType {
+				l.GGML = nil
+				failed[l.Digest] = err
+			}
+		}
+		return nil
+	}
+
+	// decode the GGML layers in parallel, each into its own element of layers
+	var g errgroup.Group
+	var mu sync.Mutex
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for _, layer := range layers {
+		if match != nil && !match(layer.Layer) {
+			continue
+		}
+
 		switch layer.MediaType {
 		case "application/vnd.ollama.image.model",
 			"application/vnd.ollama.image.projector",
 			"application/vnd.ollama.image.adapter":
-			blobpath, err := GetBlobsPath(layer.Digest)
-			if err != nil {
-				return nil, err
-			}
+			g.Go(func() (err error) {
+				layer.GGML, err = decodeLayer(layer.Layer, maxArraySize)
+				if err != nil && failed != nil {
+					mu.Lock()
+					defer mu.Unlock()
+					failed[layer.Digest] = err
+					return nil
+				}
+				return err
+			})
+		}
+	}
 
-			blob, err := os.Open(blobpath)
-			if err != nil {
-				return nil, err
-			}
-			defer blob.Close()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range layers {
+		if l.GGML != nil && isLaterSplit(l.GGML) {
+			l.GGML = nil
+		}
+	}
 
-			f, _, err := ggml.Decode(blob, 0)
+	if i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+		return l.MediaType == "application/vnd.ollama.image.adapter" && l.Base != ""
+	}); i >= 0 {
+		base := model.ParseName(layers[i].Base)
+		if i := slices.IndexFunc(layers, func(l *layerGGML) bool {
+			return l.MediaType == "application/vnd.ollama.image.model"
+		}); i >= 0 {
+			// a model created from an adapter model has a copy of the base
+			// model so the adapters are checked against that copy
+			if layers[i].GGML != nil {
+				if err := checkAdapters(name, base, layers[i].KV().Architecture(), layers); err != nil {
+					if err := report(err, "application/vnd.ollama.image.adapter"); err != nil {
+						return nil, err
+					}
+				}
+			}
+		} else {
+			baseLayers, err := parseAdapterBase(ctx, name, base, layers, fn)
 			if err != nil {
-				return nil, err
+				if err := report(err, "application/vnd.ollama.image.adapter"); err != nil {
+					return nil, err
+				}
 			}
 
-			layers = append(layers, &layerGGML{layer, f})
-		default:
-			layers = append(layers, &layerGGML{layer, nil})
+			layers = append(baseLayers, layers...)
+		}
+	}
+
+	if err := checkProjectors(layers); err != nil {
+		if err := report(fmt.Errorf("%s: %w", name.DisplayShortest(), err), "application/vnd.ollama.image.projector"); err != nil {
+			return nil, err
+		}
+	}
+
+	return sortLayers(layers), nil
+}
+
+// isLaterSplit reports whether f is a split of a split model other than the
+// first. Only the first split has the metadata of the model, so the others
+// are kept as layers without their GGML.
+func isLaterSplit(f *ggml.GGML) bool {
+	no, _ := f.KV()["split.no"].(uint16)
+	return no > 0
+}
+
+// decodeLayer decodes the GGML metadata of layer, verifying its blob first if
+// OLLAMA_VERIFY_BLOBS is set. maxArraySize is as for ggml.Decode.
+func decodeLayer(layer Layer, maxArraySize int) (*ggml.GGML, error) {
+	if envconfig.VerifyBlobs() {
+		if err := verifyBlob(layer.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	blobpath, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := os.Open(blobpath)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	f, _, err := ggml.Decode(blob, maxArraySize)
+	return f, err
+}
+
+// maxBaseDepth limits how many base models an adapter's base model can in
+// turn depend on.
+const maxBaseDepth = 8
+
+// baseChainKey is the context key of the adapters whose base models are being
+// parsed, so that a base model that depends on one of them is caught.
+type baseChainKey struct{}
+
+// parseAdapterBase parses the base model declared by the adapter model name
+// and checks that each adapter in layers is compatible with it.
+func parseAdapterBase(ctx context.Context, name, base model.Name, layers []*layerGGML, fn func(api.ProgressResponse)) ([]*layerGGML, error) {
+	if !base.IsValid() || base == name {
+		return nil, fmt.Errorf("adapter %s has invalid base model %q", name.DisplayShortest(), base.DisplayShortest())
+	}
+
+	chain, _ := ctx.Value(baseChainKey{}).([]model.Name)
+	chain = append(slices.Clip(chain), name)
+	if slices.Contains(chain, base) {
+		var names []string
+		for _, n := range append(chain, base) {
+			names = append(names, n.DisplayShortest())
 		}
+		return nil, fmt.Errorf("adapter %s has a cycle of base models: %s", name.DisplayShortest(), strings.Join(names, " -> "))
+	}
+
+	if len(chain) > maxBaseDepth {
+		return nil, fmt.Errorf("adapter %s has more than %d base models", chain[0].DisplayShortest(), maxBaseDepth)
 	}
 
-	return layers, nil
+	baseLayers, err := parseFromModel(context.WithValue(ctx, baseChainKey{}, chain), base, fn)
+	if err != nil {
+		return nil, fmt.Errorf("adapter %s requires base model %s: %w", name.DisplayShortest(), base.DisplayShortest(), err)
+	}
+
+	if err := checkAdapters(name, base, summarizeLayers(baseLayers).Architecture, layers); err != nil {
+		return nil, err
+	}
+
+	return baseLayers, nil
+}
+
+// checkAdapters returns an error if an adapter in layers of the model name
+// doesn't have the architecture arch of its base model.
+func checkAdapters(name, base model.Name, arch string, layers []*layerGGML) error {
+	for _, layer := range layers {
+		if layer.GGML == nil || layer.MediaType != "application/vnd.ollama.image.adapter" {
+			continue
+		}
+
+		if got := layer.KV().Architecture(); got != arch {
+			return fmt.Errorf("adapter %s is incompatible with base model %s: adapter architecture %s does not match %s", name.DisplayShortest(), base.DisplayShortest(), got, arch)
+		}
+	}
+
+	return nil
 }
 
 func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
 	for _, layer := range layers {
+		if layer.GGML == nil {
+			continue
+		}
+
 		if s := layer.GGML.KV().ChatTemplate(); s != "" {
 			if t, err := template.Named(s); err != nil {
 				slog.Debug("template detection", "error", err, "template", s)
@@ -109,7 +437,7 @@ func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
 		}
 	}
 
-	return layers, nil
+	return sortLayers(layers), nil
 }
 
 func detectContentType(r io.Reader) (string, error) {
@@ -122,6 +450,10 @@ func detectContentType(r io.Reader) (string, error) {
 		return contentType, nil
 	}
 
+	if bytes.HasPrefix(b.Bytes(), []byte{0x1f, 0x8b}) {
+		return "gzip", nil
+	}
+
 	if contentType := http.DetectContentType(b.Bytes()); contentType != "application/octet-stream" {
 		return contentType, nil
 	}
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/types/model"
 )
 
 func readFile(t *testing.T, base, name string) *bytes.Buffer {
@@ -177,3 +184,524 @@ func TestParseObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestSummarizeLayers(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var layers []*layerGGML
+	for _, kv := range []ggml.KV{
+		{"general.architecture": "clip", "general.type": "projector"},
+		{"general.architecture": "llama", "general.file_type": uint32(1)},
+	} {
+		_, digest := createBinFile(t, kv, []ggml.Tensor{
+			{Name: "blk.0.attn_q.weight", Kind: 1, Shape: []uint64{4, 4}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		})
+
+		ls, err := ggufLayers(digest, false, func(api.ProgressResponse) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers = append(layers, ls...)
+	}
+
+	expect := modelSummary{
+		Format:         "gguf",
+		Architecture:   "llama",
+		ParameterCount: 16,
+		FileType:       "F16",
+	}
+
+	if diff := cmp.Diff(expect, summarizeLayers(layers)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(modelSummary{}, summarizeLayers(nil)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFromModelAdapterBase(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+	baseLayers, err := ggufLayers(digest, false, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var layers []Layer
+	for _, layer := range baseLayers {
+		layers = append(layers, layer.Layer)
+	}
+
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest(model.ParseName("base"), *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	// createAdapter writes a manifest containing only an adapter layer that
+	// declares base as its base model
+	createAdapter := func(t *testing.T, name, arch, base string) model.Name {
+		t.Helper()
+
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": arch, "general.type": "adapter"}, nil)
+		adapterLayers, err := ggufLayers(digest, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := adapterLayers[0].Layer
+		adapter.Base = model.ParseName(base).String()
+
+		layers := []Layer{adapter}
+		config, err := createConfigLayer(layers, ConfigV2{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := model.ParseName(name)
+		if err := WriteManifest(n, *config, layers); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	t.Run("compatible", func(t *testing.T) {
+		layers, err := parseFromModel(t.Context(), createAdapter(t, "adapter", "llama", "base"), fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+
+		if diff := cmp.Diff([]string{
+			"application/vnd.ollama.image.model",
+			"application/vnd.ollama.image.adapter",
+		}, mediatypes); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		_, err := parseFromModel(t.Context(), createAdapter(t, "adapter-gemma2", "gemma2", "base"), fn)
+		if err == nil || !strings.Contains(err.Error(), "adapter adapter-gemma2:latest is incompatible with base model base:latest") {
+			t.Errorf("expected incompatible base error, got %v", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := parseFromModel(t.Context(), createAdapter(t, "adapter-missing", "llama", "127.0.0.1:1/library/missing"), fn)
+		if err == nil || !strings.Contains(err.Error(), "adapter adapter-missing:latest requires base model 127.0.0.1:1/library/missing:latest") {
+			t.Errorf("expected missing base error, got %v", err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		createAdapter(t, "cycle-b", "llama", "cycle-a")
+		_, err := parseFromModel(t.Context(), createAdapter(t, "cycle-a", "llama", "cycle-b"), fn)
+		if err == nil || !strings.Contains(err.Error(), "cycle of base models: cycle-a:latest -> cycle-b:latest -> cycle-a:latest") {
+			t.Errorf("expected cycle error, got %v", err)
+		}
+	})
+
+	t.Run("too deep", func(t *testing.T) {
+		base := "base"
+		for i := range maxBaseDepth + 1 {
+			base = createAdapter(t, fmt.Sprintf("deep-%d", i), "llama", base).String()
+		}
+
+		_, err := parseFromModel(t.Context(), model.ParseName(base), fn)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("more than %d base models", maxBaseDepth)) {
+			t.Errorf("expected depth error, got %v", err)
+		}
+	})
+
+	// models created from an adapter model include its base model
+	createBundled := func(t *testing.T, name, arch string) model.Name {
+		t.Helper()
+
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": arch, "general.type": "adapter"}, nil)
+		adapterLayers, err := ggufLayers(digest, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := adapterLayers[0].Layer
+		adapter.Base = model.ParseName("base").String()
+
+		bundled := append(append([]Layer{}, layers...), adapter)
+		config, err := createConfigLayer(bundled, ConfigV2{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := model.ParseName(name)
+		if err := WriteManifest(n, *config, bundled); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	t.Run("bundled", func(t *testing.T) {
+		got, err := parseFromModel(t.Context(), createBundled(t, "bundled", "llama"), fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 2 {
+			t.Errorf("expected the model and adapter layers, got %d layers", len(got))
+		}
+	})
+
+	t.Run("bundled incompatible", func(t *testing.T) {
+		_, err := parseFromModel(t.Context(), createBundled(t, "bundled-gemma2", "gemma2"), fn)
+		if err == nil || !strings.Contains(err.Error(), "adapter bundled-gemma2:latest is incompatible with base model base:latest") {
+			t.Errorf("expected incompatible base error, got %v", err)
+		}
+	})
+}
+
+func TestParseFromModelExistingBlobs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+	modelLayers, err := ggufLayers(digest, false, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var layers []Layer
+	for _, layer := range modelLayers {
+		layers = append(layers, layer.Layer)
+	}
+
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := model.ParseName("existing")
+	if err := WriteManifest(name, *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseFromModel(t.Context(), name, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(got))
+	}
+
+	if diff := cmp.Diff(Layer{
+		MediaType: layers[0].MediaType,
+		Digest:    layers[0].Digest,
+		Size:      layers[0].Size,
+		From:      name.DisplayShortest(),
+	}, got[0].Layer, cmpopts.IgnoreUnexported(Layer{})); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// a blob that no longer matches its manifest size is not reused
+	blob, err := GetBlobsPath(layers[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(blob, layers[0].Size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseFromModel(t.Context(), name, fn); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("expected %d", layers[0].Size)) {
+		t.Errorf("expected size mismatch error, got %v", err)
+	}
+}
+
+func TestParseFromModelPartial(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+	modelLayers, err := ggufLayers(digest, false, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projector, err := NewLayer(strings.NewReader("not a gguf file"), "application/vnd.ollama.image.projector")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers := []Layer{modelLayers[0].Layer, projector}
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := model.ParseName("partial")
+	if err := WriteManifest(name, *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseFromModel(t.Context(), name, fn); err == nil {
+		t.Fatal("expected error decoding projector")
+	}
+
+	got, failed, err := parseFromModelPartial(t.Context(), name, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the projector is kept without its GGML
+	if len(got) != 2 {
+		t.Fatalf("expected model and projector layers, got %v", got)
+	}
+
+	for _, l := range got {
+		if decoded := l.GGML != nil; decoded != (l.Digest == modelLayers[0].Digest) {
+			t.Errorf("expected only the model layer to be decoded, got %s decoded %t", l.MediaType, decoded)
+		}
+	}
+
+	if len(failed) != 1 || failed[projector.Digest] == nil {
+		t.Errorf("expected projector %s to fail, got %v", projector.Digest, failed)
+	}
+}
+
+func TestParseFromModelFunc(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	var layers []Layer
+	for _, kv := range []ggml.KV{
+		{"general.architecture": "llama"},
+		{"general.architecture": "clip", "general.type": "projector"},
+	} {
+		_, digest := createBinFile(t, kv, nil)
+		ls, err := ggufLayers(digest, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, layer := range ls {
+			layers = append(layers, layer.Layer)
+		}
+	}
+
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := model.ParseName("multimodal")
+	if err := WriteManifest(name, *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := func(layers []*layerGGML) map[string]bool {
+		m := make(map[string]bool)
+		for _, layer := range layers {
+			m[layer.MediaType] = layer.GGML != nil
+		}
+		return m
+	}
+
+	cases := []struct {
+		name  string
+		match func(Layer) bool
+		want  map[string]bool
+	}{
+		{
+			name: "all",
+			want: map[string]bool{"application/vnd.ollama.image.model": true, "application/vnd.ollama.image.projector": true},
+		},
+		{
+			name:  "media type",
+			match: func(l Layer) bool { return l.MediaType == "application/vnd.ollama.image.projector" },
+			want:  map[string]bool{"application/vnd.ollama.image.model": false, "application/vnd.ollama.image.projector": true},
+		},
+		{
+			name:  "digest",
+			match: func(l Layer) bool { return l.Digest == layers[0].Digest },
+			want:  map[string]bool{"application/vnd.ollama.image.model": true, "application/vnd.ollama.image.projector": false},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFromModelFunc(t.Context(), name, tt.match, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, decoded(got)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseFromModelParallel(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	kvs := []ggml.KV{{"general.architecture": "llama", "general.name": "model"}}
+	for i := range 8 {
+		kvs = append(kvs, ggml.KV{"general.architecture": "clip", "general.type": "projector", "general.name": fmt.Sprintf("projector%d", i)})
+	}
+
+	var layers []Layer
+	for _, kv := range kvs {
+		_, digest := createBinFile(t, kv, nil)
+		ls, err := ggufLayers(digest, false, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, layer := range ls {
+			layers = append(layers, layer.Layer)
+		}
+
+		system, err := NewLayer(strings.NewReader(kv.String("general.name")), "application/vnd.ollama.image.system")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers = append(layers, system)
+	}
+
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := model.ParseName("parallel")
+	if err := WriteManifest(name, *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseFromModel(t.Context(), name, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, layer := range got {
+		if layer.MediaType == "application/vnd.ollama.image.system" {
+			if layer.GGML != nil {
+				t.Errorf("unexpected GGML for %s layer", layer.MediaType)
+			}
+			continue
+		}
+
+		if layer.GGML == nil {
+			t.Fatalf("expected GGML for %s layer", layer.MediaType)
+		}
+
+		names = append(names, layer.KV().String("general.name"))
+	}
+
+	var want []string
+	for _, kv := range kvs {
+		want = append(want, kv.String("general.name"))
+	}
+
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFromModelRegistryOptions(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var paths, headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		headers = append(headers, r.Header.Get("X-Test"))
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	mirror, err := url.Parse(srv.URL + "/mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withRegistryOptions(t.Context(), &registryOptions{
+		Headers: http.Header{"X-Test": []string{"value"}},
+		Mirrors: map[string]*url.URL{"registry.invalid": mirror},
+	})
+
+	if _, err := parseFromModel(ctx, model.ParseName("registry.invalid/library/missing"), func(api.ProgressResponse) {}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if diff := cmp.Diff([]string{"/mirror/v2/library/missing/manifests/latest"}, paths); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"value"}, headers); diff != "" {
+		t.Errorf("unexpected headers (-want +got):\n%s", diff)
+	}
+}
+
+func TestSortLayers(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fn := func(api.ProgressResponse) {}
+
+	// a projector followed by a model with a known chat template in one file
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, ggml.KV{"general.architecture": "clip", "general.type": "projector"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ggml.WriteGGUF(&b, ggml.KV{
+		"general.architecture":    "llama",
+		"tokenizer.chat_template": "{{ bos_token }}{% for message in messages %}{{'<|' + message['role'] + '|>' + '\n' + message['content'] + '<|end|>\n' }}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := NewLayer(&b, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := ggufLayers(layer.Digest, false, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mediatypes []string
+	for _, layer := range layers {
+		mediatypes = append(mediatypes, layer.MediaType)
+	}
+
+	if diff := cmp.Diff([]string{
+		"application/vnd.ollama.image.model",
+		"application/vnd.ollama.image.projector",
+		"application/vnd.ollama.image.template",
+		"application/vnd.ollama.image.params",
+	}, mediatypes); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -590,9 +590,7 @@ func (s *Server) PullHandler(c *gin.Context) {
 			ch <- r
 		}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
-		}
+		regOpts := newRegistryOptions(req.Insecure)
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
@@ -639,9 +637,9 @@ func (s *Server) PushHandler(c *gin.Context) {
 			ch <- r
 		}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
-		}
+		// mirrors are only pulled from
+		regOpts := newRegistryOptions(req.Insecure)
+		regOpts.Mirrors = nil
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
@@ -784,11 +782,17 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		return nil, err
 	}
 
-	m, err := GetModel(name.String())
+	m, err := getModel(name.String())
 	if err != nil {
 		return nil, err
 	}
 
+	// the verbose request reports a missing base model as an error of the
+	// adapters
+	if err := m.resolveBase(0); err != nil && !req.Verbose {
+		return nil, err
+	}
+
 	modelDetails := api.ModelDetails{
 		ParentModel:       m.ParentModel,
 		Format:            m.Config.ModelFormat,
@@ -848,27 +852,70 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	fmt.Fprint(&sb, m.String())
 	resp.Modelfile = sb.String()
 
-	kvData, tensors, err := getModelData(m.ModelPath, req.Verbose)
-	if err != nil {
-		return nil, err
+	// verbose requests report the layers that can't be decoded and show
+	// what's left of the model instead of failing. The layers are decoded in
+	// full so they're used instead of decoding the model again.
+	decoded := make(map[string]*layerGGML)
+	if req.Verbose {
+		layers, errs, err := parseFromModelPartial(withoutPull(context.Background()), name, func(api.ProgressResponse) {})
+		if err != nil {
+			return nil, err
+		}
+
+		for digest, err := range errs {
+			if resp.LayerErrors == nil {
+				resp.LayerErrors = make(map[string]string)
+			}
+			resp.LayerErrors[digest] = err.Error()
+		}
+
+		for _, layer := range layers {
+			if p, err := GetBlobsPath(layer.Digest); err == nil {
+				decoded[p] = layer
+			}
+		}
 	}
 
-	delete(kvData, "general.name")
-	delete(kvData, "tokenizer.chat_template")
-	resp.ModelInfo = kvData
+	// modelData returns the metadata and tensors of the model file at p, or
+	// false if a verbose request found it missing or undecodable
+	modelData := func(p string) (ggml.KV, ggml.Tensors, bool, error) {
+		if layer, ok := decoded[p]; ok {
+			if layer.GGML == nil {
+				return nil, ggml.Tensors{}, false, nil
+			}
+
+			return layer.KV(), layer.Tensors(), true, nil
+		} else if req.Verbose && p == "" {
+			// an adapter without its base model
+			return nil, ggml.Tensors{}, false, nil
+		}
+
+		kv, tensors, err := getModelData(p, req.Verbose)
+		return kv, tensors, err == nil, err
+	}
 
-	tensorData := make([]api.Tensor, len(tensors.Items()))
-	for cnt, t := range tensors.Items() {
-		tensorData[cnt] = api.Tensor{Name: t.Name, Type: t.Type(), Shape: t.Shape}
+	kvData, tensors, ok, err := modelData(m.ModelPath)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		delete(kvData, "general.name")
+		delete(kvData, "tokenizer.chat_template")
+		resp.ModelInfo = kvData
+
+		tensorData := make([]api.Tensor, len(tensors.Items()))
+		for cnt, t := range tensors.Items() {
+			tensorData[cnt] = api.Tensor{Name: t.Name, Type: t.Type(), Shape: t.Shape}
+		}
+		resp.Tensors = tensorData
 	}
-	resp.Tensors = tensorData
 
 	if len(m.ProjectorPaths) > 0 {
-		projectorData, _, err := getModelData(m.ProjectorPaths[0], req.Verbose)
+		projectorData, _, ok, err := modelData(m.ProjectorPaths[0])
 		if err != nil {
 			return nil, err
+		} else if ok {
+			resp.ProjectorInfo = projectorData
 		}
-		resp.ProjectorInfo = projectorData
 	}
 
 	return resp, nil
@@ -1002,7 +1049,7 @@ func (s *Server) HeadBlobHandler(c *gin.Context) {
 }
 
 func (s *Server) CreateBlobHandler(c *gin.Context) {
-	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
+	if ib, ok := intermediateBlob(c.Param("digest")); ok {
 		p, err := GetBlobsPath(ib)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1011,7 +1058,7 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 
 		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
 			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
-			delete(intermediateBlobs, c.Param("digest"))
+			deleteIntermediateBlob(c.Param("digest"))
 		} else if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1184,6 +1231,7 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 	r.HEAD("/api/tags", s.ListHandler)
 	r.GET("/api/tags", s.ListHandler)
 	r.POST("/api/show", s.ShowHandler)
+	r.POST("/api/diff", s.DiffHandler)
 	r.DELETE("/api/delete", s.DeleteHandler)
 
 	// Create
@@ -1251,6 +1299,11 @@ func Serve(ln net.Listener) error {
 		return err
 	}
 
+	// custom templates are detected alongside the built-in ones when importing
+	if err := template.RegisterDir(envconfig.Templates()); err != nil {
+		slog.Warn("couldn't load custom templates", "path", envconfig.Templates(), "error", err)
+	}
+
 	if !envconfig.NoPrune() {
 		if _, err := Manifests(false); err != nil {
 			slog.Warn("corrupt manifests detected, skipping prune operation.  Re-pull or delete to clear", "error", err)
@@ -1269,6 +1322,8 @@ func Serve(ln net.Listener) error {
 				return err
 			}
 		}
+
+		pruneUnpacked()
 	}
 
 	s := &Server{addr: ln.Addr()}
@@ -1350,7 +1405,11 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 				status = http.StatusInternalServerError
 			}
 			if errorMsg, ok := r["error"].(string); ok {
-				c.JSON(status, gin.H{"error": errorMsg})
+				h := gin.H{"error": errorMsg}
+				if code, ok := r["code"].(string); ok {
+					h["code"] = code
+				}
+				c.JSON(status, h)
 				return
 			} else {
 				c.JSON(status, gin.H{"error": "unexpected error format in progress response"})
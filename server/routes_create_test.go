@@ -3,8 +3,11 @@ package server
 import (
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,6 +16,7 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -20,6 +24,8 @@ import (
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
 )
 
 var stream bool = false
@@ -136,6 +142,103 @@ func TestCreateFromBin(t *testing.T) {
 	})
 }
 
+func TestCreateFromGzip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+
+	name, _ := createBinFile(t, nil, nil)
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(bts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := NewLayer(&b, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf.gz": layer.Digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Layers) != 1 {
+		t.Fatalf("expected 1 layer, actual %d", len(m.Layers))
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(bts)); m.Layers[0].Digest != digest {
+		t.Errorf("expected decompressed digest %s, actual %s", digest, m.Layers[0].Digest)
+	}
+}
+
+func TestCreateFromGzipTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_MAX_UNPACKED_SIZE", "16")
+
+	var s Server
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := NewLayer(&b, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf.gz": layer.Digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "exceeds limit of 16 bytes") {
+		t.Errorf("expected size limit error, actual %s", w.Body.String())
+	}
+
+	// only the compressed blob remains
+	checkFileExists(t, filepath.Join(p, "blobs", "*"), []string{
+		filepath.Join(p, "blobs", strings.Replace(layer.Digest, ":", "-", 1)),
+	})
+}
+
 func TestCreateFromModel(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -180,6 +283,76 @@ func TestCreateFromModel(t *testing.T) {
 	})
 }
 
+func TestCreateFromModelVerifyBlobs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	name, digest := createBinFile(t, ggml.KV{"general.name": "test"}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	// corrupt the blob in a way that still decodes by changing the last
+	// byte of the general.name value
+	f, err := os.OpenFile(name, os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte{'x'}, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_VERIFY_BLOBS", "")
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test2",
+			From:   "test",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_VERIFY_BLOBS", "1")
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test3",
+			From:   "test",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code 500, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "digest mismatch") {
+			t.Errorf("expected digest mismatch error, actual %s", w.Body.String())
+		}
+	})
+}
+
 func TestCreateRemovesLayers(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -693,6 +866,84 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 
+	t.Run("custom template", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		_, digest := createBinFile(t, ggml.KV{
+			"tokenizer.chat_template": "{{ bos_token }}{% for message in messages %}{{'<|' + message['role'] + '|>' + '\n' + message['content'] + '<|end|>\n' }}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}",
+		}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:     "test-custom",
+			Files:    map[string]string{"test.gguf": digest},
+			Template: "{{ .Prompt }}",
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test-custom"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range m.Layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+
+		if want := []string{
+			"application/vnd.ollama.image.model",
+			"application/vnd.ollama.image.template",
+		}; !slices.Equal(want, mediatypes) {
+			t.Errorf("expected layers %v, actual %v", want, mediatypes)
+		}
+
+		tmpl, err := GetBlobsPath(m.Layers[1].Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bts, err := os.ReadFile(tmpl); err != nil {
+			t.Fatal(err)
+		} else if string(bts) != "{{ .Prompt }}" {
+			t.Errorf("expected custom template, got %q", bts)
+		}
+	})
+
+	t.Run("no template", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		_, digest := createBinFile(t, ggml.KV{
+			"tokenizer.chat_template": "{{ bos_token }}{% for message in messages %}{{'<|' + message['role'] + '|>' + '\n' + message['content'] + '<|end|>\n' }}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}",
+		}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:       "test-no-template",
+			Files:      map[string]string{"test.gguf": digest},
+			NoTemplate: true,
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test-no-template"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range m.Layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+
+		if want := []string{"application/vnd.ollama.image.model"}; !slices.Equal(want, mediatypes) {
+			t.Errorf("expected layers %v, actual %v", want, mediatypes)
+		}
+	})
+
 	t.Run("unmatched", func(t *testing.T) {
 		_, digest := createBinFile(t, nil, nil)
 		w := createRequest(t, s.CreateHandler, api.CreateRequest{
@@ -748,6 +999,17 @@ func TestDetectModelTypeFromFiles(t *testing.T) {
 		}
 	})
 
+	t.Run("onnx file", func(t *testing.T) {
+		files := map[string]string{
+			"model.onnx": "sha256:abc123",
+		}
+
+		modelType := detectModelTypeFromFiles(files)
+		if modelType != "onnx" {
+			t.Fatalf("expected model type 'onnx', got %q", modelType)
+		}
+	})
+
 	t.Run("unsupported file type", func(t *testing.T) {
 		p := t.TempDir()
 		t.Setenv("OLLAMA_MODELS", p)
@@ -808,3 +1070,918 @@ func TestDetectModelTypeFromFiles(t *testing.T) {
 		}
 	})
 }
+
+func TestCreateConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	var digests []string
+	for i := range 4 {
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama", "general.name": fmt.Sprintf("model-%d", i)}, nil)
+		digests = append(digests, digest)
+
+		// some intermediate blobs no longer exist so they're evicted
+		setIntermediateBlob(fmt.Sprintf("sha256:%064x", i), fmt.Sprintf("sha256:%064x", i+100))
+	}
+
+	var wg sync.WaitGroup
+	for i, digest := range digests {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			var b bytes.Buffer
+			if err := json.NewEncoder(&b).Encode(api.CreateRequest{
+				Name:   fmt.Sprintf("test-%d", i),
+				Files:  map[string]string{"test.gguf": digest},
+				Stream: &stream,
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/create", &b)
+			s.CreateHandler(c)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "digest", Value: fmt.Sprintf("sha256:%064x", i)}}
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/blobs/"+c.Param("digest"), strings.NewReader(""))
+			s.CreateBlobHandler(c)
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range digests {
+		if _, ok := intermediateBlob(fmt.Sprintf("sha256:%064x", i)); ok {
+			t.Errorf("expected intermediate blob %d to be evicted", i)
+		}
+	}
+}
+
+func TestCreateUnsupportedArchitecture(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "unknownarch"}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "unsupported_architecture") {
+		t.Errorf("expected unsupported architecture error, got %s", w.Body.String())
+	}
+
+	t.Setenv("OLLAMA_FORCE_IMPORT", "1")
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCreateIncompatibleProjector(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	_, model := createBinFile(t, ggml.KV{"general.architecture": "llama", "llama.embedding_length": uint32(16)}, nil)
+
+	projector := func(n uint64) string {
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "clip", "general.type": "projector"}, []ggml.Tensor{
+			{Name: "mm.2.bias", Kind: 0, Shape: []uint64{n}, WriterTo: bytes.NewReader(make([]byte, 4*n))},
+		})
+		return digest
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"model.gguf": model, "projector.gguf": projector(32)},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "projector embedding length 32 does not match model embedding length 16") {
+		t.Errorf("expected incompatible projector error, got %s", w.Body.String())
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"model.gguf": model, "projector.gguf": projector(16)},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCreateFromURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	p, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, p)
+	}))
+	defer srv.Close()
+
+	// the file is only available from the server
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	var s Server
+
+	// downloading is disabled by default
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": srv.URL + "/test.gguf"},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	allowLoopbackFetch(t)
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": srv.URL + "/test.gguf"},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(blob); err != nil {
+		t.Errorf("expected downloaded blob: %v", err)
+	}
+}
+
+func TestCreateAdapterFromFiles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.attention.head_count":    uint32(2),
+		"llama.attention.head_count_kv": uint32(2),
+	}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "base",
+		Files:  map[string]string{"base.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	blob := func(content []byte) string {
+		l, err := NewLayer(bytes.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Digest
+	}
+
+	header := `{"base_model.model.model.layers.0.self_attn.v_proj.lora_A.weight": {"dtype": "F32", "shape": [2, 4], "data_offsets": [0, 32]}}`
+	var st bytes.Buffer
+	if err := binary.Write(&st, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+	st.WriteString(header)
+	st.Write(make([]byte, 32))
+
+	files := map[string]string{
+		"adapter_config.json":       blob([]byte(`{"r": 8, "lora_alpha": 16}`)),
+		"adapter_model.safetensors": blob(st.Bytes()),
+	}
+
+	t.Run("without base", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), errAdapterWithoutBase.Error()) {
+			t.Errorf("expected adapter without base error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("with base", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test",
+			From:   "base",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := slices.IndexFunc(m.Layers, func(l Layer) bool {
+			return l.MediaType == "application/vnd.ollama.image.adapter"
+		})
+		if i < 0 {
+			t.Fatalf("expected an adapter layer, got %v", m.Layers)
+		}
+
+		f, err := m.Layers[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		g, _, err := ggml.Decode(f, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv := g.KV()
+		if rank := kv["adapter.lora.rank"]; rank != uint32(8) {
+			t.Errorf("expected rank 8, got %v", rank)
+		}
+
+		if alpha := kv["adapter.lora.alpha"]; alpha != float32(16) {
+			t.Errorf("expected alpha 16, got %v", alpha)
+		}
+
+		// the adapter refers to its base model instead of copying it
+		if base := m.Layers[i].Base; base != model.ParseName("base").String() {
+			t.Errorf("expected the adapter to have base model base, got %q", base)
+		}
+
+		if slices.ContainsFunc(m.Layers, func(l Layer) bool {
+			return l.MediaType == "application/vnd.ollama.image.model"
+		}) {
+			t.Errorf("expected no model layer, got %v", m.Layers)
+		}
+
+		base, err := GetModel("base")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ModelPath != base.ModelPath {
+			t.Errorf("expected model path %s, got %s", base.ModelPath, got.ModelPath)
+		}
+
+		if len(got.AdapterPaths) != 1 {
+			t.Errorf("expected one adapter, got %v", got.AdapterPaths)
+		}
+
+		layers, err := parseFromModel(t.Context(), model.ParseName("test"), func(api.ProgressResponse) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+		}
+
+		if !slices.Contains(mediatypes, "application/vnd.ollama.image.model") || !slices.Contains(mediatypes, "application/vnd.ollama.image.adapter") {
+			t.Errorf("expected the base model and adapter layers, got %v", mediatypes)
+		}
+	})
+
+	t.Run("gguf", func(t *testing.T) {
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama", "general.type": "adapter"}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:     "test-gguf",
+			From:     "base",
+			Adapters: map[string]string{"adapter.gguf": digest},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test-gguf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mediatypes []string
+		for _, layer := range m.Layers {
+			mediatypes = append(mediatypes, layer.MediaType)
+			if layer.MediaType == "application/vnd.ollama.image.adapter" && layer.Base != model.ParseName("base").String() {
+				t.Errorf("expected the adapter to have base model base, got %q", layer.Base)
+			}
+		}
+
+		if !slices.Equal(mediatypes, []string{"application/vnd.ollama.image.adapter"}) {
+			t.Errorf("expected only the adapter layer, got %v", mediatypes)
+		}
+	})
+}
+
+func TestCreateTooManyFiles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	t.Setenv("OLLAMA_MAX_MODEL_FILES", "2")
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:     "test",
+		Files:    map[string]string{"a.gguf": digest, "b.gguf": digest},
+		Adapters: map[string]string{"adapter.gguf": digest},
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "too many files: 3 exceeds the limit of 2") {
+		t.Errorf("expected too many files error, got %s", w.Body.String())
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCreateUpdateTokenizer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":  "llama",
+		"tokenizer.ggml.model":  "gpt2",
+		"tokenizer.ggml.tokens": []string{"a", "b", "c"},
+		"llama.rope.sections":   []int32{1, 2},
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 4}, WriterTo: bytes.NewReader(data)},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "base",
+		Files:  map[string]string{"base.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	blob := func(content string) string {
+		l, err := NewLayer(strings.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Digest
+	}
+
+	config, err := json.Marshal(map[string]string{
+		"chat_template": "{{ bos_token }}{% for message in messages %}{{'<|' + message['role'] + '|>' + '\n' + message['content'] + '<|end|>\n' }}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"tokenizer.json":        blob(`{"model": {"type": "BPE", "vocab": {"x": 0, "y": 1}}}`),
+		"tokenizer_config.json": blob(string(config)),
+	}
+
+	t.Run("without base", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("with base", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test",
+			From:   "base",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := slices.IndexFunc(m.Layers, func(l Layer) bool {
+			return l.MediaType == "application/vnd.ollama.image.model"
+		})
+		if i < 0 {
+			t.Fatalf("expected a model layer, got %v", m.Layers)
+		}
+
+		if m.Layers[i].Digest == digest {
+			t.Fatal("expected the model layer to be rewritten")
+		}
+
+		f, err := m.Layers[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		g, _, err := ggml.Decode(f, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv := g.KV()
+		// the vocabulary is padded to the size of the old one
+		if tokens := kv.Strings("tokenizer.ggml.tokens"); !slices.Equal(tokens, []string{"x", "y", "[PAD0]"}) {
+			t.Errorf("unexpected tokens %v", tokens)
+		}
+
+		if sections := kv.Uints("rope.sections"); !slices.Equal(sections, []uint32{1, 2}) {
+			t.Errorf("expected other metadata to be kept, got %v", sections)
+		}
+
+		tensor := g.Tensors().Items()[0]
+		if _, err := f.Seek(int64(g.Tensors().Offset+tensor.Offset), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(f, got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, got) {
+			t.Error("expected tensor data to be unchanged")
+		}
+
+		if !slices.ContainsFunc(m.Layers, func(l Layer) bool {
+			return l.MediaType == "application/vnd.ollama.image.template"
+		}) {
+			t.Errorf("expected a template layer, got %v", m.Layers)
+		}
+	})
+
+	t.Run("gemma base", func(t *testing.T) {
+		_, digest := createBinFile(t, ggml.KV{
+			"general.architecture":        "gemma",
+			"tokenizer.ggml.model":        "llama",
+			"tokenizer.ggml.tokens":       []string{"a", "b", "c"},
+			"tokenizer.ggml.eot_token_id": uint32(107),
+		}, []ggml.Tensor{
+			{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 4}, WriterTo: bytes.NewReader(data)},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "gemma",
+			Files:  map[string]string{"base.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "gemma-tokenizer",
+			From:   "gemma",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("gemma-tokenizer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := slices.IndexFunc(m.Layers, func(l Layer) bool {
+			return l.MediaType == "application/vnd.ollama.image.model"
+		})
+		if i < 0 {
+			t.Fatalf("expected a model layer, got %v", m.Layers)
+		}
+
+		f, err := m.Layers[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		g, _, err := ggml.Decode(f, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// gemma's own tokenizer keys are written again
+		kv := g.KV()
+		for k, v := range map[string]uint32{
+			"tokenizer.ggml.eot_token_id":    107,
+			"tokenizer.ggml.middle_token_id": 68,
+			"tokenizer.ggml.prefix_token_id": 67,
+			"tokenizer.ggml.suffix_token_id": 69,
+		} {
+			if kv[k] != v {
+				t.Errorf("expected %s to be %d, got %v", k, v, kv[k])
+			}
+		}
+	})
+
+	t.Run("base parameters", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:       "base-params",
+			From:       "base",
+			Parameters: map[string]any{"num_ctx": 4096},
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "params-tokenizer",
+			From:   "base-params",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := ParseNamedManifest(model.ParseName("params-tokenizer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var params []map[string]any
+		for _, l := range m.Layers {
+			if l.MediaType != "application/vnd.ollama.image.params" {
+				continue
+			}
+
+			f, err := l.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var p map[string]any
+			if err := json.NewDecoder(f).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			params = append(params, p)
+		}
+
+		if len(params) != 1 {
+			t.Fatalf("expected one params layer, got %v", params)
+		}
+
+		// the base model's parameters are kept alongside those of the
+		// detected template
+		if params[0]["num_ctx"] != float64(4096) {
+			t.Errorf("expected num_ctx to be kept, got %v", params[0])
+		}
+
+		if _, ok := params[0]["stop"]; !ok {
+			t.Errorf("expected the detected template's stop words, got %v", params[0])
+		}
+	})
+
+	t.Run("unsupported base", func(t *testing.T) {
+		_, digest := createBinFile(t, ggml.KV{
+			"general.architecture":  "mamba",
+			"tokenizer.ggml.tokens": []string{"a", "b", "c"},
+		}, nil)
+
+		t.Setenv("OLLAMA_FORCE_IMPORT", "1")
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "mamba",
+			Files:  map[string]string{"base.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "mamba-tokenizer",
+			From:   "mamba",
+			Files:  files,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unsupported architecture") {
+			t.Errorf("expected unsupported architecture error, actual %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestCreateExternalTensorData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	var b bytes.Buffer
+	if err := ggml.WriteGGUF(&b, ggml.KV{"general.architecture": "llama"}, []ggml.Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 3}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 24))},
+		{Name: "output.weight", Kind: 0, Shape: []uint64{3}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 12))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := ggml.Decode(bytes.NewReader(b.Bytes()), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := f.Tensors().Offset
+	blob := func(content []byte) string {
+		l, err := NewLayer(bytes.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Digest
+	}
+
+	want := fmt.Sprintf("sha256:%x", sha256.Sum256(b.Bytes()))
+	meta := blob(b.Bytes()[:offset])
+	data := blob(b.Bytes()[offset:])
+
+	for _, name := range []string{"model.gguf.data", "model.data"} {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.CreateHandler, api.CreateRequest{
+				Name:   "test",
+				Files:  map[string]string{"model.gguf": meta, name: data},
+				Stream: &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+			}
+
+			m, err := ParseNamedManifest(model.ParseName("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.ContainsFunc(m.Layers, func(l Layer) bool {
+				return l.MediaType == "application/vnd.ollama.image.model" && l.Digest == want
+			}) {
+				t.Errorf("expected a model layer with the joined file %s, got %v", want, m.Layers)
+			}
+		})
+	}
+
+	t.Run("truncated data", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "test",
+			Files:  map[string]string{"model.gguf": meta, "model.gguf.data": blob(b.Bytes()[offset : len(b.Bytes())-4])},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "tensor data file is 52 bytes, expected 56") {
+			t.Errorf("expected tensor data size error, got %s", w.Body.String())
+		}
+	})
+}
+
+func TestCreateSplit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	blob := func(content []byte) string {
+		l, err := NewLayer(bytes.NewReader(content), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Digest
+	}
+
+	header := `{
+		"model.embed_tokens.weight": {"dtype": "F32", "shape": [8, 4], "data_offsets": [0, 128]},
+		"model.layers.0.input_layernorm.weight": {"dtype": "F32", "shape": [4], "data_offsets": [128, 144]},
+		"model.layers.0.self_attn.q_proj.weight": {"dtype": "F32", "shape": [4, 4], "data_offsets": [144, 208]},
+		"model.layers.0.self_attn.k_proj.weight": {"dtype": "F32", "shape": [2, 4], "data_offsets": [208, 240]},
+		"model.layers.0.self_attn.v_proj.weight": {"dtype": "F32", "shape": [2, 4], "data_offsets": [240, 272]},
+		"model.layers.0.self_attn.o_proj.weight": {"dtype": "F32", "shape": [4, 4], "data_offsets": [272, 336]},
+		"model.layers.0.post_attention_layernorm.weight": {"dtype": "F32", "shape": [4], "data_offsets": [336, 352]},
+		"model.norm.weight": {"dtype": "F32", "shape": [4], "data_offsets": [352, 368]},
+		"lm_head.weight": {"dtype": "F32", "shape": [8, 4], "data_offsets": [368, 496]}
+	}`
+	var st bytes.Buffer
+	if err := binary.Write(&st, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+	st.WriteString(header)
+	st.Write(make([]byte, 496))
+
+	files := map[string]string{
+		"model.safetensors": blob(st.Bytes()),
+		"config.json":       blob([]byte(`{"architectures": ["LlamaForCausalLM"], "hidden_size": 4, "num_attention_heads": 2, "num_key_value_heads": 1, "num_hidden_layers": 1}`)),
+		"tokenizer.json":    blob([]byte(`{}`)),
+	}
+
+	t.Run("quantize", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test",
+			Files:     files,
+			SplitSize: 64,
+			Quantize:  "q8_0",
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), errSplitQuantize.Error()) {
+			t.Fatalf("expected split quantize error, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Files:     files,
+		SplitSize: 64,
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	mf, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var splits int
+	for _, l := range mf.Layers {
+		if l.MediaType == "application/vnd.ollama.image.model" {
+			splits++
+		}
+	}
+
+	// token_embd and output are F16 so each fills a split of its own, and
+	// the block's tensors and norms don't fit alongside them
+	if splits != 5 {
+		t.Fatalf("expected 5 model layers, got %d", splits)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the splits are linked under the name of the first split's blob
+	if dir, name := filepath.Split(m.ModelPath); filepath.Dir(filepath.Clean(dir)) != filepath.Join(p, "splits") || name != "model-00001-of-00005.gguf" {
+		t.Errorf("unexpected model path %s", m.ModelPath)
+	}
+
+	f, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kv := f.KV(); kv.Architecture() != "llama" {
+		t.Errorf("expected llama architecture, got %s", kv.Architecture())
+	} else if want := "sha256:" + conversionKey(files, nil, ""); kv["general.source_digest"] != want {
+		t.Errorf("expected source digest %s, got %v", want, kv["general.source_digest"])
+	}
+
+	if n := len(f.Tensors().Items()); n != 9 {
+		t.Errorf("expected 9 tensors across the splits, got %d", n)
+	}
+
+	t.Run("from", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "derived",
+			From:   "test",
+			System: "You are a test.",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		derived, err := GetModel("derived")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if derived.ModelPath != m.ModelPath {
+			t.Errorf("expected model path %s, got %s", m.ModelPath, derived.ModelPath)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		for _, name := range []string{"test", "derived"} {
+			mf, err := ParseNamedManifest(model.ParseName(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := mf.Remove(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := mf.RemoveLayers(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Dir(m.ModelPath)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected split links to be removed, got %v", err)
+		}
+	})
+}
@@ -20,6 +20,9 @@ import (
 	"testing"
 	"unicode"
 
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/openai"
@@ -130,7 +133,7 @@ func TestRoutes(t *testing.T) {
 
 		modelName := model.ParseName(name)
 
-		baseLayers, err := ggufLayers(digest, fn)
+		baseLayers, err := ggufLayers(digest, false, fn)
 		if err != nil {
 			t.Fatalf("failed to create model: %v", err)
 		}
@@ -677,8 +680,55 @@ func TestManifestCaseSensitivity(t *testing.T) {
 	}
 }
 
+func TestRegistryMirror(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var paths, headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		headers = append(headers, r.Header.Get("X-Test"))
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_REGISTRY_MIRRORS", "registry.invalid="+srv.URL+"/mirror")
+	t.Setenv("OLLAMA_REGISTRY_HEADERS", "X-Test=value")
+
+	var s Server
+	cases := []struct {
+		name    string
+		handler func(*gin.Context)
+		req     any
+	}{
+		{"pull", s.PullHandler, api.PullRequest{Model: "registry.invalid/library/missing", Stream: &stream}},
+		{"create", s.CreateHandler, api.CreateRequest{Model: "test", From: "registry.invalid/library/missing", Stream: &stream}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, headers = nil, nil
+
+			w := createRequest(t, tt.handler, tt.req)
+			if !strings.Contains(w.Body.String(), "error") {
+				t.Errorf("expected error, got %s", w.Body.String())
+			}
+
+			if diff := cmp.Diff([]string{"/mirror/v2/library/missing/manifests/latest"}, paths); diff != "" {
+				t.Errorf("unexpected paths (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff([]string{"value"}, headers); diff != "" {
+				t.Errorf("unexpected headers (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestShow(t *testing.T) {
 	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	// the test architecture can't be run
+	t.Setenv("OLLAMA_FORCE_IMPORT", "1")
 
 	var s Server
 
@@ -712,6 +762,117 @@ func TestShow(t *testing.T) {
 	}
 }
 
+func TestShowLayerErrors(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama"}, nil)
+	modelLayers, err := ggufLayers(digest, false, func(api.ProgressResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projector, err := NewLayer(strings.NewReader("not a gguf file"), "application/vnd.ollama.image.projector")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers := []Layer{modelLayers[0].Layer, projector}
+	config, err := createConfigLayer(layers, ConfigV2{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest(model.ParseName("partial"), *config, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: "partial"}); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code 500, actual %d", w.Code)
+	}
+
+	w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: "partial", Verbose: true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ModelInfo["general.architecture"] != "llama" {
+		t.Errorf("expected model architecture to be 'llama', got %v", resp.ModelInfo["general.architecture"])
+	}
+
+	if resp.ProjectorInfo != nil {
+		t.Errorf("expected no projector info, got %v", resp.ProjectorInfo)
+	}
+
+	if len(resp.LayerErrors) != 1 || resp.LayerErrors[projector.Digest] == "" {
+		t.Errorf("expected projector %s to fail, got %v", projector.Digest, resp.LayerErrors)
+	}
+}
+
+func TestShowAdapterLayerErrors(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "llama", "general.type": "adapter"}, nil)
+	adapter, err := NewLayerFromLayer(digest, "application/vnd.ollama.image.adapter", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter.Base = "missing"
+
+	corrupt, err := NewLayer(strings.NewReader("not a gguf file"), "application/vnd.ollama.image.model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	show := func(t *testing.T, name string, layers ...Layer) api.ShowResponse {
+		t.Helper()
+
+		config, err := createConfigLayer(layers, ConfigV2{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := WriteManifest(model.ParseName(name), *config, layers); err != nil {
+			t.Fatal(err)
+		}
+
+		w := createRequest(t, s.ShowHandler, api.ShowRequest{Model: name, Verbose: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ShowResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("corrupt model", func(t *testing.T) {
+		// the adapter is checked against the corrupt copy of its base model
+		// rather than looking for the base model
+		resp := show(t, "corrupt", corrupt, adapter)
+		if len(resp.LayerErrors) != 1 || resp.LayerErrors[corrupt.Digest] == "" {
+			t.Errorf("expected model %s to fail, got %v", corrupt.Digest, resp.LayerErrors)
+		}
+	})
+
+	t.Run("missing base", func(t *testing.T) {
+		resp := show(t, "missing-base", adapter)
+		if len(resp.LayerErrors) != 1 || !strings.Contains(resp.LayerErrors[adapter.Digest], "requires base model missing") {
+			t.Errorf("expected adapter %s to fail, got %v", adapter.Digest, resp.LayerErrors)
+		}
+	})
+}
+
 func TestNormalize(t *testing.T) {
 	type testCase struct {
 		input []float32
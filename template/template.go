@@ -5,8 +5,11 @@ import (
 	"embed"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
@@ -68,12 +71,78 @@ func (t named) Reader() io.Reader {
 	return bytes.NewReader(t.Bytes)
 }
 
+var (
+	registeredMu sync.RWMutex
+	registered   []*named
+)
+
+// Register adds a named template to the templates considered by [Named]. chatTemplate is
+// the model's chat template used for matching and tmpl is the template used when it matches.
+// Registering a name that already exists replaces the previously registered template.
+// It is safe to call Register concurrently with [Named].
+func Register(name, chatTemplate, tmpl string) error {
+	if name == "" {
+		return errors.New("template name is required")
+	}
+
+	if _, err := Parse(tmpl); err != nil {
+		return err
+	}
+
+	t := &named{
+		Name:     name,
+		Template: chatTemplate,
+		Bytes:    []byte(strings.ReplaceAll(tmpl, "\r\n", "\n")),
+	}
+
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registered = slices.DeleteFunc(registered, func(t *named) bool { return t.Name == name })
+	registered = append(registered, t)
+	return nil
+}
+
+// RegisterDir registers the templates in dir with [Register]. Each template is a
+// name.gotmpl file with a name.jinja file holding the chat template it matches.
+// A dir that doesn't exist has no templates.
+func RegisterDir(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.gotmpl"))
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), ".gotmpl")
+
+		tmpl, err := os.ReadFile(match)
+		if err != nil {
+			return err
+		}
+
+		chatTemplate, err := os.ReadFile(filepath.Join(dir, name+".jinja"))
+		if err != nil {
+			return err
+		}
+
+		if err := Register(name, string(chatTemplate), string(tmpl)); err != nil {
+			return fmt.Errorf("%s: %w", match, err)
+		}
+	}
+
+	return nil
+}
+
 func Named(s string) (*named, error) {
 	templates, err := templatesOnce()
 	if err != nil {
 		return nil, err
 	}
 
+	registeredMu.RLock()
+	// registered templates come first so they take precedence over built-in templates on ties
+	templates = append(slices.Clone(registered), templates...)
+	registeredMu.RUnlock()
+
 	var template *named
 	score := math.MaxInt
 	for _, t := range templates {
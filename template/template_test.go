@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -62,6 +65,113 @@ func TestNamed(t *testing.T) {
 	}
 }
 
+func TestRegister(t *testing.T) {
+	t.Cleanup(func() {
+		registeredMu.Lock()
+		defer registeredMu.Unlock()
+		registered = nil
+	})
+
+	chatTemplate := "{% for message in messages %}<<custom {{ message['role'] }}>>{{ message['content'] }}<</custom>>{% endfor %}"
+	if _, err := Named(chatTemplate); err == nil {
+		t.Fatal("expected no matching template before registering")
+	}
+
+	if err := Register("custom", chatTemplate, "{{ .Prompt }}"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Named(chatTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Name != "custom" {
+		t.Errorf("expected %q, got %q", "custom", r.Name)
+	}
+
+	if err := Register("custom", chatTemplate, "{{ .System }} {{ .Prompt }}"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = Named(chatTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(r.Bytes); s != "{{ .System }} {{ .Prompt }}" {
+		t.Errorf("expected replaced template, got %q", s)
+	}
+
+	if err := Register("invalid", chatTemplate, "{{ .Prompt"); err == nil {
+		t.Error("expected error registering an invalid template")
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := Register(fmt.Sprintf("custom-%d", i), chatTemplate, "{{ .Prompt }}"); err != nil {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if _, err := Named(chatTemplate); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestRegisterDir(t *testing.T) {
+	t.Cleanup(func() {
+		registeredMu.Lock()
+		defer registeredMu.Unlock()
+		registered = nil
+	})
+
+	if err := RegisterDir(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatalf("expected no error for a missing directory, got %v", err)
+	}
+
+	dir := t.TempDir()
+	chatTemplate := "{% for message in messages %}<<dir {{ message['role'] }}>>{{ message['content'] }}<</dir>>{% endfor %}"
+	for name, data := range map[string]string{
+		"in-house.gotmpl": "{{ .System }} {{ .Prompt }}",
+		"in-house.jinja":  chatTemplate,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RegisterDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Named(chatTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Name != "in-house" {
+		t.Errorf("expected %q, got %q", "in-house", r.Name)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "unmatched.gotmpl"), []byte("{{ .Prompt }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterDir(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %v for a template without a chat template, got %v", os.ErrNotExist, err)
+	}
+}
+
 func TestTemplate(t *testing.T) {
 	cases := make(map[string][]api.Message)
 	for _, mm := range [][]api.Message{